@@ -6,21 +6,45 @@ import (
 	"github.com/placer14/moxie/proxyhandler"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
 	var listenPort = flag.Int("port", 8080, "specify which port the proxy should listen on")
-	var defaultHost = flag.String("proxied-host", "http://http_three:8000", "default host to recieve proxied traffic")
+	var configPath = flag.String("config", "moxie.yml", "path to the YAML, JSON or TOML configuration file")
+	var defaultHost = flag.String("proxied-host", "", "default host to recieve proxied traffic, overriding the configuration file")
+	var reloadInterval = flag.Duration("reload-interval", 2*time.Second, "how often to check the configuration file for changes, 0 disables")
+	var debug = flag.Bool("debug", false, "include the cause of proxy errors in error responses")
+	var tlsCert = flag.String("tls-cert", "", "PEM certificate file used to serve TLS, overriding the configuration file")
+	var tlsKey = flag.String("tls-key", "", "PEM private key file of -tls-cert")
+	var adminPort = flag.Int("admin-port", 0, "port of the admin listener serving /metrics and the admin API, 0 disables")
 
 	flag.Parse()
 
-	var config = &proxyhandler.Configuration{
-		DefaultRoute: *defaultHost,
-		Routes: []*proxyhandler.RouteRule{
-			&proxyhandler.RouteRule{Path: "/foo", Endpoint: "http://http_one:8001"},
-			&proxyhandler.RouteRule{Path: "/bar", Endpoint: "http://http_two:8002"},
-			&proxyhandler.RouteRule{Path: "/ws", Endpoint: "ws://websocket_one"},
-		},
+	loadConfiguration := func() (*proxyhandler.Configuration, error) {
+		config, err := proxyhandler.LoadConfiguration(*configPath)
+		if err != nil {
+			return nil, err
+		}
+		if len(*defaultHost) > 0 {
+			config.DefaultRoute = *defaultHost
+		}
+		if *debug {
+			config.Debug = true
+		}
+		if len(*tlsCert) > 0 || len(*tlsKey) > 0 {
+			certificate := proxyhandler.CertificateConfiguration{CertFile: *tlsCert, KeyFile: *tlsKey}
+			config.TLS.Certificates = append([]proxyhandler.CertificateConfiguration{certificate}, config.TLS.Certificates...)
+		}
+		return config, nil
+	}
+
+	config, err := loadConfiguration()
+	if err != nil {
+		log.Fatalf("Error loading configuration: %s", err.Error())
 	}
 
 	p, err := proxyhandler.New(config)
@@ -28,6 +52,65 @@ func main() {
 		log.Fatalf("Error creating proxy: %s", err.Error())
 	}
 
-	log.Printf("Listening on port %d...", *listenPort)
-	log.Fatalln(http.ListenAndServe(fmt.Sprintf(":%d", *listenPort), p))
+	reload := func() {
+		config, err := loadConfiguration()
+		if err != nil {
+			log.Printf("Error reloading configuration: %s", err.Error())
+			return
+		}
+		p.Reload(config)
+	}
+	go reloadOnSignal(reload)
+	if *reloadInterval > 0 {
+		go reloadOnChange(*configPath, *reloadInterval, reload)
+	}
+
+	if *adminPort > 0 {
+		go func() {
+			log.Printf("Serving admin endpoints on port %d...", *adminPort)
+			log.Fatalln(http.ListenAndServe(fmt.Sprintf(":%d", *adminPort), p.AdminHandler()))
+		}()
+	}
+
+	server := &http.Server{Addr: fmt.Sprintf(":%d", *listenPort), Handler: p, TLSConfig: p.TLSConfig(), Protocols: p.Protocols()}
+	if server.TLSConfig == nil {
+		log.Printf("Listening on port %d...", *listenPort)
+		log.Fatalln(server.ListenAndServe())
+	}
+	if config.TLS.RedirectPort > 0 {
+		go func() {
+			log.Printf("Redirecting HTTP on port %d to HTTPS...", config.TLS.RedirectPort)
+			log.Fatalln(http.ListenAndServe(fmt.Sprintf(":%d", config.TLS.RedirectPort), proxyhandler.RedirectToHTTPS(*listenPort)))
+		}()
+	}
+	log.Printf("Listening for TLS on port %d...", *listenPort)
+	log.Fatalln(server.ListenAndServeTLS("", ""))
+}
+
+// reloadOnSignal calls reload each time the process receives SIGHUP.
+func reloadOnSignal(reload func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		log.Println("Received SIGHUP, reloading configuration")
+		reload()
+	}
+}
+
+// reloadOnChange calls reload whenever the modification time of the file at
+// path changes, checking once per interval.
+func reloadOnChange(path string, interval time.Duration, reload func()) {
+	var lastModified time.Time
+	if info, err := os.Stat(path); err == nil {
+		lastModified = info.ModTime()
+	}
+	for range time.Tick(interval) {
+		info, err := os.Stat(path)
+		if err != nil || info.ModTime().Equal(lastModified) {
+			continue
+		}
+		lastModified = info.ModTime()
+		log.Printf("Configuration file %s changed, reloading configuration", path)
+		reload()
+	}
 }
@@ -0,0 +1,360 @@
+package proxyhandler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AccessLogConfiguration enables the access log, which records one entry for
+// each completed request or websocket session. Format is one of "common",
+// "combined", the default, or "json". The common and combined formats are
+// followed by the name of the route, the backend, the size of the request
+// body and the seconds spent waiting for the backend and serving the request.
+// Output is "stdout", the default, "stderr" or the path of a file. A file is
+// rotated once it grows beyond MaxSize bytes, keeping MaxBackups previous
+// files named with the suffixes ".1", the most recent, to ".MaxBackups".
+type AccessLogConfiguration struct {
+	Format     string `yaml:"format"`
+	Output     string `yaml:"output"`
+	MaxSize    int64  `yaml:"max_size"`
+	MaxBackups int    `yaml:"max_backups"`
+}
+
+// accessLogSettings is a resolved AccessLogConfiguration. It is comparable so
+// that a reload may keep using the open access log when it is unchanged.
+type accessLogSettings struct {
+	Format     string
+	Output     string
+	MaxSize    int64
+	MaxBackups int
+}
+
+var defaultAccessLogSettings = accessLogSettings{
+	Format:     "combined",
+	Output:     "stdout",
+	MaxSize:    100 * 1024 * 1024,
+	MaxBackups: 5,
+}
+
+var accessLogFormats = map[string]func(*requestStats, *http.Request) []byte{
+	"common":   formatCommonLog,
+	"combined": formatCombinedLog,
+	"json":     formatJSONLog,
+}
+
+// validate returns the settings of the access log, or nil when it is not
+// enabled.
+func (accessLog *AccessLogConfiguration) validate() (*accessLogSettings, error) {
+	if accessLog == nil {
+		return nil, nil
+	}
+	if accessLog.MaxSize < 0 {
+		return nil, fmt.Errorf("max size is negative")
+	}
+	if accessLog.MaxBackups < 0 {
+		return nil, fmt.Errorf("max backups is negative")
+	}
+	settings := defaultAccessLogSettings
+	if len(accessLog.Format) > 0 {
+		settings.Format = accessLog.Format
+	}
+	if _, ok := accessLogFormats[settings.Format]; !ok {
+		return nil, fmt.Errorf("unknown format: %s", settings.Format)
+	}
+	if len(accessLog.Output) > 0 {
+		settings.Output = accessLog.Output
+	}
+	if accessLog.MaxSize > 0 {
+		settings.MaxSize = accessLog.MaxSize
+	}
+	if accessLog.MaxBackups > 0 {
+		settings.MaxBackups = accessLog.MaxBackups
+	}
+	return &settings, nil
+}
+
+// accessLogger writes entries to the access log. Requests hold the logger
+// open while they are served, so that closing it on a reload does not lose
+// the entries of requests still in progress.
+type accessLogger struct {
+	settings accessLogSettings
+	format   func(*requestStats, *http.Request) []byte
+	mutex    sync.Mutex
+	output   io.Writer
+	users    int
+	closing  bool
+	closed   bool
+}
+
+func openAccessLog(settings accessLogSettings) (*accessLogger, error) {
+	logger := &accessLogger{settings: settings, format: accessLogFormats[settings.Format]}
+	switch settings.Output {
+	case "stdout":
+		logger.output = os.Stdout
+	case "stderr":
+		logger.output = os.Stderr
+	default:
+		file, err := openRotatingFile(settings.Output, settings.MaxSize, settings.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		logger.output = file
+	}
+	return logger, nil
+}
+
+// log records the completed request described by stats. A nil or closed
+// accessLogger records nothing.
+func (logger *accessLogger) log(stats *requestStats, request *http.Request) {
+	if logger == nil {
+		return
+	}
+	entry := logger.format(stats, request)
+	logger.mutex.Lock()
+	defer logger.mutex.Unlock()
+	if logger.closed {
+		return
+	}
+	if _, err := logger.output.Write(entry); err != nil {
+		log.Printf("access log: error writing entry: %s", err.Error())
+	}
+}
+
+// acquire holds the logger open for a request until release is called. It
+// reports false when the logger is being closed and must not be used. A nil
+// accessLogger may always be acquired.
+func (logger *accessLogger) acquire() bool {
+	if logger == nil {
+		return true
+	}
+	logger.mutex.Lock()
+	defer logger.mutex.Unlock()
+	if logger.closing {
+		return false
+	}
+	logger.users++
+	return true
+}
+
+// release lets go of a logger held by acquire.
+func (logger *accessLogger) release() {
+	if logger == nil {
+		return
+	}
+	logger.mutex.Lock()
+	defer logger.mutex.Unlock()
+	logger.users--
+	if logger.closing && logger.users == 0 {
+		logger.closeOutput()
+	}
+}
+
+// close closes the file of the access log, if any, once every request
+// holding the logger has released it.
+func (logger *accessLogger) close() {
+	if logger == nil {
+		return
+	}
+	logger.mutex.Lock()
+	defer logger.mutex.Unlock()
+	logger.closing = true
+	if logger.users == 0 {
+		logger.closeOutput()
+	}
+}
+
+// closeOutput closes the file of the access log. The mutex must be held.
+func (logger *accessLogger) closeOutput() {
+	if logger.closed {
+		return
+	}
+	logger.closed = true
+	if file, ok := logger.output.(*rotatingFile); ok {
+		file.Close()
+	}
+}
+
+// clientHost is the address of the client of request, without its port.
+func clientHost(request *http.Request) string {
+	if host, _, err := net.SplitHostPort(request.RemoteAddr); err == nil {
+		return host
+	}
+	return request.RemoteAddr
+}
+
+// dashIfEmpty returns value, or "-" in place of an empty value.
+func dashIfEmpty(value string) string {
+	if len(value) == 0 {
+		return "-"
+	}
+	return value
+}
+
+// logToken returns value as a single field of a log line, quoting it when it
+// contains spaces, quotes or control characters.
+func logToken(value string) string {
+	if len(value) == 0 {
+		return "-"
+	}
+	for _, character := range value {
+		if character <= ' ' || character == '"' || character == 0x7f {
+			return strconv.Quote(value)
+		}
+	}
+	return value
+}
+
+func formatCommonFields(buffer *bytes.Buffer, stats *requestStats, request *http.Request) {
+	user, _, _ := request.BasicAuth()
+	size := "-"
+	if written := stats.ResponseBytes(); written > 0 {
+		size = strconv.FormatInt(written, 10)
+	}
+	fmt.Fprintf(buffer, "%s - %s [%s] %s %d %s",
+		clientHost(request), logToken(user),
+		stats.Start.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(request.Method+" "+request.RequestURI+" "+request.Proto),
+		stats.Status, size)
+}
+
+func formatExtensionFields(buffer *bytes.Buffer, stats *requestStats) {
+	fmt.Fprintf(buffer, " %s %s %d %.3f %.3f\n",
+		strconv.Quote(stats.Route), strconv.Quote(dashIfEmpty(stats.Backend)), stats.RequestBytes(),
+		stats.UpstreamLatency.Seconds(), stats.Duration.Seconds())
+}
+
+func formatCommonLog(stats *requestStats, request *http.Request) []byte {
+	var buffer bytes.Buffer
+	formatCommonFields(&buffer, stats, request)
+	formatExtensionFields(&buffer, stats)
+	return buffer.Bytes()
+}
+
+func formatCombinedLog(stats *requestStats, request *http.Request) []byte {
+	var buffer bytes.Buffer
+	formatCommonFields(&buffer, stats, request)
+	fmt.Fprintf(&buffer, " %s %s",
+		strconv.Quote(dashIfEmpty(request.Referer())), strconv.Quote(dashIfEmpty(request.UserAgent())))
+	formatExtensionFields(&buffer, stats)
+	return buffer.Bytes()
+}
+
+type jsonAccessLogEntry struct {
+	Time              string  `json:"time"`
+	RequestID         string  `json:"request_id,omitempty"`
+	RemoteAddr        string  `json:"remote_addr"`
+	Method            string  `json:"method"`
+	URI               string  `json:"uri"`
+	Protocol          string  `json:"protocol"`
+	Host              string  `json:"host"`
+	Status            int     `json:"status"`
+	RequestBytes      int64   `json:"request_bytes"`
+	ResponseBytes     int64   `json:"response_bytes"`
+	Referer           string  `json:"referer,omitempty"`
+	UserAgent         string  `json:"user_agent,omitempty"`
+	Route             string  `json:"route"`
+	Backend           string  `json:"backend,omitempty"`
+	UpstreamLatencyMs float64 `json:"upstream_latency_ms"`
+	TotalLatencyMs    float64 `json:"total_latency_ms"`
+	Websocket         bool    `json:"websocket,omitempty"`
+}
+
+func formatJSONLog(stats *requestStats, request *http.Request) []byte {
+	entry := jsonAccessLogEntry{
+		Time:              stats.Start.Format(time.RFC3339Nano),
+		RequestID:         stats.RequestID,
+		RemoteAddr:        clientHost(request),
+		Method:            request.Method,
+		URI:               request.RequestURI,
+		Protocol:          request.Proto,
+		Host:              request.Host,
+		Status:            stats.Status,
+		RequestBytes:      stats.RequestBytes(),
+		ResponseBytes:     stats.ResponseBytes(),
+		Referer:           request.Referer(),
+		UserAgent:         request.UserAgent(),
+		Route:             stats.Route,
+		Backend:           stats.Backend,
+		UpstreamLatencyMs: float64(stats.UpstreamLatency) / float64(time.Millisecond),
+		TotalLatencyMs:    float64(stats.Duration) / float64(time.Millisecond),
+		Websocket:         stats.Websocket,
+	}
+	encoded, _ := json.Marshal(entry)
+	return append(encoded, '\n')
+}
+
+// rotatingFile is a log file which is renamed to make way for a new file once
+// it grows beyond maxSize bytes.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	file := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := file.open(); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (file *rotatingFile) open() error {
+	opened, err := os.OpenFile(file.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("opening access log: %s", err.Error())
+	}
+	info, err := opened.Stat()
+	if err != nil {
+		opened.Close()
+		return fmt.Errorf("opening access log: %s", err.Error())
+	}
+	file.file, file.size = opened, info.Size()
+	return nil
+}
+
+// Write appends data to the file, rotating it first when data would take it
+// beyond its maximum size. Callers serialize writes.
+func (file *rotatingFile) Write(data []byte) (int, error) {
+	if file.file == nil {
+		return 0, fmt.Errorf("access log %s is closed", file.path)
+	}
+	if file.size > 0 && file.size+int64(len(data)) > file.maxSize {
+		if err := file.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	written, err := file.file.Write(data)
+	file.size += int64(written)
+	return written, err
+}
+
+func (file *rotatingFile) rotate() error {
+	file.file.Close()
+	file.file = nil
+	for index := file.maxBackups - 1; index > 0; index-- {
+		os.Rename(fmt.Sprintf("%s.%d", file.path, index), fmt.Sprintf("%s.%d", file.path, index+1))
+	}
+	os.Rename(file.path, file.path+".1")
+	return file.open()
+}
+
+func (file *rotatingFile) Close() error {
+	if file.file == nil {
+		return nil
+	}
+	err := file.file.Close()
+	file.file = nil
+	return err
+}
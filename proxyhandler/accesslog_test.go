@@ -0,0 +1,283 @@
+package proxyhandler
+
+import (
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"github.com/jarcoal/httpmock"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func buildRequestStats() *requestStats {
+	return &requestStats{
+		Start:           time.Date(2020, time.March, 4, 5, 6, 7, 0, time.UTC),
+		Route:           "api",
+		Backend:         "http://endpoint.one",
+		UpstreamLatency: 12 * time.Millisecond,
+		Status:          http.StatusCreated,
+		Duration:        15 * time.Millisecond,
+		requestBytes:    7,
+		responseBytes:   42,
+	}
+}
+
+func buildAccessLogRequest() *http.Request {
+	request := httptest.NewRequest("POST", "/api/items?page=2", nil)
+	request.RemoteAddr = "203.0.113.7:4321"
+	request.SetBasicAuth("frank", "secret")
+	request.Header.Set("Referer", "http://example.com/start")
+	request.Header.Set("User-Agent", "curl/7.68.0")
+	return request
+}
+
+func TestAccessLogFormats(t *testing.T) {
+	var expectations = map[string]string{
+		"common": `203.0.113.7 - frank [04/Mar/2020:05:06:07 +0000] "POST /api/items?page=2 HTTP/1.1" 201 42 "api" "http://endpoint.one" 7 0.012 0.015` + "\n",
+		"combined": `203.0.113.7 - frank [04/Mar/2020:05:06:07 +0000] "POST /api/items?page=2 HTTP/1.1" 201 42 "http://example.com/start" "curl/7.68.0" ` +
+			`"api" "http://endpoint.one" 7 0.012 0.015` + "\n",
+		"json": `{"time":"2020-03-04T05:06:07Z","remote_addr":"203.0.113.7","method":"POST","uri":"/api/items?page=2","protocol":"HTTP/1.1",` +
+			`"host":"example.com","status":201,"request_bytes":7,"response_bytes":42,"referer":"http://example.com/start","user_agent":"curl/7.68.0",` +
+			`"route":"api","backend":"http://endpoint.one","upstream_latency_ms":12,"total_latency_ms":15}` + "\n",
+	}
+	for format, expected := range expectations {
+		entry := string(accessLogFormats[format](buildRequestStats(), buildAccessLogRequest()))
+		if entry != expected {
+			t.Errorf("unexpected %s entry\nexpected: %v\nreceived: %v", format, expected, entry)
+		}
+	}
+}
+
+func TestAccessLogConfigurationValidate(t *testing.T) {
+	settings, err := (&AccessLogConfiguration{Format: "json"}).validate()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	expected := defaultAccessLogSettings
+	expected.Format = "json"
+	if *settings != expected {
+		t.Errorf("unexpected settings\nexpected: %+v\nreceived: %+v", expected, *settings)
+	}
+
+	var expectations = map[string]*AccessLogConfiguration{
+		"invalid access log: unknown format: apache":  {Format: "apache"},
+		"invalid access log: max size is negative":    {MaxSize: -1},
+		"invalid access log: max backups is negative": {MaxBackups: -1},
+	}
+	for expectedError, accessLog := range expectations {
+		config := buildConfiguration()
+		config.AccessLog = accessLog
+		_, err := config.validate()
+		if err == nil || !strings.Contains(err.Error(), expectedError) {
+			t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+		}
+	}
+}
+
+func TestRotatingFileKeepsBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	file, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	defer file.Close()
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := file.Write([]byte(line)); err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+	}
+
+	var expectations = map[string]string{
+		path:        "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	}
+	for name, expected := range expectations {
+		contents, _ := ioutil.ReadFile(name)
+		if string(contents) != expected {
+			t.Errorf("unexpected contents of %s\nexpected: %q\nreceived: %q", name, expected, string(contents))
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected only 2 backups to be kept\nexpected: %v\nreceived: %v", "no "+path+".3", err)
+	}
+}
+
+func readAccessLog(t *testing.T, path string) []jsonAccessLogEntry {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	var entries []jsonAccessLogEntry
+	for _, line := range strings.Split(strings.TrimSpace(string(contents)), "\n") {
+		var entry jsonAccessLogEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestProxyWritesAccessLog(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	httpmock.RegisterResponder("POST", "http://endpoint.one/route1/items", func(request *http.Request) (*http.Response, error) {
+		ioutil.ReadAll(request.Body)
+		return httpmock.NewStringResponse(http.StatusCreated, "created"), nil
+	})
+	path := filepath.Join(t.TempDir(), "access.log")
+	config := buildConfiguration()
+	config.Routes[0].Name = "items"
+	config.AccessLog = &AccessLogConfiguration{Format: "json", Output: path}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	defer h.Close()
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/route1/items", strings.NewReader("new item")))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/other", nil))
+
+	entries := readAccessLog(t, path)
+	if len(entries) != 2 {
+		t.Fatalf("unexpected number of entries\nexpected: %v\nreceived: %v", 2, len(entries))
+	}
+	entry := entries[0]
+	if entry.Route != "items" || entry.Backend != "http://endpoint.one" || entry.Status != http.StatusCreated {
+		t.Errorf("unexpected entry\nexpected: %v\nreceived: %+v", "items http://endpoint.one 201", entry)
+	}
+	if entry.RequestBytes != int64(len("new item")) || entry.ResponseBytes != int64(len("created")) {
+		t.Errorf("unexpected sizes\nexpected: %v %v\nreceived: %v %v", len("new item"), len("created"), entry.RequestBytes, entry.ResponseBytes)
+	}
+	if entry.TotalLatencyMs < entry.UpstreamLatencyMs {
+		t.Errorf("expected total latency to include upstream latency\nexpected: >= %v\nreceived: %v", entry.UpstreamLatencyMs, entry.TotalLatencyMs)
+	}
+	if entry := entries[1]; entry.Route != "default" || entry.Status != http.StatusBadGateway {
+		t.Errorf("unexpected entry\nexpected: %v\nreceived: %+v", "default 502", entry)
+	}
+}
+
+func TestReloadKeepsUnchangedAccessLog(t *testing.T) {
+	dir := t.TempDir()
+	config := buildConfiguration()
+	config.AccessLog = &AccessLogConfiguration{Output: filepath.Join(dir, "access.log")}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	defer h.Close()
+	initial := h.configuration().AccessLog
+
+	h.Reload(config)
+	if h.configuration().AccessLog != initial {
+		t.Error("expected unchanged access log to be kept")
+	}
+	config.AccessLog = &AccessLogConfiguration{Output: filepath.Join(dir, "other.log")}
+	h.Reload(config)
+	if h.configuration().AccessLog == initial || !initial.closed {
+		t.Error("expected changed access log to replace and close the previous one")
+	}
+}
+
+func TestReloadLogsRequestsInProgressToPreviousAccessLog(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	httpmock.RegisterResponder("GET", "http://endpoint.one/route1", func(r *http.Request) (*http.Response, error) {
+		close(started)
+		<-release
+		return httpmock.NewStringResponse(http.StatusOK, ""), nil
+	})
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	config := buildConfiguration()
+	config.AccessLog = &AccessLogConfiguration{Format: "json", Output: path}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	defer h.Close()
+	initial := h.configuration().AccessLog
+
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/route1", nil))
+		close(done)
+	}()
+	<-started
+	config.AccessLog = &AccessLogConfiguration{Format: "json", Output: filepath.Join(dir, "other.log")}
+	if err := h.Reload(config); err != nil {
+		t.Fatalf("unable to reload proxyhandler: %s", err.Error())
+	}
+	close(release)
+	<-done
+
+	if entries := readAccessLog(t, path); len(entries) != 1 || entries[0].Route != "/route1" {
+		t.Errorf("expected request in progress to be logged\nexpected: %v\nreceived: %+v", "/route1", entries)
+	}
+	initial.mutex.Lock()
+	defer initial.mutex.Unlock()
+	if !initial.closed {
+		t.Error("expected previous access log to be closed once the request was logged")
+	}
+}
+
+func TestProxyLogsWebsocketSessions(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		connection, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer connection.Close()
+		messageType, message, err := connection.ReadMessage()
+		if err != nil {
+			return
+		}
+		connection.WriteMessage(messageType, message)
+	}))
+	defer backend.Close()
+
+	path := filepath.Join(t.TempDir(), "access.log")
+	config := buildConfiguration()
+	config.Routes = []*RouteRule{{Path: "/ws", Endpoint: "ws://" + strings.TrimPrefix(backend.URL, "http://")}}
+	config.AccessLog = &AccessLogConfiguration{Format: "json", Output: path}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	defer h.Close()
+	proxy := httptest.NewServer(h)
+	defer proxy.Close()
+
+	connection, _, err := websocket.DefaultDialer.Dial("ws://"+strings.TrimPrefix(proxy.URL, "http://")+"/ws", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	connection.WriteMessage(websocket.TextMessage, []byte("hello"))
+	connection.ReadMessage()
+	connection.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if contents, _ := ioutil.ReadFile(path); len(contents) > 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	entries := readAccessLog(t, path)
+	entry := entries[0]
+	if !entry.Websocket || entry.Status != http.StatusSwitchingProtocols || entry.Route != "/ws" {
+		t.Errorf("unexpected entry\nexpected: %v\nreceived: %+v", "websocket /ws 101", entry)
+	}
+	if entry.RequestBytes == 0 || entry.ResponseBytes == 0 {
+		t.Errorf("expected session traffic to be counted\nexpected: %v\nreceived: %v %v", "non-zero sizes", entry.RequestBytes, entry.ResponseBytes)
+	}
+}
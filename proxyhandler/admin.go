@@ -0,0 +1,317 @@
+package proxyhandler
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// AdminConfiguration controls the admin API. Requests to the API must carry
+// Token in an "Authorization: Bearer" header, and the API is disabled when no
+// Token is set.
+type AdminConfiguration struct {
+	Token string `yaml:"token"`
+}
+
+// redactedToken replaces the admin token and other secrets in configurations
+// returned by the admin API.
+const redactedToken = "REDACTED"
+
+// maxAdminRequestSize limits the size of request bodies sent to the admin API.
+const maxAdminRequestSize = 1 << 20
+
+// AdminHandler returns the http.Handler of the admin listener, which serves
+// the metrics of the handler in the Prometheus text format at /metrics and
+// the admin API under /api/. It is intended to be served on a separate port
+// from the proxy.
+func (handler *ProxyHandler) AdminHandler() http.Handler {
+	api := &adminAPI{handler: handler}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", handler.metrics)
+	mux.Handle("/api/", api.authenticate(api.routes()))
+	return mux
+}
+
+// adminAPI serves JSON endpoints which inspect and change the configuration
+// of a ProxyHandler. Changes are applied by reloading the handler with a
+// modified copy of its configuration, so they last until the configuration
+// is next reloaded from its source.
+type adminAPI struct {
+	handler *ProxyHandler
+}
+
+func (api *adminAPI) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/api/config", adminMethods{"GET": api.getConfiguration})
+	mux.Handle("/api/config/validate", adminMethods{"POST": api.validateConfiguration})
+	mux.Handle("/api/routes", adminMethods{"GET": api.listRoutes, "POST": api.addRoute})
+	mux.Handle("/api/routes/", adminMethods{"DELETE": api.removeRoute})
+	mux.Handle("/api/routes/order", adminMethods{"PUT": api.reorderRoutes})
+	mux.Handle("/api/backends", adminMethods{"GET": api.listBackends})
+	mux.Handle("/api/backends/drain", adminMethods{"POST": api.setBackendMode(backendDraining)})
+	mux.Handle("/api/backends/disable", adminMethods{"POST": api.setBackendMode(backendDisabled)})
+	mux.Handle("/api/backends/enable", adminMethods{"POST": api.setBackendMode(backendActive)})
+	return mux
+}
+
+// adminMethods serves each request to an admin API path with the handler for
+// its method.
+type adminMethods map[string]http.HandlerFunc
+
+func (methods adminMethods) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	handler, ok := methods[request.Method]
+	if !ok {
+		allowed := make([]string, 0, len(methods))
+		for method := range methods {
+			allowed = append(allowed, method)
+		}
+		sort.Strings(allowed)
+		writer.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeAdminError(writer, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", request.Method))
+		return
+	}
+	handler(writer, request)
+}
+
+// authenticate only passes requests bearing the admin token on to next.
+func (api *adminAPI) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		token := api.handler.configuration().AdminToken
+		if len(token) == 0 {
+			writeAdminError(writer, http.StatusForbidden, fmt.Errorf("admin api is disabled, no admin token is configured"))
+			return
+		}
+		authorization := request.Header.Get("Authorization")
+		presented := strings.TrimPrefix(authorization, "Bearer ")
+		if presented == authorization || subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+			writer.Header().Set("WWW-Authenticate", `Bearer realm="moxie"`)
+			writeAdminError(writer, http.StatusUnauthorized, fmt.Errorf("invalid admin token"))
+			return
+		}
+		next.ServeHTTP(writer, request)
+	})
+}
+
+func writeAdminJSON(writer http.ResponseWriter, status int, value interface{}) {
+	encoded, err := encodeJSON(value)
+	if err != nil {
+		log.Printf("admin: error encoding response: %s", err.Error())
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	writer.Write(append(encoded, '\n'))
+}
+
+func writeAdminError(writer http.ResponseWriter, status int, err error) {
+	writeAdminJSON(writer, status, map[string]string{"error": err.Error()})
+}
+
+// readAdminRequest decodes the JSON body of request into value.
+func readAdminRequest(request *http.Request, value interface{}) error {
+	body, err := io.ReadAll(io.LimitReader(request.Body, maxAdminRequestSize+1))
+	if err != nil {
+		return fmt.Errorf("reading request: %s", err.Error())
+	}
+	if len(body) > maxAdminRequestSize {
+		return fmt.Errorf("request is larger than %d bytes", maxAdminRequestSize)
+	}
+	if len(strings.TrimSpace(string(body))) == 0 {
+		return fmt.Errorf("request body is empty")
+	}
+	if err := decodeJSON(body, value); err != nil {
+		return fmt.Errorf("invalid request: %s", err.Error())
+	}
+	return nil
+}
+
+// currentConfiguration returns a copy of the configuration the handler is
+// serving.
+func (api *adminAPI) currentConfiguration() (*Configuration, error) {
+	return cloneConfiguration(api.handler.configuration().Source)
+}
+
+// apply makes the handler serve the configuration modified by change and
+// responds with its routes, or with the reason the change was rejected.
+// change reports errors in the request as a proxyError with their status.
+func (api *adminAPI) apply(writer http.ResponseWriter, status int, change func(config *Configuration) error) {
+	var routes []*RouteRule
+	err := api.handler.reloadWith(func(config *Configuration) error {
+		if err := change(config); err != nil {
+			return err
+		}
+		routes = config.Routes
+		return nil
+	})
+	var requestErr *proxyError
+	switch {
+	case errors.As(err, &requestErr):
+		writeAdminError(writer, requestErr.Status, requestErr.Err)
+	case err != nil:
+		writeAdminError(writer, http.StatusUnprocessableEntity, err)
+	default:
+		writeAdminJSON(writer, status, routes)
+	}
+}
+
+func (api *adminAPI) getConfiguration(writer http.ResponseWriter, request *http.Request) {
+	config, err := api.currentConfiguration()
+	if err != nil {
+		writeAdminError(writer, http.StatusInternalServerError, err)
+		return
+	}
+	redactConfiguration(config)
+	writeAdminJSON(writer, http.StatusOK, config)
+}
+
+// redactConfiguration replaces the secrets held by config: the admin token
+// and the values of the headers sent to the tracing collector, which usually
+// carry its credentials.
+func redactConfiguration(config *Configuration) {
+	if len(config.Admin.Token) > 0 {
+		config.Admin.Token = redactedToken
+	}
+	if config.Tracing != nil {
+		for name := range config.Tracing.Headers {
+			config.Tracing.Headers[name] = redactedToken
+		}
+	}
+}
+
+// validateConfiguration reports whether the configuration in the request is
+// valid without applying it.
+func (api *adminAPI) validateConfiguration(writer http.ResponseWriter, request *http.Request) {
+	config := &Configuration{}
+	if err := readAdminRequest(request, config); err != nil {
+		writeAdminError(writer, http.StatusBadRequest, err)
+		return
+	}
+	if _, err := config.validate(); err != nil {
+		writeAdminJSON(writer, http.StatusUnprocessableEntity, map[string]interface{}{"valid": false, "error": err.Error()})
+		return
+	}
+	writeAdminJSON(writer, http.StatusOK, map[string]interface{}{"valid": true})
+}
+
+func (api *adminAPI) listRoutes(writer http.ResponseWriter, request *http.Request) {
+	writeAdminJSON(writer, http.StatusOK, api.handler.configuration().Source.Routes)
+}
+
+// addRoute inserts the route in the request at the position given by the
+// index query parameter, or after every other route.
+func (api *adminAPI) addRoute(writer http.ResponseWriter, request *http.Request) {
+	route := &RouteRule{}
+	if err := readAdminRequest(request, route); err != nil {
+		writeAdminError(writer, http.StatusBadRequest, err)
+		return
+	}
+	api.apply(writer, http.StatusCreated, func(config *Configuration) error {
+		index := len(config.Routes)
+		if value := request.URL.Query().Get("index"); len(value) > 0 {
+			var err error
+			index, err = strconv.Atoi(value)
+			if err != nil || index < 0 || index > len(config.Routes) {
+				return &proxyError{Status: http.StatusBadRequest, Err: fmt.Errorf("index must be between 0 and %d", len(config.Routes))}
+			}
+		}
+		config.Routes = append(config.Routes[:index], append([]*RouteRule{route}, config.Routes[index:]...)...)
+		return nil
+	})
+}
+
+func (api *adminAPI) removeRoute(writer http.ResponseWriter, request *http.Request) {
+	value := strings.TrimPrefix(request.URL.Path, "/api/routes/")
+	api.apply(writer, http.StatusOK, func(config *Configuration) error {
+		index, err := strconv.Atoi(value)
+		if err != nil || index < 0 || index >= len(config.Routes) {
+			return &proxyError{Status: http.StatusNotFound, Err: fmt.Errorf("no route at index %s", value)}
+		}
+		config.Routes = append(config.Routes[:index], config.Routes[index+1:]...)
+		return nil
+	})
+}
+
+// routeOrder lists the current index of each route in its new order.
+type routeOrder struct {
+	Order []int `yaml:"order"`
+}
+
+func (api *adminAPI) reorderRoutes(writer http.ResponseWriter, request *http.Request) {
+	var order routeOrder
+	if err := readAdminRequest(request, &order); err != nil {
+		writeAdminError(writer, http.StatusBadRequest, err)
+		return
+	}
+	api.apply(writer, http.StatusOK, func(config *Configuration) error {
+		invalid := &proxyError{Status: http.StatusBadRequest, Err: fmt.Errorf("order must list each of the %d route indexes once", len(config.Routes))}
+		if len(order.Order) != len(config.Routes) {
+			return invalid
+		}
+		reordered := make([]*RouteRule, len(config.Routes))
+		for position, index := range order.Order {
+			if index < 0 || index >= len(config.Routes) || config.Routes[index] == nil {
+				return invalid
+			}
+			reordered[position] = config.Routes[index]
+			config.Routes[index] = nil
+		}
+		config.Routes = reordered
+		return nil
+	})
+}
+
+// adminBackend describes a backend in responses of the admin API.
+type adminBackend struct {
+	URL            string `yaml:"url"`
+	Mode           string `yaml:"mode"`
+	Healthy        bool   `yaml:"healthy"`
+	ActiveRequests int64  `yaml:"active_requests"`
+}
+
+func describeBackend(key string, state *backendState) adminBackend {
+	return adminBackend{URL: key, Mode: backendModeNames[state.backendMode()], Healthy: state.healthy(), ActiveRequests: state.active()}
+}
+
+func (api *adminAPI) listBackends(writer http.ResponseWriter, request *http.Request) {
+	backends := []adminBackend{}
+	api.handler.backends.each(func(key string, state *backendState) {
+		backends = append(backends, describeBackend(key, state))
+	})
+	writeAdminJSON(writer, http.StatusOK, backends)
+}
+
+// setBackendMode returns the endpoint which puts the backend with the URL in
+// the request in mode. The mode of a backend outlasts reloads which keep
+// using it.
+func (api *adminAPI) setBackendMode(mode int32) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		var target struct {
+			URL string `yaml:"url"`
+		}
+		if err := readAdminRequest(request, &target); err != nil {
+			writeAdminError(writer, http.StatusBadRequest, err)
+			return
+		}
+		targetURL, err := parseEndpoint(target.URL)
+		if err != nil {
+			writeAdminError(writer, http.StatusBadRequest, fmt.Errorf("invalid url: %s", err.Error()))
+			return
+		}
+		key := targetURL.String()
+		state := api.handler.backends.state(key)
+		if state == nil {
+			writeAdminError(writer, http.StatusNotFound, fmt.Errorf("no backend with url %s", key))
+			return
+		}
+		state.setBackendMode(mode)
+		log.Printf("admin: backend %s is %s", key, backendModeNames[mode])
+		writeAdminJSON(writer, http.StatusOK, describeBackend(key, state))
+	}
+}
@@ -0,0 +1,249 @@
+package proxyhandler
+
+import (
+	"encoding/json"
+	"github.com/jarcoal/httpmock"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func buildAdminHandler(t *testing.T) *ProxyHandler {
+	config := buildConfiguration()
+	config.Admin.Token = "secret"
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	return h
+}
+
+// adminRequest sends a request bearing token to the admin API of h.
+func adminRequest(h *ProxyHandler, token, method, path, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	if len(token) > 0 {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	recorder := httptest.NewRecorder()
+	h.AdminHandler().ServeHTTP(recorder, request)
+	return recorder
+}
+
+func routeEndpoints(t *testing.T, recorder *httptest.ResponseRecorder) []string {
+	var routes []struct {
+		Endpoint string `json:"endpoint"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &routes); err != nil {
+		t.Fatalf("unexpected error: %s: %s", err.Error(), recorder.Body.String())
+	}
+	endpoints := make([]string, len(routes))
+	for index, route := range routes {
+		endpoints[index] = route.Endpoint
+	}
+	return endpoints
+}
+
+func TestAdminAPIRequiresToken(t *testing.T) {
+	h, err := New(buildConfiguration())
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	if recorder := adminRequest(h, "secret", "GET", "/api/config", ""); recorder.Code != http.StatusForbidden {
+		t.Errorf("expected api to be disabled without a token\nexpected: %v\nreceived: %v", http.StatusForbidden, recorder.Code)
+	}
+
+	h = buildAdminHandler(t)
+	var expectations = map[string]int{
+		"":       http.StatusUnauthorized,
+		"wrong":  http.StatusUnauthorized,
+		"secret": http.StatusOK,
+	}
+	for token, expected := range expectations {
+		if recorder := adminRequest(h, token, "GET", "/api/config", ""); recorder.Code != expected {
+			t.Errorf("unexpected status for token %q\nexpected: %v\nreceived: %v", token, expected, recorder.Code)
+		}
+	}
+	request := httptest.NewRequest("GET", "/api/config", nil)
+	request.Header.Set("Authorization", "secret")
+	recorder := httptest.NewRecorder()
+	h.AdminHandler().ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("expected token without bearer scheme to be rejected\nexpected: %v\nreceived: %v", http.StatusUnauthorized, recorder.Code)
+	}
+}
+
+func TestAdminAPIListsConfiguration(t *testing.T) {
+	h := buildAdminHandler(t)
+	recorder := adminRequest(h, "secret", "GET", "/api/config", "")
+	var config map[string]interface{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &config); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if config["default_route"] != "http://default.endpoint" {
+		t.Errorf("unexpected default route\nexpected: %v\nreceived: %v", "http://default.endpoint", config["default_route"])
+	}
+	if admin := config["admin"].(map[string]interface{}); admin["token"] != redactedToken {
+		t.Errorf("expected token to be redacted\nexpected: %v\nreceived: %v", redactedToken, admin["token"])
+	}
+	if endpoints := routeEndpoints(t, adminRequest(h, "secret", "GET", "/api/routes", "")); len(endpoints) != 1 || endpoints[0] != "http://endpoint.one" {
+		t.Errorf("unexpected routes\nexpected: %v\nreceived: %v", []string{"http://endpoint.one"}, endpoints)
+	}
+}
+
+func TestAdminAPIRedactsTracingHeaders(t *testing.T) {
+	config := buildConfiguration()
+	config.Admin.Token = "secret"
+	config.Tracing = &TracingConfiguration{Endpoint: "http://collector.example.com", Headers: map[string]string{"Authorization": "Bearer collector-secret"}}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	defer h.Close()
+
+	recorder := adminRequest(h, "secret", "GET", "/api/config", "")
+	if strings.Contains(recorder.Body.String(), "collector-secret") {
+		t.Errorf("expected tracing headers to be redacted\nexpected: %v\nreceived: %v", redactedToken, recorder.Body.String())
+	}
+	var received struct {
+		Tracing struct {
+			Headers map[string]string `json:"headers"`
+		} `json:"tracing"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &received); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if received.Tracing.Headers["Authorization"] != redactedToken {
+		t.Errorf("expected tracing header to be redacted\nexpected: %v\nreceived: %v", redactedToken, received.Tracing.Headers["Authorization"])
+	}
+	if header := h.configuration().Source.Tracing.Headers["Authorization"]; header != "Bearer collector-secret" {
+		t.Errorf("expected served configuration to keep its tracing headers\nexpected: %v\nreceived: %v", "Bearer collector-secret", header)
+	}
+}
+
+func TestAdminAPIChangesRoutes(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	httpmock.RegisterResponder("GET", "http://endpoint.two/route2", httpmock.NewStringResponder(http.StatusOK, "two"))
+	h := buildAdminHandler(t)
+
+	recorder := adminRequest(h, "secret", "POST", "/api/routes?index=0", `{"path": "/route2", "endpoint": "http://endpoint.two"}`)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("unexpected status\nexpected: %v\nreceived: %v %v", http.StatusCreated, recorder.Code, recorder.Body.String())
+	}
+	if endpoints := routeEndpoints(t, recorder); strings.Join(endpoints, " ") != "http://endpoint.two http://endpoint.one" {
+		t.Errorf("unexpected routes\nexpected: %v\nreceived: %v", "http://endpoint.two http://endpoint.one", endpoints)
+	}
+	proxied := httptest.NewRecorder()
+	h.ServeHTTP(proxied, httptest.NewRequest("GET", "/route2", nil))
+	if proxied.Body.String() != "two" {
+		t.Errorf("expected added route to be served\nexpected: %v\nreceived: %v", "two", proxied.Body.String())
+	}
+
+	recorder = adminRequest(h, "secret", "PUT", "/api/routes/order", `{"order": [1, 0]}`)
+	if endpoints := routeEndpoints(t, recorder); strings.Join(endpoints, " ") != "http://endpoint.one http://endpoint.two" {
+		t.Errorf("unexpected routes\nexpected: %v\nreceived: %v", "http://endpoint.one http://endpoint.two", endpoints)
+	}
+	recorder = adminRequest(h, "secret", "DELETE", "/api/routes/0", "")
+	if endpoints := routeEndpoints(t, recorder); strings.Join(endpoints, " ") != "http://endpoint.two" {
+		t.Errorf("unexpected routes\nexpected: %v\nreceived: %v", "http://endpoint.two", endpoints)
+	}
+
+	var expectations = []struct {
+		method, path, body string
+		status             int
+		expectedError      string
+	}{
+		{"POST", "/api/routes", `{"path": "/route3"}`, http.StatusUnprocessableEntity, "invalid configuration: invalid RouteRule"},
+		{"POST", "/api/routes", `{"path": "/route3", "endpont": "http://typo"}`, http.StatusBadRequest, "field endpont not found"},
+		{"POST", "/api/routes?index=5", `{"path": "/route3", "endpoint": "http://three"}`, http.StatusBadRequest, "index must be between 0 and 1"},
+		{"DELETE", "/api/routes/1", "", http.StatusNotFound, "no route at index 1"},
+		{"DELETE", "/api/routes/first", "", http.StatusNotFound, "no route at index first"},
+		{"PATCH", "/api/routes", "", http.StatusMethodNotAllowed, "method PATCH is not allowed"},
+		{"PUT", "/api/routes/order", `{"order": [1]}`, http.StatusBadRequest, "order must list each of the 1 route indexes once"},
+	}
+	for _, expectation := range expectations {
+		recorder := adminRequest(h, "secret", expectation.method, expectation.path, expectation.body)
+		if recorder.Code != expectation.status || !strings.Contains(recorder.Body.String(), expectation.expectedError) {
+			t.Errorf("expected error not found\nexpected: %v %v\nreceived: %v %v", expectation.status, expectation.expectedError, recorder.Code, recorder.Body.String())
+		}
+	}
+	if endpoints := routeEndpoints(t, adminRequest(h, "secret", "GET", "/api/routes", "")); strings.Join(endpoints, " ") != "http://endpoint.two" {
+		t.Errorf("expected rejected changes not to be applied\nexpected: %v\nreceived: %v", "http://endpoint.two", endpoints)
+	}
+}
+
+func TestAdminAPIValidatesConfiguration(t *testing.T) {
+	h := buildAdminHandler(t)
+	recorder := adminRequest(h, "secret", "POST", "/api/config/validate", `{"default_route": "http://other", "routes": [{"path": "/a", "endpoint": "http://a"}]}`)
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `"valid":true`) {
+		t.Errorf("expected configuration to be valid\nexpected: %v\nreceived: %v %v", http.StatusOK, recorder.Code, recorder.Body.String())
+	}
+	if h.configuration().DefaultRoute.String() != "http://default.endpoint" {
+		t.Errorf("expected validated configuration not to be applied\nexpected: %v\nreceived: %v", "http://default.endpoint", h.configuration().DefaultRoute)
+	}
+
+	expectedError := "no configured routes"
+	recorder = adminRequest(h, "secret", "POST", "/api/config/validate", `{"default_route": "http://other"}`)
+	if recorder.Code != http.StatusUnprocessableEntity || !strings.Contains(recorder.Body.String(), expectedError) {
+		t.Errorf("expected error not found\nexpected: %v\nreceived: %v %v", expectedError, recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestAdminAPIDrainsAndDisablesBackends(t *testing.T) {
+	config := buildConfiguration()
+	config.Admin.Token = "secret"
+	config.Routes[0] = &RouteRule{Path: "/route1", Endpoints: []Endpoint{{URL: "http://endpoint.one"}, {URL: "http://endpoint.two"}}}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	route := h.configuration().Routes[0]
+	picks := func() map[string]int {
+		picked := map[string]int{}
+		for i := 0; i < 4; i++ {
+			if selected := pickBackend(route, httptest.NewRequest("GET", "/route1", nil)); selected != nil {
+				picked[selected.URL.Host]++
+			}
+		}
+		return picked
+	}
+
+	recorder := adminRequest(h, "secret", "POST", "/api/backends/drain", `{"url": "http://endpoint.one"}`)
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `"mode":"draining"`) {
+		t.Fatalf("unexpected response\nexpected: %v\nreceived: %v %v", "draining", recorder.Code, recorder.Body.String())
+	}
+	if picked := picks(); picked["endpoint.two"] != 4 {
+		t.Errorf("expected draining backend not to be picked\nexpected: %v\nreceived: %v", "endpoint.two 4 times", picked)
+	}
+	adminRequest(h, "secret", "POST", "/api/backends/disable", `{"url": "http://endpoint.two"}`)
+	if picked := picks(); picked["endpoint.one"] != 4 {
+		t.Errorf("expected draining backend to be picked as a last resort\nexpected: %v\nreceived: %v", "endpoint.one 4 times", picked)
+	}
+	adminRequest(h, "secret", "POST", "/api/backends/disable", `{"url": "http://endpoint.one"}`)
+	if picked := picks(); len(picked) != 0 {
+		t.Errorf("expected disabled backends not to be picked\nexpected: %v\nreceived: %v", "none", picked)
+	}
+
+	h.Reload(config)
+	adminRequest(h, "secret", "POST", "/api/backends/enable", `{"url": "http://endpoint.two"}`)
+	if picked := picks(); picked["endpoint.two"] != 4 {
+		t.Errorf("expected enabled backend to be picked\nexpected: %v\nreceived: %v", "endpoint.two 4 times", picked)
+	}
+	recorder = adminRequest(h, "secret", "GET", "/api/backends", "")
+	var backends []adminBackend
+	json.Unmarshal(recorder.Body.Bytes(), &backends)
+	modes := map[string]string{}
+	for _, described := range backends {
+		modes[described.URL] = described.Mode
+	}
+	if len(modes) != 3 || modes["http://endpoint.one"] != "disabled" || modes["http://endpoint.two"] != "active" {
+		t.Errorf("unexpected backends\nexpected: %v\nreceived: %v", "default, disabled one and active two", recorder.Body.String())
+	}
+
+	expectedError := "no backend with url http://endpoint.three"
+	recorder = adminRequest(h, "secret", "POST", "/api/backends/drain", `{"url": "http://endpoint.three"}`)
+	if recorder.Code != http.StatusNotFound || !strings.Contains(recorder.Body.String(), expectedError) {
+		t.Errorf("expected error not found\nexpected: %v\nreceived: %v %v", expectedError, recorder.Code, recorder.Body.String())
+	}
+}
@@ -0,0 +1,206 @@
+package proxyhandler
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Endpoint is one of the backends of a RouteRule. Weight is used by the
+// weighted strategies to send proportionally more traffic to the endpoint. It
+// defaults to 1 and may be at most maxEndpointWeight.
+type Endpoint struct {
+	URL    string `yaml:"url"`
+	Weight int    `yaml:"weight"`
+}
+
+// maxEndpointWeight bounds the weight of an endpoint, which sizes the hash
+// ring of the consistent_hash strategy.
+const maxEndpointWeight = 1000
+
+// backend is a validated Endpoint. The backendState is shared by every route,
+// and every reloaded configuration, which uses the same endpoint URL.
+type backend struct {
+	URL    *url.URL
+	Weight int
+	*backendState
+}
+
+// backendState is the live state of a backend.
+type backendState struct {
+	activeRequests int64
+	outlierState
+	circuit   circuitBreaker
+	unhealthy int32
+	mode      int32
+}
+
+// The modes of a backend set through the admin API. Draining backends are
+// only sent requests when no active backend of a route is available, while
+// disabled backends are sent none.
+const (
+	backendActive int32 = iota
+	backendDraining
+	backendDisabled
+)
+
+var backendModeNames = []string{"active", "draining", "disabled"}
+
+func (state *backendState) begin() {
+	atomic.AddInt64(&state.activeRequests, 1)
+}
+
+func (state *backendState) end() {
+	atomic.AddInt64(&state.activeRequests, -1)
+}
+
+func (state *backendState) active() int64 {
+	return atomic.LoadInt64(&state.activeRequests)
+}
+
+// healthy reports whether the backend passed its latest health checks.
+// Backends without health checks are always healthy.
+func (state *backendState) healthy() bool {
+	return atomic.LoadInt32(&state.unhealthy) == 0
+}
+
+func (state *backendState) backendMode() int32 {
+	return atomic.LoadInt32(&state.mode)
+}
+
+func (state *backendState) setBackendMode(mode int32) {
+	atomic.StoreInt32(&state.mode, mode)
+}
+
+func (state *backendState) setHealthy(healthy bool) {
+	var unhealthy int32
+	if !healthy {
+		unhealthy = 1
+	}
+	atomic.StoreInt32(&state.unhealthy, unhealthy)
+}
+
+func (endpoint Endpoint) validate() (*backend, error) {
+	endpointURL, err := parseEndpoint(endpoint.URL)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Weight < 0 {
+		return nil, fmt.Errorf("weight is negative")
+	}
+	if endpoint.Weight > maxEndpointWeight {
+		return nil, fmt.Errorf("weight is greater than %d", maxEndpointWeight)
+	}
+	weight := endpoint.Weight
+	if weight == 0 {
+		weight = 1
+	}
+	return newBackend(endpointURL, weight), nil
+}
+
+func newBackend(endpointURL *url.URL, weight int) *backend {
+	return &backend{URL: endpointURL, Weight: weight, backendState: &backendState{}}
+}
+
+// backendRegistry holds the backendState and the healthChecker of each
+// endpoint URL so that they outlive a configuration reload.
+type backendRegistry struct {
+	mutex      sync.Mutex
+	states     map[string]*backendState
+	checkers   map[string]*healthChecker
+	transports *transportPool
+}
+
+func newBackendRegistry(transports *transportPool) *backendRegistry {
+	return &backendRegistry{
+		states:     make(map[string]*backendState),
+		checkers:   make(map[string]*healthChecker),
+		transports: transports,
+	}
+}
+
+// bind replaces the backendState of each backend in config with the shared
+// state of its endpoint URL and forgets the state of unused endpoints. Health
+// checks are started for the backends of routes which enable them, using the
+// settings of the first such route, and stopped for any other backend. It
+// must be called before config is used to serve requests.
+func (registry *backendRegistry) bind(config *validConfiguration) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	used := make(map[string]*backendState)
+	checked := make(map[string]*healthChecker)
+	for _, route := range append([]*validRouteRule{config.DefaultRouteRule}, config.Routes...) {
+		for _, backend := range route.Backends {
+			key := backend.URL.String()
+			state, ok := registry.states[key]
+			if !ok {
+				state = backend.backendState
+				registry.states[key] = state
+			}
+			backend.backendState = state
+			used[key] = state
+
+			if route.HealthCheck == nil || checked[key] != nil {
+				continue
+			}
+			checker := registry.checkers[key]
+			if checker == nil || checker.settings != *route.HealthCheck || checker.transport != route.TransportSettings {
+				if checker != nil {
+					checker.close()
+					delete(registry.checkers, key)
+				}
+				checker = startHealthChecker(backend.URL, *route.HealthCheck, route.TransportSettings, state, registry.transports)
+			}
+			checked[key] = checker
+		}
+	}
+	for key, checker := range registry.checkers {
+		if checked[key] == checker {
+			continue
+		}
+		checker.close()
+		if state, ok := used[key]; ok && checked[key] == nil {
+			state.setHealthy(true)
+		}
+	}
+	registry.states = used
+	registry.checkers = checked
+}
+
+// state returns the backendState of the endpoint with key, its URL, or nil
+// when no route uses the endpoint.
+func (registry *backendRegistry) state(key string) *backendState {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	return registry.states[key]
+}
+
+// each calls visit with the URL and backendState of every endpoint in use,
+// in order of their URLs.
+func (registry *backendRegistry) each(visit func(key string, state *backendState)) {
+	registry.mutex.Lock()
+	states := make(map[string]*backendState, len(registry.states))
+	keys := make([]string, 0, len(registry.states))
+	for key, state := range registry.states {
+		states[key] = state
+		keys = append(keys, key)
+	}
+	registry.mutex.Unlock()
+	sort.Strings(keys)
+	for _, key := range keys {
+		visit(key, states[key])
+	}
+}
+
+// close stops every health check and marks the checked backends healthy.
+func (registry *backendRegistry) close() {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	for key, checker := range registry.checkers {
+		checker.close()
+		checker.state.setHealthy(true)
+		delete(registry.checkers, key)
+	}
+}
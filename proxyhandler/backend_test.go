@@ -0,0 +1,60 @@
+package proxyhandler
+
+import (
+	"testing"
+)
+
+func TestEndpointValidateDefaultsWeight(t *testing.T) {
+	backend, err := Endpoint{URL: "http://a"}.validate()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if backend.Weight != 1 {
+		t.Errorf("unexpected weight\nexpected: %v\nreceived: %v", 1, backend.Weight)
+	}
+}
+
+func TestEndpointValidateRejectsInvalidEndpoints(t *testing.T) {
+	expectations := map[string]Endpoint{
+		"weight is negative":          {URL: "http://a", Weight: -1},
+		"weight is greater than 1000": {URL: "http://a", Weight: 1001},
+		"host is empty":               {URL: "http://"},
+		"unsupported scheme: ftp":     {URL: "ftp://a"},
+	}
+	for expectedError, endpoint := range expectations {
+		_, err := endpoint.validate()
+		if err == nil || err.Error() != expectedError {
+			t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+		}
+	}
+}
+
+func TestBackendRegistrySharesStateAcrossReloads(t *testing.T) {
+	registry := newBackendRegistry(newTransportPool())
+	first, err := buildConfiguration().validate()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	registry.bind(first)
+	first.Routes[0].Backends[0].begin()
+
+	second, err := buildConfiguration().validate()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	registry.bind(second)
+	if active := second.Routes[0].Backends[0].active(); active != 1 {
+		t.Errorf("backend state was not shared\nexpected: %v\nreceived: %v", 1, active)
+	}
+
+	changed := buildConfiguration()
+	changed.Routes[0].Endpoint = "http://endpoint.two"
+	third, err := changed.validate()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	registry.bind(third)
+	if _, ok := registry.states["http://endpoint.one"]; ok {
+		t.Error("expected state of removed endpoint to be forgotten")
+	}
+}
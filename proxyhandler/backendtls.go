@@ -0,0 +1,94 @@
+package proxyhandler
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// BackendTLSConfiguration controls how https and wss backends are verified.
+// CAFile is a PEM bundle of the certificate authorities trusted in place of
+// the system roots. CertFile and KeyFile are the client certificate presented
+// to backends which require one. ServerName overrides the name the backend
+// certificate is verified against, which is otherwise the endpoint host.
+// InsecureSkipVerify disables verification of the backend certificate and
+// should only be used in development.
+type BackendTLSConfiguration struct {
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	ServerName         string `yaml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// backendTLSSettings is a resolved BackendTLSConfiguration. It holds the
+// paths of the files rather than their contents so that it is comparable.
+type backendTLSSettings struct {
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+func (backendTLS *BackendTLSConfiguration) validate() error {
+	if backendTLS == nil {
+		return nil
+	}
+	if len(backendTLS.CertFile) > 0 != (len(backendTLS.KeyFile) > 0) {
+		return fmt.Errorf("client certificate requires cert file and key file")
+	}
+	_, err := backendTLS.settings().clientConfig()
+	return err
+}
+
+func (backendTLS *BackendTLSConfiguration) settings() backendTLSSettings {
+	return backendTLSSettings(*backendTLS)
+}
+
+// loadsFiles reports whether settings load certificates from files, which may
+// be replaced while moxie is running.
+func (settings backendTLSSettings) loadsFiles() bool {
+	return len(settings.CAFile) > 0 || len(settings.CertFile) > 0
+}
+
+// clientConfig loads the files of settings and returns the tls.Config used to
+// connect to backends, or nil when the defaults are used.
+func (settings backendTLSSettings) clientConfig() (*tls.Config, error) {
+	if settings == (backendTLSSettings{}) {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{
+		ServerName:         settings.ServerName,
+		InsecureSkipVerify: settings.InsecureSkipVerify,
+	}
+	if len(settings.CAFile) > 0 {
+		pool, err := loadCertPool(settings.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if len(settings.CertFile) > 0 {
+		pair, err := tls.LoadX509KeyPair(settings.CertFile, settings.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate %s: %s", settings.CertFile, err.Error())
+		}
+		tlsConfig.Certificates = []tls.Certificate{pair}
+	}
+	return tlsConfig, nil
+}
+
+// loadCertPool returns a pool of the certificates in the PEM bundle at path.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	bundle, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("loading ca file %s: %s", path, err.Error())
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle) {
+		return nil, fmt.Errorf("no certificates found in ca file %s", path)
+	}
+	return pool, nil
+}
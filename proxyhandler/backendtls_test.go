@@ -0,0 +1,219 @@
+package proxyhandler
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/gorilla/websocket"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// writeServerCA writes the certificate of server to a CA file in dir.
+func writeServerCA(t *testing.T, dir string, server *httptest.Server) string {
+	caFile := filepath.Join(dir, "ca.pem")
+	encoded := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, encoded, 0600); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	return caFile
+}
+
+func proxyStatus(t *testing.T, endpoint string, backendTLS *BackendTLSConfiguration) int {
+	config := buildConfiguration()
+	config.Routes = []*RouteRule{{Path: "/", Endpoint: endpoint, Transport: &TransportConfiguration{TLS: backendTLS}}}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	defer h.Close()
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	return recorder.Code
+}
+
+func TestBackendTLSConfigurationValidation(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCertificate(t, dir, "client", "client.example.com")
+	emptyFile := filepath.Join(dir, "empty.pem")
+	ioutil.WriteFile(emptyFile, []byte("not a certificate"), 0600)
+
+	var cases = map[string]*BackendTLSConfiguration{
+		"invalid tls: client certificate requires cert file and key file": {CertFile: certFile},
+		"invalid tls: loading ca file":                                    {CAFile: filepath.Join(dir, "missing.pem")},
+		"invalid tls: no certificates found in ca file":                   {CAFile: emptyFile},
+		"invalid tls: loading client certificate":                         {CertFile: keyFile, KeyFile: keyFile},
+	}
+	for expectedError, backendTLS := range cases {
+		config := buildConfiguration()
+		config.Routes[0].Transport = &TransportConfiguration{TLS: backendTLS}
+		_, err := config.validate()
+		if err == nil {
+			t.Fatalf("expected config to be invalid: %s", expectedError)
+		}
+		if !strings.Contains(err.Error(), expectedError) {
+			t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err.Error())
+		}
+	}
+}
+
+func TestTransportConfigurationReplacesBackendTLS(t *testing.T) {
+	config := buildConfiguration()
+	config.Transport = TransportConfiguration{TLS: &BackendTLSConfiguration{ServerName: "default.example.com"}}
+	config.Routes[0].Transport = &TransportConfiguration{TLS: &BackendTLSConfiguration{InsecureSkipVerify: true}}
+	validConfig, err := config.validate()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	expected := backendTLSSettings{ServerName: "default.example.com"}
+	if validConfig.TransportSettings.TLS != expected {
+		t.Errorf("unexpected default tls\nexpected: %+v\nreceived: %+v", expected, validConfig.TransportSettings.TLS)
+	}
+	expected = backendTLSSettings{InsecureSkipVerify: true}
+	if validConfig.Routes[0].TransportSettings.TLS != expected {
+		t.Errorf("unexpected route tls\nexpected: %+v\nreceived: %+v", expected, validConfig.Routes[0].TransportSettings.TLS)
+	}
+}
+
+func TestProxyVerifiesHTTPSBackend(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	caFile := writeServerCA(t, t.TempDir(), server)
+
+	var cases = []struct {
+		name       string
+		backendTLS *BackendTLSConfiguration
+		status     int
+	}{
+		{"untrusted", nil, http.StatusBadGateway},
+		{"ca file", &BackendTLSConfiguration{CAFile: caFile}, http.StatusOK},
+		{"server name", &BackendTLSConfiguration{CAFile: caFile, ServerName: "example.com"}, http.StatusOK},
+		{"wrong server name", &BackendTLSConfiguration{CAFile: caFile, ServerName: "other.example"}, http.StatusBadGateway},
+		{"insecure", &BackendTLSConfiguration{InsecureSkipVerify: true}, http.StatusOK},
+	}
+	for _, c := range cases {
+		if status := proxyStatus(t, server.URL, c.backendTLS); status != c.status {
+			t.Errorf("unexpected status for %s\nexpected: %v\nreceived: %v", c.name, c.status, status)
+		}
+	}
+}
+
+func TestReloadLoadsReplacedCAFile(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	caFile, _ := writeCertificate(t, dir, "ca", "other.example.com")
+
+	config := buildConfiguration()
+	config.Routes = []*RouteRule{{Path: "/", Endpoint: server.URL, Transport: &TransportConfiguration{TLS: &BackendTLSConfiguration{CAFile: caFile}}}}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	defer h.Close()
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	if recorder.Code != http.StatusBadGateway {
+		t.Fatalf("expected backend to be untrusted\nexpected: %v\nreceived: %v", http.StatusBadGateway, recorder.Code)
+	}
+
+	writeServerCA(t, dir, server)
+	if err := h.Reload(config); err != nil {
+		t.Fatalf("unable to reload proxyhandler: %s", err.Error())
+	}
+	recorder = httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("expected replaced ca file to be trusted after reload\nexpected: %v\nreceived: %v", http.StatusOK, recorder.Code)
+	}
+}
+
+func TestProxyPresentsClientCertificate(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	dir := t.TempDir()
+	certFile, keyFile := writeCertificate(t, dir, "client", "client.example.com")
+	clientCAs := x509.NewCertPool()
+	encoded, _ := ioutil.ReadFile(certFile)
+	clientCAs.AppendCertsFromPEM(encoded)
+
+	var subject atomic.Value
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subject.Store(r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+	caFile := writeServerCA(t, dir, server)
+
+	if status := proxyStatus(t, server.URL, &BackendTLSConfiguration{CAFile: caFile}); status != http.StatusBadGateway {
+		t.Errorf("unexpected status without client certificate\nexpected: %v\nreceived: %v", http.StatusBadGateway, status)
+	}
+	backendTLS := &BackendTLSConfiguration{CAFile: caFile, CertFile: certFile, KeyFile: keyFile}
+	if status := proxyStatus(t, server.URL, backendTLS); status != http.StatusOK {
+		t.Errorf("unexpected status with client certificate\nexpected: %v\nreceived: %v", http.StatusOK, status)
+	}
+	if name := subject.Load(); name != "client.example.com" {
+		t.Errorf("unexpected client certificate\nexpected: %v\nreceived: %v", "client.example.com", name)
+	}
+}
+
+func TestProxyToWSSBackend(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		connection, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer connection.Close()
+		messageType, message, err := connection.ReadMessage()
+		if err != nil {
+			return
+		}
+		connection.WriteMessage(messageType, message)
+	}))
+	defer server.Close()
+
+	config := buildConfiguration()
+	config.Routes = []*RouteRule{{
+		Path:      "/",
+		Endpoint:  "wss://" + strings.TrimPrefix(server.URL, "https://"),
+		Transport: &TransportConfiguration{TLS: &BackendTLSConfiguration{CAFile: writeServerCA(t, t.TempDir(), server)}},
+	}}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	defer h.Close()
+	proxy := httptest.NewServer(h)
+	defer proxy.Close()
+
+	connection, _, err := websocket.DefaultDialer.Dial("ws://"+strings.TrimPrefix(proxy.URL, "http://")+"/", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	defer connection.Close()
+	connection.WriteMessage(websocket.TextMessage, []byte("hello"))
+	_, message, err := connection.ReadMessage()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if string(message) != "hello" {
+		t.Errorf("unexpected message\nexpected: %v\nreceived: %v", "hello", string(message))
+	}
+}
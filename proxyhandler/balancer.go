@@ -0,0 +1,223 @@
+package proxyhandler
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// LoadBalancingConfiguration controls how a RouteRule with several Endpoints
+// chooses the endpoint for each request. Strategy is one of "round_robin",
+// the default, "weighted_round_robin", "least_connections",
+// "random_two_choices" or "consistent_hash". The consistent hash is computed
+// from the client IP, or when HashOn is "header" or "cookie", from the header
+// or cookie named by HashKey, falling back to the client IP when it is absent.
+type LoadBalancingConfiguration struct {
+	Strategy string `yaml:"strategy"`
+	HashOn   string `yaml:"hash_on"`
+	HashKey  string `yaml:"hash_key"`
+}
+
+// balancer chooses one of the backends of a route for a request. Backends for
+// which available returns false are skipped and nil is returned when none are
+// available.
+type balancer interface {
+	pick(request *http.Request, available func(*backend) bool) *backend
+}
+
+func newBalancer(config LoadBalancingConfiguration, backends []*backend) (balancer, error) {
+	switch config.Strategy {
+	case "", "round_robin":
+		return &roundRobinBalancer{backends: backends}, nil
+	case "weighted_round_robin":
+		return &weightedRoundRobinBalancer{backends: backends, currentWeights: make([]int, len(backends))}, nil
+	case "least_connections":
+		return &leastConnectionsBalancer{backends: backends}, nil
+	case "random_two_choices":
+		return &randomTwoChoicesBalancer{backends: backends}, nil
+	case "consistent_hash":
+		return newConsistentHashBalancer(config, backends)
+	}
+	return nil, fmt.Errorf("unknown load balancing strategy: %s", config.Strategy)
+}
+
+// roundRobinBalancer picks each backend in turn.
+type roundRobinBalancer struct {
+	backends []*backend
+	counter  uint64
+}
+
+func (b *roundRobinBalancer) pick(request *http.Request, available func(*backend) bool) *backend {
+	start := atomic.AddUint64(&b.counter, 1) - 1
+	for offset := range b.backends {
+		candidate := b.backends[(start+uint64(offset))%uint64(len(b.backends))]
+		if available(candidate) {
+			return candidate
+		}
+	}
+	return nil
+}
+
+// weightedRoundRobinBalancer is the smooth weighted round robin used by nginx,
+// which interleaves backends in proportion to their weight.
+type weightedRoundRobinBalancer struct {
+	mutex          sync.Mutex
+	backends       []*backend
+	currentWeights []int
+}
+
+func (b *weightedRoundRobinBalancer) pick(request *http.Request, available func(*backend) bool) *backend {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	selected := -1
+	total := 0
+	for index, candidate := range b.backends {
+		if !available(candidate) {
+			continue
+		}
+		b.currentWeights[index] += candidate.Weight
+		total += candidate.Weight
+		if selected == -1 || b.currentWeights[index] > b.currentWeights[selected] {
+			selected = index
+		}
+	}
+	if selected == -1 {
+		return nil
+	}
+	b.currentWeights[selected] -= total
+	return b.backends[selected]
+}
+
+// leastConnectionsBalancer picks the backend with the fewest active requests
+// relative to its weight. Ties are broken in turn.
+type leastConnectionsBalancer struct {
+	backends []*backend
+	counter  uint64
+}
+
+func (b *leastConnectionsBalancer) pick(request *http.Request, available func(*backend) bool) *backend {
+	start := atomic.AddUint64(&b.counter, 1) - 1
+	var selected *backend
+	for offset := range b.backends {
+		candidate := b.backends[(start+uint64(offset))%uint64(len(b.backends))]
+		if !available(candidate) {
+			continue
+		}
+		if selected == nil || candidate.active()*int64(selected.Weight) < selected.active()*int64(candidate.Weight) {
+			selected = candidate
+		}
+	}
+	return selected
+}
+
+// randomTwoChoicesBalancer picks two available backends at random and uses the
+// one with fewer active requests.
+type randomTwoChoicesBalancer struct {
+	backends []*backend
+}
+
+func (b *randomTwoChoicesBalancer) pick(request *http.Request, available func(*backend) bool) *backend {
+	candidates := make([]*backend, 0, len(b.backends))
+	for _, candidate := range b.backends {
+		if available(candidate) {
+			candidates = append(candidates, candidate)
+		}
+	}
+	switch len(candidates) {
+	case 0:
+		return nil
+	case 1:
+		return candidates[0]
+	}
+	first := rand.Intn(len(candidates))
+	second := rand.Intn(len(candidates) - 1)
+	if second >= first {
+		second++
+	}
+	if candidates[second].active() < candidates[first].active() {
+		return candidates[second]
+	}
+	return candidates[first]
+}
+
+// consistentHashBalancer places each backend on a hash ring many times, in
+// proportion to its weight, so a request key is directed to the same backend
+// while the set of available backends is unchanged.
+type consistentHashBalancer struct {
+	hashOn  string
+	hashKey string
+	ring    []uint32
+	owners  map[uint32]*backend
+}
+
+const consistentHashReplicas = 100
+
+func newConsistentHashBalancer(config LoadBalancingConfiguration, backends []*backend) (*consistentHashBalancer, error) {
+	switch config.HashOn {
+	case "", "ip":
+	case "header", "cookie":
+		if len(config.HashKey) == 0 {
+			return nil, fmt.Errorf("hash key is required to hash on %s", config.HashOn)
+		}
+	default:
+		return nil, fmt.Errorf("unknown hash on: %s", config.HashOn)
+	}
+	b := &consistentHashBalancer{
+		hashOn:  config.HashOn,
+		hashKey: config.HashKey,
+		owners:  make(map[uint32]*backend),
+	}
+	for _, candidate := range backends {
+		for replica := 0; replica < consistentHashReplicas*candidate.Weight; replica++ {
+			point := hashKey(candidate.URL.String() + "#" + strconv.Itoa(replica))
+			if _, ok := b.owners[point]; ok {
+				continue
+			}
+			b.owners[point] = candidate
+			b.ring = append(b.ring, point)
+		}
+	}
+	sort.Slice(b.ring, func(i, j int) bool { return b.ring[i] < b.ring[j] })
+	return b, nil
+}
+
+func (b *consistentHashBalancer) pick(request *http.Request, available func(*backend) bool) *backend {
+	point := hashKey(b.requestKey(request))
+	start := sort.Search(len(b.ring), func(i int) bool { return b.ring[i] >= point })
+	for offset := range b.ring {
+		candidate := b.owners[b.ring[(start+offset)%len(b.ring)]]
+		if available(candidate) {
+			return candidate
+		}
+	}
+	return nil
+}
+
+func (b *consistentHashBalancer) requestKey(request *http.Request) string {
+	switch b.hashOn {
+	case "header":
+		if value := request.Header.Get(b.hashKey); len(value) > 0 {
+			return value
+		}
+	case "cookie":
+		if cookie, err := request.Cookie(b.hashKey); err == nil {
+			return cookie.Value
+		}
+	}
+	if host, _, err := net.SplitHostPort(request.RemoteAddr); err == nil {
+		return host
+	}
+	return request.RemoteAddr
+}
+
+func hashKey(key string) uint32 {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return hash.Sum32()
+}
@@ -0,0 +1,170 @@
+package proxyhandler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func buildBackends(t *testing.T, endpoints ...Endpoint) []*backend {
+	backends := make([]*backend, len(endpoints))
+	for index, endpoint := range endpoints {
+		backend, err := endpoint.validate()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		backends[index] = backend
+	}
+	return backends
+}
+
+func buildBalancer(t *testing.T, config LoadBalancingConfiguration, backends []*backend) balancer {
+	b, err := newBalancer(config, backends)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	return b
+}
+
+func anyBackend(*backend) bool { return true }
+
+func pickHosts(b balancer, request *http.Request, count int, available func(*backend) bool) []string {
+	hosts := make([]string, count)
+	for index := range hosts {
+		if picked := b.pick(request, available); picked != nil {
+			hosts[index] = picked.URL.Host
+		}
+	}
+	return hosts
+}
+
+func TestRoundRobinBalancerPicksEachBackendInTurn(t *testing.T) {
+	backends := buildBackends(t, Endpoint{URL: "http://a"}, Endpoint{URL: "http://b"}, Endpoint{URL: "http://c"})
+	b := buildBalancer(t, LoadBalancingConfiguration{}, backends)
+	hosts := pickHosts(b, httptest.NewRequest("GET", "/", nil), 6, anyBackend)
+	expected := []string{"a", "b", "c", "a", "b", "c"}
+	if !reflect.DeepEqual(hosts, expected) {
+		t.Errorf("unexpected backends\nexpected: %v\nreceived: %v", expected, hosts)
+	}
+}
+
+func TestBalancersSkipUnavailableBackends(t *testing.T) {
+	backends := buildBackends(t, Endpoint{URL: "http://a"}, Endpoint{URL: "http://b"}, Endpoint{URL: "http://c"})
+	onlyB := func(candidate *backend) bool { return candidate.URL.Host == "b" }
+	none := func(*backend) bool { return false }
+	for _, strategy := range []string{"round_robin", "weighted_round_robin", "least_connections", "random_two_choices", "consistent_hash"} {
+		b := buildBalancer(t, LoadBalancingConfiguration{Strategy: strategy}, backends)
+		request := httptest.NewRequest("GET", "/", nil)
+		for _, host := range pickHosts(b, request, 5, onlyB) {
+			if host != "b" {
+				t.Errorf("%s picked an unavailable backend\nexpected: %v\nreceived: %v", strategy, "b", host)
+			}
+		}
+		if picked := b.pick(request, none); picked != nil {
+			t.Errorf("%s picked a backend when none are available\nexpected: %v\nreceived: %v", strategy, nil, picked.URL)
+		}
+	}
+}
+
+func TestWeightedRoundRobinBalancerInterleavesByWeight(t *testing.T) {
+	backends := buildBackends(t, Endpoint{URL: "http://a", Weight: 5}, Endpoint{URL: "http://b"}, Endpoint{URL: "http://c"})
+	b := buildBalancer(t, LoadBalancingConfiguration{Strategy: "weighted_round_robin"}, backends)
+	hosts := pickHosts(b, httptest.NewRequest("GET", "/", nil), 7, anyBackend)
+	expected := []string{"a", "a", "b", "a", "c", "a", "a"}
+	if !reflect.DeepEqual(hosts, expected) {
+		t.Errorf("unexpected backends\nexpected: %v\nreceived: %v", expected, hosts)
+	}
+}
+
+func TestLeastConnectionsBalancerPicksLeastActiveBackend(t *testing.T) {
+	backends := buildBackends(t, Endpoint{URL: "http://a"}, Endpoint{URL: "http://b", Weight: 2}, Endpoint{URL: "http://c"})
+	backends[0].begin()
+	backends[1].begin()
+	backends[1].begin()
+	backends[2].begin()
+	backends[2].begin()
+	b := buildBalancer(t, LoadBalancingConfiguration{Strategy: "least_connections"}, backends)
+	for _, host := range pickHosts(b, httptest.NewRequest("GET", "/", nil), 3, anyBackend) {
+		if host != "a" && host != "b" {
+			t.Errorf("unexpected backend\nexpected: %v\nreceived: %v", "a or b", host)
+		}
+	}
+	backends[0].begin()
+	for _, host := range pickHosts(b, httptest.NewRequest("GET", "/", nil), 3, anyBackend) {
+		if host != "b" {
+			t.Errorf("unexpected backend\nexpected: %v\nreceived: %v", "b", host)
+		}
+	}
+}
+
+func TestRandomTwoChoicesBalancerAvoidsBusiestBackend(t *testing.T) {
+	backends := buildBackends(t, Endpoint{URL: "http://a"}, Endpoint{URL: "http://b"})
+	backends[0].begin()
+	b := buildBalancer(t, LoadBalancingConfiguration{Strategy: "random_two_choices"}, backends)
+	for _, host := range pickHosts(b, httptest.NewRequest("GET", "/", nil), 10, anyBackend) {
+		if host != "b" {
+			t.Errorf("unexpected backend\nexpected: %v\nreceived: %v", "b", host)
+		}
+	}
+}
+
+func TestConsistentHashBalancerIsStickyByKey(t *testing.T) {
+	backends := buildBackends(t, Endpoint{URL: "http://a"}, Endpoint{URL: "http://b"}, Endpoint{URL: "http://c"})
+	configs := []LoadBalancingConfiguration{
+		{Strategy: "consistent_hash"},
+		{Strategy: "consistent_hash", HashOn: "header", HashKey: "X-User"},
+		{Strategy: "consistent_hash", HashOn: "cookie", HashKey: "session"},
+	}
+	for _, config := range configs {
+		b := buildBalancer(t, config, backends)
+		seen := map[string]struct{}{}
+		for user := 0; user < 50; user++ {
+			request := httptest.NewRequest("GET", "/", nil)
+			key := strings.Repeat("u", user+1)
+			request.RemoteAddr = "10.0.0." + strconv.Itoa(user) + ":1234"
+			request.Header.Set("X-User", key)
+			request.AddCookie(&http.Cookie{Name: "session", Value: key})
+			hosts := pickHosts(b, request, 3, anyBackend)
+			if hosts[0] != hosts[1] || hosts[1] != hosts[2] {
+				t.Errorf("hash on %q is not sticky: %v", config.HashOn, hosts)
+			}
+			seen[hosts[0]] = struct{}{}
+		}
+		if len(seen) < 2 {
+			t.Errorf("hash on %q did not spread requests: %v", config.HashOn, seen)
+		}
+	}
+}
+
+func TestConsistentHashBalancerOnlyMovesKeysOfUnavailableBackend(t *testing.T) {
+	backends := buildBackends(t, Endpoint{URL: "http://a"}, Endpoint{URL: "http://b"}, Endpoint{URL: "http://c"})
+	b := buildBalancer(t, LoadBalancingConfiguration{Strategy: "consistent_hash", HashOn: "header", HashKey: "X-User"}, backends)
+	withoutC := func(candidate *backend) bool { return candidate.URL.Host != "c" }
+	for user := 0; user < 50; user++ {
+		request := httptest.NewRequest("GET", "/", nil)
+		request.Header.Set("X-User", strings.Repeat("u", user+1))
+		before := b.pick(request, anyBackend).URL.Host
+		after := b.pick(request, withoutC).URL.Host
+		if before != "c" && before != after {
+			t.Errorf("key moved between available backends\nexpected: %v\nreceived: %v", before, after)
+		}
+	}
+}
+
+func TestNewBalancerRejectsInvalidConfiguration(t *testing.T) {
+	backends := buildBackends(t, Endpoint{URL: "http://a"})
+	expectations := map[string]LoadBalancingConfiguration{
+		"unknown load balancing strategy: fastest": {Strategy: "fastest"},
+		"hash key is required to hash on header":   {Strategy: "consistent_hash", HashOn: "header"},
+		"unknown hash on: body":                    {Strategy: "consistent_hash", HashOn: "body"},
+	}
+	for expectedError, config := range expectations {
+		_, err := newBalancer(config, backends)
+		if err == nil || err.Error() != expectedError {
+			t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+		}
+	}
+}
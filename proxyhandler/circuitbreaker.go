@@ -0,0 +1,229 @@
+package proxyhandler
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// CircuitBreakerConfiguration enables a circuit breaker for each endpoint of
+// a RouteRule. The circuit of an endpoint opens when at least FailureRatio of
+// MinRequests or more requests within Interval fail by being unable to reach
+// the endpoint or receiving a 5xx status. While open, requests are not sent to
+// the endpoint. After OpenDuration the circuit is half-open and up to
+// HalfOpenRequests requests are sent to the endpoint, closing the circuit if
+// they all succeed and opening it again if any fail.
+type CircuitBreakerConfiguration struct {
+	FailureRatio     float64       `yaml:"failure_ratio"`
+	MinRequests      int           `yaml:"min_requests"`
+	Interval         time.Duration `yaml:"interval"`
+	OpenDuration     time.Duration `yaml:"open_duration"`
+	HalfOpenRequests int           `yaml:"half_open_requests"`
+}
+
+// circuitBreakerSettings is a resolved CircuitBreakerConfiguration.
+type circuitBreakerSettings struct {
+	FailureRatio     float64
+	MinRequests      int
+	Interval         time.Duration
+	OpenDuration     time.Duration
+	HalfOpenRequests int
+}
+
+var defaultCircuitBreakerSettings = circuitBreakerSettings{
+	FailureRatio:     0.5,
+	MinRequests:      20,
+	Interval:         10 * time.Second,
+	OpenDuration:     30 * time.Second,
+	HalfOpenRequests: 1,
+}
+
+// validate returns the settings of the circuit breaker, or nil when it is not
+// enabled.
+func (breaker *CircuitBreakerConfiguration) validate() (*circuitBreakerSettings, error) {
+	if breaker == nil {
+		return nil, nil
+	}
+	if breaker.FailureRatio < 0 || breaker.FailureRatio > 1 {
+		return nil, fmt.Errorf("failure ratio must be between 0 and 1")
+	}
+	if breaker.MinRequests < 0 {
+		return nil, fmt.Errorf("min requests is negative")
+	}
+	if breaker.Interval < 0 {
+		return nil, fmt.Errorf("interval is negative")
+	}
+	if breaker.OpenDuration < 0 {
+		return nil, fmt.Errorf("open duration is negative")
+	}
+	if breaker.HalfOpenRequests < 0 {
+		return nil, fmt.Errorf("half open requests is negative")
+	}
+
+	settings := defaultCircuitBreakerSettings
+	if breaker.FailureRatio > 0 {
+		settings.FailureRatio = breaker.FailureRatio
+	}
+	if breaker.MinRequests > 0 {
+		settings.MinRequests = breaker.MinRequests
+	}
+	if breaker.Interval > 0 {
+		settings.Interval = breaker.Interval
+	}
+	if breaker.OpenDuration > 0 {
+		settings.OpenDuration = breaker.OpenDuration
+	}
+	if breaker.HalfOpenRequests > 0 {
+		settings.HalfOpenRequests = breaker.HalfOpenRequests
+	}
+	return &settings, nil
+}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuitBreaker is the circuit of a single backend. Every method accepts nil
+// settings, for which the circuit is always closed.
+type circuitBreaker struct {
+	mutex       sync.Mutex
+	state       circuitState
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	probes      int
+	successes   int
+}
+
+// advance moves an open circuit to half-open once its open duration has
+// elapsed. The mutex must be held.
+func (breaker *circuitBreaker) advance(settings *circuitBreakerSettings, now time.Time) {
+	if breaker.state == circuitOpen && now.Sub(breaker.openedAt) >= settings.OpenDuration {
+		breaker.state = circuitHalfOpen
+		breaker.probes, breaker.successes = 0, 0
+	}
+}
+
+// available reports whether a request may be sent to the backend at now.
+func (breaker *circuitBreaker) available(settings *circuitBreakerSettings, now time.Time) bool {
+	if settings == nil {
+		return true
+	}
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	breaker.advance(settings, now)
+	switch breaker.state {
+	case circuitOpen:
+		return false
+	case circuitHalfOpen:
+		return breaker.probes < settings.HalfOpenRequests
+	}
+	return true
+}
+
+// acquire reserves the right to send a request to the backend at now. probe
+// reports whether the request is one of the requests of a half-open circuit,
+// and must be passed to record along with the outcome of the request.
+func (breaker *circuitBreaker) acquire(settings *circuitBreakerSettings, now time.Time) (probe bool, ok bool) {
+	if settings == nil {
+		return false, true
+	}
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	breaker.advance(settings, now)
+	switch breaker.state {
+	case circuitOpen:
+		return false, false
+	case circuitHalfOpen:
+		if breaker.probes >= settings.HalfOpenRequests {
+			return false, false
+		}
+		breaker.probes++
+		return true, true
+	}
+	return false, true
+}
+
+// retryAfter is how long the circuit will remain open at now, or zero when it
+// is not open.
+func (breaker *circuitBreaker) retryAfter(settings *circuitBreakerSettings, now time.Time) time.Duration {
+	if settings == nil {
+		return 0
+	}
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	breaker.advance(settings, now)
+	if breaker.state != circuitOpen {
+		return 0
+	}
+	return breaker.openedAt.Add(settings.OpenDuration).Sub(now)
+}
+
+// observe records the outcome of a request acquired from the circuit of the
+// backend at target.
+func (breaker *circuitBreaker) observe(settings *circuitBreakerSettings, target string, probe bool, err error, response *http.Response) {
+	if settings == nil {
+		return
+	}
+	breaker.record(settings, target, probe, err != nil || response.StatusCode >= 500, time.Now())
+}
+
+// release gives back a request acquired from the circuit without recording
+// an outcome, as when the client went away before the backend answered.
+func (breaker *circuitBreaker) release(settings *circuitBreakerSettings, probe bool) {
+	if settings == nil || !probe {
+		return
+	}
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	if breaker.state == circuitHalfOpen {
+		breaker.probes--
+	}
+}
+
+func (breaker *circuitBreaker) record(settings *circuitBreakerSettings, target string, probe bool, failed bool, now time.Time) {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	switch {
+	case probe && breaker.state == circuitHalfOpen:
+		breaker.probes--
+		if failed {
+			breaker.open(now)
+			log.Printf("circuit: reopening circuit of backend %s after a failed request", target)
+			return
+		}
+		breaker.successes++
+		if breaker.successes >= settings.HalfOpenRequests {
+			breaker.state = circuitClosed
+			breaker.windowStart = time.Time{}
+			log.Printf("circuit: closing circuit of backend %s", target)
+		}
+	case !probe && breaker.state == circuitClosed:
+		if now.Sub(breaker.windowStart) >= settings.Interval {
+			breaker.windowStart = now
+			breaker.requests, breaker.failures = 0, 0
+		}
+		breaker.requests++
+		if failed {
+			breaker.failures++
+		}
+		if breaker.requests >= settings.MinRequests && float64(breaker.failures)/float64(breaker.requests) >= settings.FailureRatio {
+			log.Printf("circuit: opening circuit of backend %s after %d of %d requests failed", target, breaker.failures, breaker.requests)
+			breaker.open(now)
+		}
+	}
+}
+
+// open opens the circuit at now. The mutex must be held.
+func (breaker *circuitBreaker) open(now time.Time) {
+	breaker.state = circuitOpen
+	breaker.openedAt = now
+	breaker.requests, breaker.failures = 0, 0
+}
@@ -0,0 +1,106 @@
+package proxyhandler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerValidateRejectsInvalidConfiguration(t *testing.T) {
+	expectations := map[string]CircuitBreakerConfiguration{
+		"failure ratio must be between 0 and 1": {FailureRatio: 2},
+		"min requests is negative":              {MinRequests: -1},
+		"interval is negative":                  {Interval: -time.Second},
+		"open duration is negative":             {OpenDuration: -time.Second},
+		"half open requests is negative":        {HalfOpenRequests: -1},
+	}
+	for expectedError, breaker := range expectations {
+		_, err := breaker.validate()
+		if err == nil || err.Error() != expectedError {
+			t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+		}
+	}
+}
+
+func TestCircuitBreakerOpensAndRecovers(t *testing.T) {
+	settings, _ := (&CircuitBreakerConfiguration{
+		FailureRatio:     0.5,
+		MinRequests:      4,
+		OpenDuration:     time.Minute,
+		HalfOpenRequests: 2,
+	}).validate()
+	breaker := &circuitBreaker{}
+	now := time.Now()
+	for _, failed := range []bool{true, false, true, false} {
+		probe, ok := breaker.acquire(settings, now)
+		if !ok || probe {
+			t.Fatalf("expected closed circuit to allow requests\nexpected: %v\nreceived: %v", true, ok)
+		}
+		breaker.record(settings, "http://a", probe, failed, now)
+	}
+	if breaker.available(settings, now) {
+		t.Fatal("expected circuit to open")
+	}
+	if wait := breaker.retryAfter(settings, now.Add(time.Second)); wait != 59*time.Second {
+		t.Errorf("unexpected retry after\nexpected: %v\nreceived: %v", 59*time.Second, wait)
+	}
+
+	now = now.Add(time.Minute)
+	first, _ := breaker.acquire(settings, now)
+	second, _ := breaker.acquire(settings, now)
+	if _, ok := breaker.acquire(settings, now); ok || !first || !second {
+		t.Fatal("expected half-open circuit to allow only the configured probes")
+	}
+	breaker.record(settings, "http://a", true, false, now)
+	breaker.record(settings, "http://a", true, true, now)
+	if breaker.available(settings, now) {
+		t.Fatal("expected failed probe to reopen the circuit")
+	}
+
+	now = now.Add(time.Minute)
+	for i := 0; i < 2; i++ {
+		probe, _ := breaker.acquire(settings, now)
+		breaker.record(settings, "http://a", probe, false, now)
+	}
+	if probe, ok := breaker.acquire(settings, now); !ok || probe {
+		t.Error("expected successful probes to close the circuit")
+	}
+}
+
+func TestCircuitBreakerIgnoresRequestsFromEarlierState(t *testing.T) {
+	settings, _ := (&CircuitBreakerConfiguration{MinRequests: 1, OpenDuration: time.Minute}).validate()
+	breaker := &circuitBreaker{}
+	now := time.Now()
+	slow, _ := breaker.acquire(settings, now)
+	breaker.record(settings, "http://a", false, true, now)
+
+	now = now.Add(time.Minute)
+	probe, _ := breaker.acquire(settings, now)
+	breaker.record(settings, "http://a", slow, true, now)
+	if breaker.available(settings, now) {
+		t.Fatal("expected outstanding probe to be the only request allowed")
+	}
+	breaker.record(settings, "http://a", probe, false, now)
+	if !breaker.available(settings, now) {
+		t.Error("expected successful probe to close the circuit")
+	}
+}
+
+func TestCircuitBreakerReleasesProbeWithoutOutcome(t *testing.T) {
+	settings, _ := (&CircuitBreakerConfiguration{MinRequests: 1, OpenDuration: time.Minute}).validate()
+	breaker := &circuitBreaker{}
+	now := time.Now()
+	breaker.acquire(settings, now)
+	breaker.record(settings, "http://a", false, true, now)
+
+	now = now.Add(time.Minute)
+	probe, _ := breaker.acquire(settings, now)
+	breaker.release(settings, probe)
+	if !breaker.available(settings, now) {
+		t.Fatal("expected released probe to be available again")
+	}
+	probe, _ = breaker.acquire(settings, now)
+	breaker.record(settings, "http://a", probe, false, now)
+	if probe, ok := breaker.acquire(settings, now); !ok || probe {
+		t.Error("expected successful probe to close the circuit")
+	}
+}
@@ -0,0 +1,59 @@
+package proxyhandler
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// clientCertificateFields are the values of a verified client certificate
+// which routes may match and which may be forwarded to backends, by name.
+var clientCertificateFields = map[string]func(*x509.Certificate) []string{
+	"subject":     func(certificate *x509.Certificate) []string { return []string{certificate.Subject.String()} },
+	"common_name": func(certificate *x509.Certificate) []string { return []string{certificate.Subject.CommonName} },
+	"issuer":      func(certificate *x509.Certificate) []string { return []string{certificate.Issuer.String()} },
+	"serial":      func(certificate *x509.Certificate) []string { return []string{certificate.SerialNumber.Text(16)} },
+	"fingerprint": func(certificate *x509.Certificate) []string {
+		sum := sha256.Sum256(certificate.Raw)
+		return []string{hex.EncodeToString(sum[:])}
+	},
+	"dns_san":   func(certificate *x509.Certificate) []string { return certificate.DNSNames },
+	"email_san": func(certificate *x509.Certificate) []string { return certificate.EmailAddresses },
+	"uri_san": func(certificate *x509.Certificate) []string {
+		values := make([]string, len(certificate.URIs))
+		for index, uri := range certificate.URIs {
+			values[index] = uri.String()
+		}
+		return values
+	},
+	"ip_san": func(certificate *x509.Certificate) []string {
+		values := make([]string, len(certificate.IPAddresses))
+		for index, ip := range certificate.IPAddresses {
+			values[index] = ip.String()
+		}
+		return values
+	},
+}
+
+// clientCertificateFieldNames lists the names of clientCertificateFields for
+// error messages.
+func clientCertificateFieldNames() string {
+	names := make([]string, 0, len(clientCertificateFields))
+	for name := range clientCertificateFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// clientCertificateValues returns the values of field from the verified
+// client certificate of request, or nil when the client did not present one.
+func clientCertificateValues(request *http.Request, field string) []string {
+	if request.TLS == nil || len(request.TLS.VerifiedChains) == 0 || len(request.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return clientCertificateFields[field](request.TLS.VerifiedChains[0][0])
+}
@@ -0,0 +1,132 @@
+package proxyhandler
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// withClientCertificate makes request appear to have been made by a client
+// which presented the verified certificate in certFile.
+func withClientCertificate(t *testing.T, request *http.Request, certFile string) *http.Request {
+	encoded, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	block, _ := pem.Decode(encoded)
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	request.TLS = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{certificate},
+		VerifiedChains:   [][]*x509.Certificate{{certificate}},
+	}
+	return request
+}
+
+func TestClientCertificateValues(t *testing.T) {
+	certFile, _ := writeCertificate(t, t.TempDir(), "client", "client.example.com", "alt.example.com")
+	request := withClientCertificate(t, httptest.NewRequest("GET", "/", nil), certFile)
+
+	var expectations = map[string][]string{
+		"subject":     {"CN=client.example.com"},
+		"common_name": {"client.example.com"},
+		"dns_san":     {"client.example.com", "alt.example.com"},
+	}
+	for field, expected := range expectations {
+		if values := clientCertificateValues(request, field); !reflect.DeepEqual(values, expected) {
+			t.Errorf("unexpected %s\nexpected: %v\nreceived: %v", field, expected, values)
+		}
+	}
+	if values := clientCertificateValues(request, "email_san"); len(values) != 0 {
+		t.Errorf("unexpected email_san\nexpected: %v\nreceived: %v", nil, values)
+	}
+	if fingerprint := clientCertificateValues(request, "fingerprint"); len(fingerprint) != 1 || len(fingerprint[0]) != 64 {
+		t.Errorf("unexpected fingerprint\nexpected: %v\nreceived: %v", "sha256 hex digest", fingerprint)
+	}
+
+	unverified := httptest.NewRequest("GET", "/", nil)
+	unverified.TLS = &tls.ConnectionState{PeerCertificates: request.TLS.PeerCertificates}
+	if values := clientCertificateValues(unverified, "subject"); values != nil {
+		t.Errorf("expected unverified certificate to be ignored\nexpected: %v\nreceived: %v", nil, values)
+	}
+}
+
+func TestRouteMatchesClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	adminCert, _ := writeCertificate(t, dir, "admin", "admin.internal")
+	userCert, _ := writeCertificate(t, dir, "user", "user.internal")
+	r := buildRouter(t,
+		RouteRule{Path: "/", Endpoint: "http://public"},
+		RouteRule{Path: "/", Endpoint: "http://admin", ClientCertificate: []ValueMatch{{Name: "dns_san", Pattern: `^admin\.`}}},
+	)
+
+	var expectations = map[*http.Request]string{
+		httptest.NewRequest("GET", "/", nil):                                      "http://public",
+		withClientCertificate(t, httptest.NewRequest("GET", "/", nil), userCert):  "http://public",
+		withClientCertificate(t, httptest.NewRequest("GET", "/", nil), adminCert): "http://admin",
+	}
+	for request, expectedEndpoint := range expectations {
+		if route := r.route(request); route.Endpoint != expectedEndpoint {
+			t.Errorf("unexpected route\nexpected: %v\nreceived: %v", expectedEndpoint, route.Endpoint)
+		}
+	}
+
+	expectedError := "invalid client certificate match: unknown field serial_number"
+	config := buildConfiguration()
+	config.Routes[0].ClientCertificate = []ValueMatch{{Name: "serial_number"}}
+	_, err := config.validate()
+	if err == nil {
+		t.Fatal("expected config to be invalid")
+	}
+	if !strings.Contains(err.Error(), expectedError) {
+		t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err.Error())
+	}
+}
+
+func TestForwardedClientCertificateHeaders(t *testing.T) {
+	certFile, _ := writeCertificate(t, t.TempDir(), "client", "client.example.com")
+	forwarded, err := ForwardedConfiguration{
+		ClientCertificateHeaders: map[string]string{"x-client-cert-subject": "subject", "X-Client-Cert-Email": "email_san"},
+	}.validate()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	request := withClientCertificate(t, httptest.NewRequest("GET", "/", nil), certFile)
+	request.Header.Set("X-Client-Cert-Email", "spoofed@example.com")
+	header := http.Header{}
+	copyHeaders(header, request.Header)
+	forwarded.apply(header, request)
+	if subject := header.Get("X-Client-Cert-Subject"); subject != "CN=client.example.com" {
+		t.Errorf("unexpected subject header\nexpected: %v\nreceived: %v", "CN=client.example.com", subject)
+	}
+	if _, ok := header["X-Client-Cert-Email"]; ok {
+		t.Errorf("expected spoofed header to be removed\nexpected: %v\nreceived: %v", nil, header["X-Client-Cert-Email"])
+	}
+
+	request = httptest.NewRequest("GET", "/", nil)
+	request.Header.Set("X-Client-Cert-Subject", "CN=spoofed")
+	header = http.Header{}
+	copyHeaders(header, request.Header)
+	forwarded.apply(header, request)
+	if _, ok := header["X-Client-Cert-Subject"]; ok {
+		t.Errorf("expected spoofed header to be removed\nexpected: %v\nreceived: %v", nil, header["X-Client-Cert-Subject"])
+	}
+
+	expectedError := "unknown client certificate field subject_name for header X-Client"
+	_, err = ForwardedConfiguration{ClientCertificateHeaders: map[string]string{"X-Client": "subject_name"}}.validate()
+	if err == nil {
+		t.Fatal("expected error to be returned")
+	}
+	if !strings.Contains(err.Error(), expectedError) {
+		t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err.Error())
+	}
+}
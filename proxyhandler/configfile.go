@@ -0,0 +1,178 @@
+package proxyhandler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/pelletier/go-toml"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// LoadConfiguration reads the Configuration stored in the file at path. The
+// format is chosen by the file extension: .yaml/.yml, .json or .toml. The
+// loaded Configuration is validated before it is returned and any error is
+// reported with the line of the file where the problem was found.
+func LoadConfiguration(path string) (*Configuration, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading configuration: %s", err.Error())
+	}
+	return parseConfiguration(path, data)
+}
+
+func parseConfiguration(path string, data []byte) (*Configuration, error) {
+	var config *Configuration
+	var routeLines []int
+	var err error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		config, routeLines, err = decodeYAMLConfiguration(data)
+	case ".json":
+		config, routeLines, err = decodeJSONConfiguration(data)
+	case ".toml":
+		config, routeLines, err = decodeTOMLConfiguration(data)
+	default:
+		return nil, fmt.Errorf("%s: unsupported configuration format %q", path, filepath.Ext(path))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+
+	if _, err := config.validate(); err != nil {
+		if routeErr, ok := err.(*routeRuleError); ok && routeErr.Index < len(routeLines) {
+			return nil, fmt.Errorf("%s:%d: %s", path, routeLines[routeErr.Index], err.Error())
+		}
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	return config, nil
+}
+
+// decodeYAMLConfiguration returns the decoded Configuration along with the
+// line on which each of its Routes begins.
+func decodeYAMLConfiguration(data []byte) (*Configuration, []int, error) {
+	config := &Configuration{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil {
+		return nil, nil, err
+	}
+
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, nil, err
+	}
+	var routeLines []int
+	if len(document.Content) > 0 {
+		root := document.Content[0]
+		for i := 0; i+1 < len(root.Content); i += 2 {
+			if root.Content[i].Value == "routes" {
+				for _, route := range root.Content[i+1].Content {
+					routeLines = append(routeLines, route.Line)
+				}
+			}
+		}
+	}
+	return config, routeLines, nil
+}
+
+// decodeJSONConfiguration checks data is well formed JSON and then decodes it
+// as YAML, of which JSON is a subset, so the formats share struct tags and
+// value conversions.
+func decodeJSONConfiguration(data []byte) (*Configuration, []int, error) {
+	converted, err := jsonAsYAML(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return decodeYAMLConfiguration(converted)
+}
+
+// jsonAsYAML checks data is well formed JSON and returns it in a form which
+// may be decoded as YAML.
+func jsonAsYAML(data []byte) ([]byte, error) {
+	var document interface{}
+	if err := json.Unmarshal(data, &document); err != nil {
+		if syntaxErr, ok := err.(*json.SyntaxError); ok {
+			return nil, fmt.Errorf("line %d: %s", lineAtOffset(data, syntaxErr.Offset), err.Error())
+		}
+		return nil, err
+	}
+	// YAML does not allow tabs as indentation. Raw newlines cannot occur
+	// within valid JSON strings so leading whitespace is always structural.
+	lines := bytes.Split(data, []byte("\n"))
+	for i, line := range lines {
+		trimmed := bytes.TrimLeft(line, " \t")
+		indent := bytes.Repeat([]byte(" "), len(line)-len(trimmed))
+		lines[i] = append(indent, trimmed...)
+	}
+	return bytes.Join(lines, []byte("\n")), nil
+}
+
+// decodeJSON decodes the JSON in data into value using its YAML struct tags,
+// rejecting unknown fields.
+func decodeJSON(data []byte, value interface{}) error {
+	converted, err := jsonAsYAML(data)
+	if err != nil {
+		return err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(converted))
+	decoder.KnownFields(true)
+	return decoder.Decode(value)
+}
+
+// encodeJSON encodes value as JSON using its YAML struct tags, so that it may
+// be decoded by decodeJSON.
+func encodeJSON(value interface{}) ([]byte, error) {
+	encoded, err := yaml.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var document interface{}
+	if err := yaml.Unmarshal(encoded, &document); err != nil {
+		return nil, err
+	}
+	return json.Marshal(document)
+}
+
+// cloneConfiguration returns a deep copy of config.
+func cloneConfiguration(config *Configuration) (*Configuration, error) {
+	encoded, err := yaml.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	clone := &Configuration{}
+	if err := yaml.Unmarshal(encoded, clone); err != nil {
+		return nil, err
+	}
+	return clone, nil
+}
+
+// decodeTOMLConfiguration decodes data using the same struct tags as YAML.
+func decodeTOMLConfiguration(data []byte) (*Configuration, []int, error) {
+	config := &Configuration{}
+	decoder := toml.NewDecoder(bytes.NewReader(data)).SetTagName("yaml").Strict(true)
+	if err := decoder.Decode(config); err != nil {
+		return nil, nil, err
+	}
+
+	tree, err := toml.LoadBytes(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	var routeLines []int
+	if routes, ok := tree.Get("routes").([]*toml.Tree); ok {
+		for _, route := range routes {
+			routeLines = append(routeLines, route.Position().Line)
+		}
+	}
+	return config, routeLines, nil
+}
+
+func lineAtOffset(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
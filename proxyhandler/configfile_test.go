@@ -0,0 +1,159 @@
+package proxyhandler
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeConfigurationFile(t *testing.T, name, contents string) string {
+	dir, err := ioutil.TempDir("", "moxie")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err.Error())
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatalf("unable to write configuration: %s", err.Error())
+	}
+	return path
+}
+
+func removeConfigurationFile(path string) {
+	os.RemoveAll(filepath.Dir(path))
+}
+
+func assertLoadedConfiguration(t *testing.T, config *Configuration) {
+	expected := buildConfiguration()
+	if config.DefaultRoute != expected.DefaultRoute {
+		t.Errorf("unexpected default route\nexpected: %v\nreceived: %v", expected.DefaultRoute, config.DefaultRoute)
+	}
+	if len(config.Routes) != len(expected.Routes) {
+		t.Fatalf("unexpected number of routes\nexpected: %v\nreceived: %v", len(expected.Routes), len(config.Routes))
+	}
+	for index, route := range expected.Routes {
+		if !reflect.DeepEqual(config.Routes[index], route) {
+			t.Errorf("unexpected route\nexpected: %v\nreceived: %v", route, config.Routes[index])
+		}
+	}
+}
+
+func TestLoadConfigurationFromYAML(t *testing.T) {
+	path := writeConfigurationFile(t, "moxie.yaml", `
+default_route: http://default.endpoint
+routes:
+  - path: /route1
+    endpoint: http://endpoint.one
+`)
+	defer removeConfigurationFile(path)
+
+	config, err := LoadConfiguration(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	assertLoadedConfiguration(t, config)
+}
+
+func TestLoadConfigurationFromJSON(t *testing.T) {
+	path := writeConfigurationFile(t, "moxie.json", "{\n\t\"default_route\": \"http://default.endpoint\",\n\t\"routes\": [\n\t\t{\"path\": \"/route1\", \"endpoint\": \"http://endpoint.one\"}\n\t]\n}\n")
+	defer removeConfigurationFile(path)
+
+	config, err := LoadConfiguration(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	assertLoadedConfiguration(t, config)
+}
+
+func TestLoadConfigurationFromTOML(t *testing.T) {
+	path := writeConfigurationFile(t, "moxie.toml", `
+default_route = "http://default.endpoint"
+
+[[routes]]
+path = "/route1"
+endpoint = "http://endpoint.one"
+`)
+	defer removeConfigurationFile(path)
+
+	config, err := LoadConfiguration(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	assertLoadedConfiguration(t, config)
+}
+
+func TestLoadConfigurationRejectsUnknownFormat(t *testing.T) {
+	expectedError := "unsupported configuration format"
+	path := writeConfigurationFile(t, "moxie.ini", "")
+	defer removeConfigurationFile(path)
+
+	_, err := LoadConfiguration(path)
+	if err == nil {
+		t.Fatal("expected error to be returned")
+	}
+	if !strings.Contains(err.Error(), expectedError) {
+		t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err.Error())
+	}
+}
+
+func TestLoadConfigurationReportsInvalidRouteLine(t *testing.T) {
+	var files = map[string]string{
+		"moxie.yaml": "default_route: http://default.endpoint\nroutes:\n  - path: /good\n    endpoint: http://good\n  - path: /bad\n    endpoint: bad://bad\n",
+		"moxie.json": "{\n\"default_route\": \"http://default.endpoint\",\n\"routes\": [\n{\"path\": \"/good\", \"endpoint\": \"http://good\"},\n{\"path\": \"/bad\", \"endpoint\": \"bad://bad\"}\n]\n}\n",
+		"moxie.toml": "default_route = \"http://default.endpoint\"\n[[routes]]\npath = \"/good\"\nendpoint = \"http://good\"\n[[routes]]\npath = \"/bad\"\nendpoint = \"bad://bad\"\n",
+	}
+	expectedError := ":5: invalid RouteRule: unsupported scheme"
+	for name, contents := range files {
+		path := writeConfigurationFile(t, name, contents)
+		defer removeConfigurationFile(path)
+
+		_, err := LoadConfiguration(path)
+		if err == nil {
+			t.Fatalf("expected %s to be invalid", name)
+		}
+		if !strings.Contains(err.Error(), expectedError) {
+			t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err.Error())
+		}
+	}
+}
+
+func TestLoadConfigurationReportsSyntaxErrorLine(t *testing.T) {
+	var files = map[string]string{
+		"moxie.yaml": "default_route: http://default.endpoint\nroutes:\n  - path: [\n",
+		"moxie.json": "{\n\"default_route\": \"http://default.endpoint\",\n\"routes\": [,]\n}\n",
+		"moxie.toml": "default_route = \"http://default.endpoint\"\n\n[[routes]\n",
+	}
+	var expectedLines = map[string]string{
+		"moxie.yaml": "line 3",
+		"moxie.json": "line 3",
+		"moxie.toml": "(3, ",
+	}
+	for name, contents := range files {
+		path := writeConfigurationFile(t, name, contents)
+		defer removeConfigurationFile(path)
+
+		_, err := LoadConfiguration(path)
+		if err == nil {
+			t.Fatalf("expected %s to be invalid", name)
+		}
+		if !strings.Contains(err.Error(), expectedLines[name]) {
+			t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedLines[name], err.Error())
+		}
+	}
+}
+
+func TestLoadConfigurationRejectsUnknownFields(t *testing.T) {
+	expectedError := "line 2"
+	path := writeConfigurationFile(t, "moxie.yaml", "default_route: http://default.endpoint\nroute:\n  - path: /foo\n")
+	defer removeConfigurationFile(path)
+
+	_, err := LoadConfiguration(path)
+	if err == nil {
+		t.Fatal("expected error to be returned")
+	}
+	if !strings.Contains(err.Error(), expectedError) {
+		t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err.Error())
+	}
+}
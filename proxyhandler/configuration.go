@@ -1,29 +1,97 @@
 package proxyhandler
 
 import (
+	"crypto/tls"
 	"fmt"
+	"net/http"
 	"net/url"
+	"time"
 )
 
 // Configuration controls the behavior of a newly created ProxyHandler.
-// DefaultRoute is a URL string which is the target of any requests
-// that are not matched to any RouteRules in Routes. Each inbound request
-// has its URL.Path matched against each of the RouteRule.Path in the order
-// listed. The RouteRule.Path will match if it has the prefix of the
-// request URL.Path.
+// DefaultRoute is a URL string which is the target of any requests that are
+// not matched to any RouteRules in Routes. Each inbound request is directed to
+// the RouteRule with the longest RouteRule.Path made up of leading segments of
+// the request URL.Path and, when set, whose RouteRule.Host matches the request
+// Host. Routes with the same Path and Host are rejected as one would never be
+// used. Transport controls the connections made to the DefaultRoute and is the
+// default for each of the Routes. FlushInterval is how often response bodies
+// are flushed to the client while being copied, zero disables periodic
+// flushing and a negative value flushes after every write. Streaming responses
+// are always flushed after every write. ForwardedHeaders controls which
+// headers describe the client to backends. FallbackToDefaultRoute sends
+// requests for a route whose endpoints are all unhealthy to the DefaultRoute
+// rather than failing them. ErrorPages are the responses sent when a request
+// cannot be proxied, which only describe the cause of the failure when Debug
+// is enabled. Timeout limits how long each http request may wait for its
+// response and may be overridden by each route, zero waits for as long as the
+// client does. TLS enables TLS termination on the listener. H2C allows clients
+// of a listener without TLS to use HTTP/2 without TLS. The protocols of the
+// listener are fixed when the ProxyHandler is created. AccessLog enables
+// logging of every completed request. Tracing enables the export of a span for
+// every request and backend attempt. RequestIDHeader names the header,
+// X-Request-Id by default, which carries the ID of each request to its backend
+// and back to the client. An ID received from the client is kept, otherwise a
+// new one is generated. Admin controls the admin API served by
+// ProxyHandler.AdminHandler.
 type Configuration struct {
-	DefaultRoute string
-	Routes       []*RouteRule
+	DefaultRoute           string                  `yaml:"default_route"`
+	Routes                 []*RouteRule            `yaml:"routes"`
+	Transport              TransportConfiguration  `yaml:"transport"`
+	FlushInterval          time.Duration           `yaml:"flush_interval"`
+	ForwardedHeaders       ForwardedConfiguration  `yaml:"forwarded_headers"`
+	FallbackToDefaultRoute bool                    `yaml:"fallback_to_default_route"`
+	ErrorPages             ErrorPagesConfiguration `yaml:"error_pages"`
+	Debug                  bool                    `yaml:"debug"`
+	Timeout                time.Duration           `yaml:"timeout"`
+	TLS                    TLSConfiguration        `yaml:"tls"`
+	H2C                    bool                    `yaml:"h2c"`
+	AccessLog              *AccessLogConfiguration `yaml:"access_log"`
+	Tracing                *TracingConfiguration   `yaml:"tracing"`
+	RequestIDHeader        string                  `yaml:"request_id_header"`
+	Admin                  AdminConfiguration      `yaml:"admin"`
 }
 
 type validConfiguration struct {
-	DefaultRoute *url.URL
-	Routes       []*validRouteRule
+	DefaultRoute           *url.URL
+	DefaultRouteRule       *validRouteRule
+	Routes                 []*validRouteRule
+	TransportSettings      transportSettings
+	FlushInterval          time.Duration
+	ForwardedHeaders       *validForwardedConfiguration
+	FallbackToDefaultRoute bool
+	ErrorPages             *errorPages
+	TLSConfig              *tls.Config
+	Protocols              *http.Protocols
+	AccessLogSettings      *accessLogSettings
+	AccessLog              *accessLogger
+	TracingSettings        *tracingSettings
+	Tracer                 *tracer
+	RequestIDHeader        string
+	AdminToken             string
+	// Source is a copy of the Configuration which was validated.
+	Source *Configuration
+	router *router
+}
+
+// routeRuleError is returned by validate when one of the Configuration.Routes
+// is invalid. Index allows callers to relate the error back to its source.
+type routeRuleError struct {
+	Index int
+	Err   error
+}
+
+func (e *routeRuleError) Error() string {
+	return fmt.Sprintf("invalid RouteRule: %s", e.Err.Error())
 }
 
 func (config *Configuration) validate() (*validConfiguration, error) {
 	var err error
-	var validConfig = &validConfiguration{}
+	var validConfig = &validConfiguration{
+		FlushInterval:          config.FlushInterval,
+		FallbackToDefaultRoute: config.FallbackToDefaultRoute,
+		AdminToken:             config.Admin.Token,
+	}
 	if len(config.DefaultRoute) == 0 {
 		return nil, fmt.Errorf("default route is missing")
 	}
@@ -31,6 +99,49 @@ func (config *Configuration) validate() (*validConfiguration, error) {
 	if err != nil {
 		return nil, fmt.Errorf("invalid default route: %s", err.Error())
 	}
+	if err := config.Transport.validate(); err != nil {
+		return nil, fmt.Errorf("invalid transport: %s", err.Error())
+	}
+	validConfig.TransportSettings = config.Transport.apply(defaultTransportSettings)
+	if config.Timeout < 0 {
+		return nil, fmt.Errorf("timeout is negative")
+	}
+	defaultBackends := []*backend{newBackend(validConfig.DefaultRoute, 1)}
+	validConfig.DefaultRouteRule = &validRouteRule{
+		RouteRule:         RouteRule{Name: "default", Endpoint: config.DefaultRoute, Timeout: config.Timeout},
+		EndpointURL:       validConfig.DefaultRoute,
+		Backends:          defaultBackends,
+		Balancer:          &roundRobinBalancer{backends: defaultBackends},
+		TransportSettings: validConfig.TransportSettings,
+	}
+	validConfig.ForwardedHeaders, err = config.ForwardedHeaders.validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid forwarded headers: %s", err.Error())
+	}
+	validConfig.ErrorPages, err = config.ErrorPages.validate(config.Debug)
+	if err != nil {
+		return nil, fmt.Errorf("invalid error pages: %s", err.Error())
+	}
+	validConfig.TLSConfig, err = config.TLS.validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid tls: %s", err.Error())
+	}
+	if config.H2C && validConfig.TLSConfig != nil {
+		return nil, fmt.Errorf("h2c is not supported with tls")
+	}
+	validConfig.Protocols = config.listenerProtocols(validConfig.TLSConfig != nil)
+	validConfig.AccessLogSettings, err = config.AccessLog.validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid access log: %s", err.Error())
+	}
+	validConfig.TracingSettings, err = config.Tracing.validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid tracing: %s", err.Error())
+	}
+	validConfig.RequestIDHeader, err = validateRequestIDHeader(config.RequestIDHeader)
+	if err != nil {
+		return nil, err
+	}
 	if len(config.Routes) == 0 {
 		return nil, fmt.Errorf("no configured routes")
 	}
@@ -38,9 +149,17 @@ func (config *Configuration) validate() (*validConfiguration, error) {
 	for index, route := range config.Routes {
 		validRoute, err := route.validate()
 		if err != nil {
-			return nil, fmt.Errorf("invalid RouteRule: %s", err.Error())
+			return nil, &routeRuleError{Index: index, Err: err}
+		}
+		validRoute.TransportSettings = route.Transport.apply(validConfig.TransportSettings)
+		if validRoute.Timeout == 0 {
+			validRoute.Timeout = config.Timeout
 		}
 		validConfig.Routes[index] = validRoute
 	}
+	validConfig.router, err = newRouter(validConfig.Routes)
+	if err != nil {
+		return nil, err
+	}
 	return validConfig, nil
 }
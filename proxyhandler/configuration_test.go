@@ -1,8 +1,10 @@
 package proxyhandler
 
 import (
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 func buildConfiguration() *Configuration {
@@ -99,3 +101,24 @@ func TestValidationChecksDefaultRouteIsValid(t *testing.T) {
 		t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err.Error())
 	}
 }
+
+func TestValidationAppliesDefaultTimeout(t *testing.T) {
+	config := buildConfiguration()
+	config.Timeout = 5 * time.Second
+	config.Routes = append(config.Routes, &RouteRule{Path: "/route2", Endpoint: "http://endpoint.two", Timeout: time.Second})
+	validConfig, err := config.validate()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	expected := []time.Duration{5 * time.Second, 5 * time.Second, time.Second}
+	actual := []time.Duration{validConfig.DefaultRouteRule.Timeout, validConfig.Routes[0].Timeout, validConfig.Routes[1].Timeout}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("unexpected timeouts\nexpected: %v\nreceived: %v", expected, actual)
+	}
+
+	config.Timeout = -time.Second
+	expectedError := "timeout is negative"
+	if _, err := config.validate(); err == nil || err.Error() != expectedError {
+		t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+	}
+}
@@ -0,0 +1,191 @@
+package proxyhandler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// ErrorPagesConfiguration holds the templates of the responses sent to
+// clients when a request cannot be proxied. HTML is used for clients which
+// accept text/html and JSON for clients which prefer application/json. Each
+// template is executed with the fields Status, the numeric status code,
+// StatusText, its description, and Detail, which describes the error only
+// when Configuration.Debug is enabled. The JSON template may use the json
+// function to quote a value. Empty templates use the built in pages.
+type ErrorPagesConfiguration struct {
+	HTML string `yaml:"html"`
+	JSON string `yaml:"json"`
+}
+
+const defaultHTMLErrorPage = `<!DOCTYPE html>
+<html>
+<head><title>{{.Status}} {{.StatusText}}</title></head>
+<body>
+<h1>{{.Status}} {{.StatusText}}</h1>
+{{if .Detail}}<pre>{{.Detail}}</pre>
+{{end}}</body>
+</html>
+`
+
+const defaultJSONErrorPage = `{"status":{{.Status}},"error":{{json .StatusText}}{{if .Detail}},"detail":{{json .Detail}}{{end}}}
+`
+
+type errorPageData struct {
+	Status     int
+	StatusText string
+	Detail     string
+}
+
+// errorPages writes the responses for requests which could not be proxied.
+type errorPages struct {
+	html  *htmltemplate.Template
+	json  *texttemplate.Template
+	debug bool
+}
+
+func (pages ErrorPagesConfiguration) validate(debug bool) (*errorPages, error) {
+	htmlSource, jsonSource := pages.HTML, pages.JSON
+	if len(htmlSource) == 0 {
+		htmlSource = defaultHTMLErrorPage
+	}
+	if len(jsonSource) == 0 {
+		jsonSource = defaultJSONErrorPage
+	}
+	htmlPage, err := htmltemplate.New("html").Parse(htmlSource)
+	if err != nil {
+		return nil, fmt.Errorf("invalid html template: %s", err.Error())
+	}
+	jsonPage, err := texttemplate.New("json").Funcs(texttemplate.FuncMap{"json": quoteJSON}).Parse(jsonSource)
+	if err != nil {
+		return nil, fmt.Errorf("invalid json template: %s", err.Error())
+	}
+	return &errorPages{html: htmlPage, json: jsonPage, debug: debug}, nil
+}
+
+func quoteJSON(value interface{}) (string, error) {
+	encoded, err := json.Marshal(value)
+	return string(encoded), err
+}
+
+// proxyError is an error which prevented a request from being proxied, along
+// with the status sent to the client.
+type proxyError struct {
+	Status     int
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *proxyError) Error() string {
+	return e.Err.Error()
+}
+
+// classifyError returns err as a proxyError. Backends whose circuit is open
+// are unavailable, timeouts waiting for a backend are gateway timeouts and
+// any other failure to reach a backend is a bad gateway.
+func classifyError(err error) *proxyError {
+	var classified *proxyError
+	if errors.As(err, &classified) {
+		return classified
+	}
+	var circuitErr *circuitOpenError
+	if errors.As(err, &circuitErr) {
+		return &proxyError{Status: http.StatusServiceUnavailable, RetryAfter: circuitErr.retryAfter, Err: err}
+	}
+	var timeoutErr interface{ Timeout() bool }
+	if errors.As(err, &timeoutErr) && timeoutErr.Timeout() {
+		return &proxyError{Status: http.StatusGatewayTimeout, Err: err}
+	}
+	return &proxyError{Status: http.StatusBadGateway, Err: err}
+}
+
+// write responds to request with the page for err, in the format preferred
+// by the client. The detail of err is only included in debug mode.
+func (pages *errorPages) write(writer http.ResponseWriter, request *http.Request, err *proxyError) {
+	data := errorPageData{Status: err.Status, StatusText: http.StatusText(err.Status)}
+	if pages.debug {
+		data.Detail = err.Error()
+	}
+
+	var body bytes.Buffer
+	var contentType string
+	var executeErr error
+	switch negotiateErrorFormat(request.Header.Get("Accept")) {
+	case "json":
+		contentType = "application/json; charset=utf-8"
+		executeErr = pages.json.Execute(&body, data)
+	case "html":
+		contentType = "text/html; charset=utf-8"
+		executeErr = pages.html.Execute(&body, data)
+	default:
+		contentType = "text/plain; charset=utf-8"
+		fmt.Fprintf(&body, "%d %s\n", data.Status, data.StatusText)
+		if len(data.Detail) > 0 {
+			fmt.Fprintln(&body, data.Detail)
+		}
+	}
+	if executeErr != nil {
+		logRequestf(request, "error executing error page: %s", executeErr.Error())
+		body.Reset()
+		contentType = "text/plain; charset=utf-8"
+		fmt.Fprintf(&body, "%d %s\n", data.Status, data.StatusText)
+	}
+
+	header := writer.Header()
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Length", strconv.Itoa(body.Len()))
+	header.Set("X-Content-Type-Options", "nosniff")
+	if err.RetryAfter > 0 {
+		seconds := int64((err.RetryAfter + time.Second - 1) / time.Second)
+		header.Set("Retry-After", strconv.FormatInt(seconds, 10))
+	}
+	writer.WriteHeader(err.Status)
+	writer.Write(body.Bytes())
+}
+
+// negotiateErrorFormat chooses "json", "html" or "text" for the error page
+// from the Accept header of a request, preferring the media type with the
+// highest quality and html when none is acceptable or Accept is missing.
+func negotiateErrorFormat(accept string) string {
+	if len(strings.TrimSpace(accept)) == 0 {
+		return "html"
+	}
+	format, best := "html", -1.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			if quality, err = strconv.ParseFloat(q, 64); err != nil || quality <= 0 {
+				continue
+			}
+		}
+		var candidate string
+		switch {
+		case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+			candidate = "json"
+		case mediaType == "text/html" || mediaType == "application/xhtml+xml":
+			candidate = "html"
+		case mediaType == "text/plain" || mediaType == "text/*":
+			candidate = "text"
+		case mediaType == "*/*":
+			candidate = "html"
+		default:
+			continue
+		}
+		if quality > best {
+			format, best = candidate, quality
+		}
+	}
+	return format
+}
@@ -0,0 +1,103 @@
+package proxyhandler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClassifyError(t *testing.T) {
+	expectations := []struct {
+		err      error
+		expected int
+	}{
+		{fmt.Errorf("connection refused"), http.StatusBadGateway},
+		{context.DeadlineExceeded, http.StatusGatewayTimeout},
+		{&perTryTimeoutError{timeout: time.Second}, http.StatusGatewayTimeout},
+		{&circuitOpenError{backend: &backend{}, retryAfter: time.Second}, http.StatusServiceUnavailable},
+		{&proxyError{Status: http.StatusBadRequest, Err: fmt.Errorf("bad body")}, http.StatusBadRequest},
+	}
+	for _, expectation := range expectations {
+		if status := classifyError(expectation.err).Status; status != expectation.expected {
+			t.Errorf("unexpected status for %T\nexpected: %v\nreceived: %v", expectation.err, expectation.expected, status)
+		}
+	}
+}
+
+func TestNegotiateErrorFormat(t *testing.T) {
+	expectations := map[string]string{
+		"":                                     "html",
+		"application/json":                     "json",
+		"application/problem+json":             "json",
+		"text/html,application/json;q=0.9":     "html",
+		"text/html;q=0.5, application/json":    "json",
+		"text/plain":                           "text",
+		"*/*":                                  "html",
+		"image/png":                            "html",
+		"application/json;q=0, text/plain;q=1": "text",
+	}
+	for accept, expected := range expectations {
+		if format := negotiateErrorFormat(accept); format != expected {
+			t.Errorf("unexpected format for %q\nexpected: %v\nreceived: %v", accept, expected, format)
+		}
+	}
+}
+
+func TestErrorPagesUseConfiguredTemplates(t *testing.T) {
+	pages, err := ErrorPagesConfiguration{
+		HTML: "<p>{{.Status}} {{.Detail}}</p>",
+		JSON: `{"code":{{.Status}},"message":{{json .StatusText}}}`,
+	}.validate(true)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	failure := &proxyError{Status: http.StatusServiceUnavailable, RetryAfter: 1500 * time.Millisecond, Err: fmt.Errorf("<down>")}
+
+	recorder := httptest.NewRecorder()
+	pages.write(recorder, httptest.NewRequest("GET", "/", nil), failure)
+	if body := recorder.Body.String(); body != "<p>503 &lt;down&gt;</p>" {
+		t.Errorf("unexpected html page\nexpected: %v\nreceived: %v", "<p>503 &lt;down&gt;</p>", body)
+	}
+	if retryAfter := recorder.Header().Get("Retry-After"); retryAfter != "2" {
+		t.Errorf("unexpected Retry-After\nexpected: %v\nreceived: %v", "2", retryAfter)
+	}
+
+	recorder = httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/", nil)
+	request.Header.Set("Accept", "application/json")
+	pages.write(recorder, request, failure)
+	expected := `{"code":503,"message":"Service Unavailable"}`
+	if body := recorder.Body.String(); body != expected {
+		t.Errorf("unexpected json page\nexpected: %v\nreceived: %v", expected, body)
+	}
+}
+
+func TestErrorPagesRejectInvalidTemplates(t *testing.T) {
+	expectations := map[string]ErrorPagesConfiguration{
+		"invalid html template": {HTML: "{{.Status"},
+		"invalid json template": {JSON: "{{.Status"},
+	}
+	for expectedError, pages := range expectations {
+		_, err := pages.validate(false)
+		if err == nil || !strings.HasPrefix(err.Error(), expectedError) {
+			t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+		}
+	}
+}
+
+func TestDefaultErrorPagesOmitDetail(t *testing.T) {
+	pages, _ := ErrorPagesConfiguration{}.validate(false)
+	for _, accept := range []string{"text/html", "application/json", "text/plain"} {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "/", nil)
+		request.Header.Set("Accept", accept)
+		pages.write(recorder, request, &proxyError{Status: http.StatusBadGateway, Err: fmt.Errorf("dial tcp 10.0.0.1:80")})
+		if body := recorder.Body.String(); strings.Contains(body, "10.0.0.1") || !strings.Contains(body, "Bad Gateway") {
+			t.Errorf("unexpected %s page: %s", accept, body)
+		}
+	}
+}
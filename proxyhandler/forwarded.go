@@ -0,0 +1,149 @@
+package proxyhandler
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ForwardedConfiguration controls the headers which tell a backend about the
+// client which made a request. XForwarded emits X-Forwarded-For,
+// X-Forwarded-Proto and X-Forwarded-Host. Forwarded emits the RFC 7239
+// Forwarded header. TrustedProxies is a list of CIDRs, or single addresses, of
+// proxies in front of moxie. Values received from a trusted proxy are appended
+// to, any others are overwritten. ClientCertificateHeaders maps the name of a
+// header to the field of the verified client certificate sent in it, such as
+// "X-Client-Cert-Subject: subject". These headers are always removed from the
+// client request, so backends may trust their values.
+type ForwardedConfiguration struct {
+	XForwarded               bool              `yaml:"x_forwarded"`
+	Forwarded                bool              `yaml:"forwarded"`
+	TrustedProxies           []string          `yaml:"trusted_proxies"`
+	ClientCertificateHeaders map[string]string `yaml:"client_certificate_headers"`
+}
+
+type validForwardedConfiguration struct {
+	XForwarded               bool
+	Forwarded                bool
+	TrustedProxies           []*net.IPNet
+	ClientCertificateHeaders map[string]string
+}
+
+func (forwarded ForwardedConfiguration) validate() (*validForwardedConfiguration, error) {
+	validForwarded := &validForwardedConfiguration{
+		XForwarded: forwarded.XForwarded,
+		Forwarded:  forwarded.Forwarded,
+	}
+	for _, proxy := range forwarded.TrustedProxies {
+		if !strings.Contains(proxy, "/") {
+			if strings.Contains(proxy, ":") {
+				proxy += "/128"
+			} else {
+				proxy += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy: %s", err.Error())
+		}
+		validForwarded.TrustedProxies = append(validForwarded.TrustedProxies, network)
+	}
+	for name, field := range forwarded.ClientCertificateHeaders {
+		if len(name) == 0 {
+			return nil, fmt.Errorf("client certificate header name is empty")
+		}
+		if _, ok := clientCertificateFields[field]; !ok {
+			return nil, fmt.Errorf("unknown client certificate field %s for header %s, expected one of %s", field, name, clientCertificateFieldNames())
+		}
+		if validForwarded.ClientCertificateHeaders == nil {
+			validForwarded.ClientCertificateHeaders = make(map[string]string)
+		}
+		validForwarded.ClientCertificateHeaders[http.CanonicalHeaderKey(name)] = field
+	}
+	return validForwarded, nil
+}
+
+func (forwarded *validForwardedConfiguration) trusts(ip net.IP) bool {
+	for _, network := range forwarded.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply sets the configured forwarding headers on header, which will be sent
+// to the backend, describing the client of upstreamRequest.
+func (forwarded *validForwardedConfiguration) apply(header http.Header, upstreamRequest *http.Request) {
+	for name, field := range forwarded.ClientCertificateHeaders {
+		header.Del(name)
+		if values := clientCertificateValues(upstreamRequest, field); len(values) > 0 {
+			header.Set(name, strings.Join(values, ", "))
+		}
+	}
+	if !forwarded.XForwarded && !forwarded.Forwarded {
+		return
+	}
+	clientAddress := upstreamRequest.RemoteAddr
+	if host, _, err := net.SplitHostPort(clientAddress); err == nil {
+		clientAddress = host
+	}
+	proto := "http"
+	if upstreamRequest.TLS != nil {
+		proto = "https"
+	}
+	trusted := forwarded.trusts(net.ParseIP(clientAddress))
+
+	if forwarded.XForwarded {
+		priorFor := strings.Join(upstreamRequest.Header["X-Forwarded-For"], ", ")
+		if trusted && len(priorFor) > 0 {
+			header.Set("X-Forwarded-For", priorFor+", "+clientAddress)
+		} else {
+			header.Set("X-Forwarded-For", clientAddress)
+		}
+		if !trusted || len(upstreamRequest.Header.Get("X-Forwarded-Proto")) == 0 {
+			header.Set("X-Forwarded-Proto", proto)
+		}
+		if !trusted || len(upstreamRequest.Header.Get("X-Forwarded-Host")) == 0 {
+			header.Set("X-Forwarded-Host", upstreamRequest.Host)
+		}
+	}
+
+	if forwarded.Forwarded {
+		element := fmt.Sprintf("for=%s;host=%s;proto=%s",
+			forwardedNode(clientAddress), forwardedValue(upstreamRequest.Host), proto)
+		priorForwarded := strings.Join(upstreamRequest.Header["Forwarded"], ", ")
+		if trusted && len(priorForwarded) > 0 {
+			header.Set("Forwarded", priorForwarded+", "+element)
+		} else {
+			header.Set("Forwarded", element)
+		}
+	}
+}
+
+// forwardedNode formats address as a node of the Forwarded header. IPv6
+// addresses are bracketed and quoted, see RFC 7239 section 6.
+func forwardedNode(address string) string {
+	if ip := net.ParseIP(address); ip != nil && ip.To4() == nil {
+		return `"[` + address + `]"`
+	}
+	return forwardedValue(address)
+}
+
+// forwardedValue quotes value when it is not a valid token.
+func forwardedValue(value string) string {
+	for _, character := range value {
+		if !isTokenCharacter(character) {
+			return `"` + strings.Replace(value, `"`, `\"`, -1) + `"`
+		}
+	}
+	return value
+}
+
+func isTokenCharacter(character rune) bool {
+	if character >= 'a' && character <= 'z' || character >= 'A' && character <= 'Z' || character >= '0' && character <= '9' {
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", character)
+}
@@ -0,0 +1,129 @@
+package proxyhandler
+
+import (
+	"github.com/jarcoal/httpmock"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func buildForwardedConfiguration(trustedProxies ...string) *validForwardedConfiguration {
+	forwarded, err := ForwardedConfiguration{
+		XForwarded:     true,
+		Forwarded:      true,
+		TrustedProxies: trustedProxies,
+	}.validate()
+	if err != nil {
+		panic(err)
+	}
+	return forwarded
+}
+
+func TestForwardedValidatesTrustedProxies(t *testing.T) {
+	forwarded := buildForwardedConfiguration("10.0.0.0/8", "192.168.1.1", "::1")
+	for _, address := range []string{"10.1.2.3", "192.168.1.1", "::1"} {
+		if !forwarded.trusts(net.ParseIP(address)) {
+			t.Errorf("expected %s to be trusted", address)
+		}
+	}
+	if forwarded.trusts(net.ParseIP("192.168.1.2")) {
+		t.Error("expected 192.168.1.2 to be untrusted")
+	}
+
+	expectedError := "invalid trusted proxy"
+	_, err := ForwardedConfiguration{TrustedProxies: []string{"not.an.address"}}.validate()
+	if err == nil {
+		t.Fatal("expected error to be returned")
+	}
+	if !strings.Contains(err.Error(), expectedError) {
+		t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err.Error())
+	}
+}
+
+func TestForwardedOverwritesUntrustedValues(t *testing.T) {
+	request := httptest.NewRequest("GET", "http://example.com/", nil)
+	request.RemoteAddr = "203.0.113.7:4321"
+	request.Header.Set("X-Forwarded-For", "1.1.1.1")
+	request.Header.Set("X-Forwarded-Proto", "https")
+	request.Header.Set("X-Forwarded-Host", "spoofed.com")
+	request.Header.Set("Forwarded", "for=1.1.1.1")
+	header := http.Header{}
+	copyHeaders(header, request.Header)
+
+	buildForwardedConfiguration("10.0.0.0/8").apply(header, request)
+
+	var expectedHeaders = map[string]string{
+		"X-Forwarded-For":   "203.0.113.7",
+		"X-Forwarded-Proto": "http",
+		"X-Forwarded-Host":  "example.com",
+		"Forwarded":         "for=203.0.113.7;host=example.com;proto=http",
+	}
+	for name, expected := range expectedHeaders {
+		if actual := header.Get(name); actual != expected {
+			t.Errorf("unexpected %s\nexpected: %v\nreceived: %v", name, expected, actual)
+		}
+	}
+}
+
+func TestForwardedAppendsTrustedValues(t *testing.T) {
+	request := httptest.NewRequest("GET", "http://example.com:8080/", nil)
+	request.RemoteAddr = "10.0.0.2:4321"
+	request.Header.Set("X-Forwarded-For", "198.51.100.1")
+	request.Header.Set("X-Forwarded-Proto", "https")
+	request.Header.Set("X-Forwarded-Host", "public.example.com")
+	request.Header.Set("Forwarded", `for="[2001:db8::1]";proto=https`)
+	header := http.Header{}
+	copyHeaders(header, request.Header)
+
+	buildForwardedConfiguration("10.0.0.0/8").apply(header, request)
+
+	var expectedHeaders = map[string]string{
+		"X-Forwarded-For":   "198.51.100.1, 10.0.0.2",
+		"X-Forwarded-Proto": "https",
+		"X-Forwarded-Host":  "public.example.com",
+		"Forwarded":         `for="[2001:db8::1]";proto=https, for=10.0.0.2;host="example.com:8080";proto=http`,
+	}
+	for name, expected := range expectedHeaders {
+		if actual := header.Get(name); actual != expected {
+			t.Errorf("unexpected %s\nexpected: %v\nreceived: %v", name, expected, actual)
+		}
+	}
+}
+
+func TestForwardedQuotesIPv6Clients(t *testing.T) {
+	request := httptest.NewRequest("GET", "http://example.com/", nil)
+	request.RemoteAddr = "[2001:db8::2]:4321"
+	header := http.Header{}
+
+	buildForwardedConfiguration().apply(header, request)
+
+	expected := `for="[2001:db8::2]";host=example.com;proto=http`
+	if actual := header.Get("Forwarded"); actual != expected {
+		t.Errorf("unexpected Forwarded\nexpected: %v\nreceived: %v", expected, actual)
+	}
+}
+
+func TestForwardedHeadersAreSentToBackend(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	success := false
+	httpmock.RegisterResponder("GET", "http://defaulthost/", func(r *http.Request) (*http.Response, error) {
+		success = r.Header.Get("X-Forwarded-For") == "192.0.2.1" && r.Header.Get("Forwarded") != ""
+		return httpmock.NewStringResponse(200, ""), nil
+	})
+
+	config := buildConfiguration()
+	config.DefaultRoute = "http://defaulthost"
+	config.ForwardedHeaders = ForwardedConfiguration{XForwarded: true, Forwarded: true}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if !success {
+		t.Error("Expected forwarded headers to be sent to the backend")
+	}
+}
@@ -0,0 +1,201 @@
+package proxyhandler
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// HealthCheckConfiguration enables active health checks of each endpoint of a
+// RouteRule. Every Interval a request for Path is sent to the endpoint and
+// succeeds when it responds with ExpectedStatus within Timeout. Endpoints of
+// websocket routes are checked by completing a websocket handshake for Path
+// instead. An endpoint is removed from the route after Fall consecutive
+// failed checks and restored after Rise consecutive successful checks.
+type HealthCheckConfiguration struct {
+	Path           string        `yaml:"path"`
+	ExpectedStatus int           `yaml:"expected_status"`
+	Interval       time.Duration `yaml:"interval"`
+	Timeout        time.Duration `yaml:"timeout"`
+	Rise           int           `yaml:"rise"`
+	Fall           int           `yaml:"fall"`
+}
+
+// healthCheckSettings is a resolved HealthCheckConfiguration. It is comparable
+// so that a running health check is only restarted when its settings change.
+type healthCheckSettings struct {
+	Path           string
+	ExpectedStatus int
+	Interval       time.Duration
+	Timeout        time.Duration
+	Rise           int
+	Fall           int
+}
+
+var defaultHealthCheckSettings = healthCheckSettings{
+	Path:           "/",
+	ExpectedStatus: http.StatusOK,
+	Interval:       10 * time.Second,
+	Timeout:        2 * time.Second,
+	Rise:           2,
+	Fall:           3,
+}
+
+// validate returns the settings of the health check, or nil when health
+// checks are not enabled.
+func (check *HealthCheckConfiguration) validate() (*healthCheckSettings, error) {
+	if check == nil {
+		return nil, nil
+	}
+	if len(check.Path) > 0 && !strings.HasPrefix(check.Path, "/") {
+		return nil, fmt.Errorf("path must begin with /")
+	}
+	if check.ExpectedStatus != 0 && (check.ExpectedStatus < 100 || check.ExpectedStatus > 599) {
+		return nil, fmt.Errorf("invalid expected status: %d", check.ExpectedStatus)
+	}
+	if check.Interval < 0 {
+		return nil, fmt.Errorf("interval is negative")
+	}
+	if check.Timeout < 0 {
+		return nil, fmt.Errorf("timeout is negative")
+	}
+	if check.Rise < 0 {
+		return nil, fmt.Errorf("rise is negative")
+	}
+	if check.Fall < 0 {
+		return nil, fmt.Errorf("fall is negative")
+	}
+
+	settings := defaultHealthCheckSettings
+	if len(check.Path) > 0 {
+		settings.Path = check.Path
+	}
+	if check.ExpectedStatus > 0 {
+		settings.ExpectedStatus = check.ExpectedStatus
+	}
+	if check.Interval > 0 {
+		settings.Interval = check.Interval
+	}
+	if check.Timeout > 0 {
+		settings.Timeout = check.Timeout
+	}
+	if check.Rise > 0 {
+		settings.Rise = check.Rise
+	}
+	if check.Fall > 0 {
+		settings.Fall = check.Fall
+	}
+	return &settings, nil
+}
+
+// healthChecker periodically checks a single backend and records the result
+// in its backendState.
+type healthChecker struct {
+	target    *url.URL
+	settings  healthCheckSettings
+	transport transportSettings
+	state     *backendState
+	pool      *transportPool
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+func startHealthChecker(target *url.URL, settings healthCheckSettings, transport transportSettings, state *backendState, pool *transportPool) *healthChecker {
+	checker := &healthChecker{
+		target:    target,
+		settings:  settings,
+		transport: transport,
+		state:     state,
+		pool:      pool,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go checker.run()
+	return checker
+}
+
+func (checker *healthChecker) run() {
+	defer close(checker.done)
+	ticker := time.NewTicker(checker.settings.Interval)
+	defer ticker.Stop()
+	successes, failures := 0, 0
+	for {
+		err := checker.check()
+		if err == nil {
+			successes, failures = successes+1, 0
+			if !checker.state.healthy() && successes >= checker.settings.Rise {
+				checker.state.setHealthy(true)
+				log.Printf("health: backend %s is healthy", checker.target.String())
+			}
+		} else {
+			successes, failures = 0, failures+1
+			if checker.state.healthy() && failures >= checker.settings.Fall {
+				checker.state.setHealthy(false)
+				log.Printf("health: backend %s is unhealthy: %s", checker.target.String(), err.Error())
+			}
+		}
+
+		select {
+		case <-checker.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// close stops the health checker and waits for any check in progress.
+func (checker *healthChecker) close() {
+	close(checker.stop)
+	<-checker.done
+}
+
+func (checker *healthChecker) check() error {
+	checkURL := &url.URL{Scheme: checker.target.Scheme, Host: checker.target.Host, Path: checker.settings.Path}
+	if isWebsocketScheme(checkURL.Scheme) {
+		return checker.checkWebsocket(checkURL)
+	}
+	return checker.checkHTTP(checkURL)
+}
+
+func (checker *healthChecker) checkHTTP(checkURL *url.URL) error {
+	request, err := http.NewRequest("GET", checkURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("User-Agent", "moxie-health-check")
+	client := http.Client{
+		Transport: checker.pool.roundTripper(checker.target, checker.transport),
+		Timeout:   checker.settings.Timeout,
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != checker.settings.ExpectedStatus {
+		return fmt.Errorf("unexpected status %d", response.StatusCode)
+	}
+	return nil
+}
+
+func (checker *healthChecker) checkWebsocket(checkURL *url.URL) error {
+	transportDialer, err := checker.pool.websocketDialer(checker.transport)
+	if err != nil {
+		return err
+	}
+	dialer := *transportDialer
+	dialer.HandshakeTimeout = checker.settings.Timeout
+	header := http.Header{"User-Agent": []string{"moxie-health-check"}}
+	connection, response, err := dialer.Dial(checkURL.String(), header)
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		return fmt.Errorf("unexpected status %d", response.StatusCode)
+	}
+	return nil
+}
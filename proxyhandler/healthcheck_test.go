@@ -0,0 +1,141 @@
+package proxyhandler
+
+import (
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func waitForHealth(t *testing.T, state *backendState, healthy bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for state.healthy() != healthy {
+		if time.Now().After(deadline) {
+			t.Fatalf("backend health did not change\nexpected: %v\nreceived: %v", healthy, state.healthy())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHealthCheckValidateAppliesDefaults(t *testing.T) {
+	settings, err := (&HealthCheckConfiguration{Path: "/health", Fall: 5}).validate()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	expected := defaultHealthCheckSettings
+	expected.Path = "/health"
+	expected.Fall = 5
+	if *settings != expected {
+		t.Errorf("unexpected settings\nexpected: %v\nreceived: %v", expected, *settings)
+	}
+
+	var disabled *HealthCheckConfiguration
+	if settings, err := disabled.validate(); settings != nil || err != nil {
+		t.Errorf("expected disabled health check\nexpected: %v\nreceived: %v", nil, settings)
+	}
+}
+
+func TestHealthCheckValidateRejectsInvalidConfiguration(t *testing.T) {
+	expectations := map[string]HealthCheckConfiguration{
+		"path must begin with /":       {Path: "health"},
+		"invalid expected status: 700": {ExpectedStatus: 700},
+		"interval is negative":         {Interval: -time.Second},
+		"timeout is negative":          {Timeout: -time.Second},
+		"rise is negative":             {Rise: -1},
+		"fall is negative":             {Fall: -1},
+	}
+	for expectedError, check := range expectations {
+		_, err := check.validate()
+		if err == nil || err.Error() != expectedError {
+			t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+		}
+	}
+}
+
+func TestHTTPHealthCheckEjectsAndRestoresBackend(t *testing.T) {
+	var status int32 = http.StatusOK
+	var requestedPath atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestedPath.Store(r.URL.Path)
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer server.Close()
+
+	target, _ := url.Parse(server.URL)
+	settings := healthCheckSettings{Path: "/health", ExpectedStatus: http.StatusOK, Interval: time.Millisecond, Timeout: time.Second, Rise: 2, Fall: 2}
+	state := &backendState{}
+	checker := startHealthChecker(target, settings, defaultTransportSettings, state, newTransportPool())
+	defer checker.close()
+
+	atomic.StoreInt32(&status, http.StatusInternalServerError)
+	waitForHealth(t, state, false)
+	atomic.StoreInt32(&status, http.StatusOK)
+	waitForHealth(t, state, true)
+	if path := requestedPath.Load(); path != "/health" {
+		t.Errorf("unexpected health check path\nexpected: %v\nreceived: %v", "/health", path)
+	}
+}
+
+func TestWebsocketHealthCheckCompletesHandshake(t *testing.T) {
+	var refuse int32
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&refuse) == 1 {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		connection, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		connection.Close()
+	}))
+	defer server.Close()
+
+	target, _ := url.Parse("ws://" + strings.TrimPrefix(server.URL, "http://"))
+	settings := healthCheckSettings{Path: "/", Interval: time.Millisecond, Timeout: time.Second, Rise: 1, Fall: 1}
+	state := &backendState{}
+	state.setHealthy(false)
+	checker := startHealthChecker(target, settings, defaultTransportSettings, state, newTransportPool())
+	defer checker.close()
+
+	waitForHealth(t, state, true)
+	atomic.StoreInt32(&refuse, 1)
+	waitForHealth(t, state, false)
+}
+
+func TestBackendRegistryRestartsChangedHealthChecks(t *testing.T) {
+	registry := newBackendRegistry(newTransportPool())
+	defer registry.close()
+	config := buildConfiguration()
+	config.Routes[0].HealthCheck = &HealthCheckConfiguration{Interval: time.Hour}
+	first, err := config.validate()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	registry.bind(first)
+	checker := registry.checkers["http://endpoint.one"]
+	if checker == nil {
+		t.Fatal("expected health check to be started")
+	}
+
+	second, _ := config.validate()
+	registry.bind(second)
+	if registry.checkers["http://endpoint.one"] != checker {
+		t.Error("expected unchanged health check to keep running")
+	}
+
+	config.Routes[0].HealthCheck = nil
+	third, _ := config.validate()
+	registry.bind(third)
+	if len(registry.checkers) != 0 {
+		t.Errorf("unexpected health checks\nexpected: %v\nreceived: %v", 0, len(registry.checkers))
+	}
+	if !third.Routes[0].Backends[0].healthy() {
+		t.Error("expected backend without health check to be healthy")
+	}
+}
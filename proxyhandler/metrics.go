@@ -0,0 +1,213 @@
+package proxyhandler
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metricBuckets are the upper bounds, in seconds, of the latency histograms.
+var metricBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metricSeries is the value of a metric for one combination of label values.
+type metricSeries struct {
+	labelValues []string
+	value       float64
+	// buckets and count are only used by histograms, whose value is the sum
+	// of the observations.
+	buckets []uint64
+	count   uint64
+}
+
+// metricVec is a metric with a series for each combination of the values of
+// its labels, written in the Prometheus text exposition format.
+type metricVec struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	mutex   sync.Mutex
+	series  map[string]*metricSeries
+}
+
+func newMetricVec(kind, name, help string, labels ...string) *metricVec {
+	return &metricVec{name: name, help: help, kind: kind, labels: labels, series: make(map[string]*metricSeries)}
+}
+
+func newHistogramVec(name, help string, labels ...string) *metricVec {
+	vec := newMetricVec("histogram", name, help, labels...)
+	vec.buckets = metricBuckets
+	return vec
+}
+
+// with returns the series for labelValues, creating it when necessary. The
+// caller must hold the mutex.
+func (vec *metricVec) with(labelValues []string) *metricSeries {
+	key := strings.Join(labelValues, "\xff")
+	series, ok := vec.series[key]
+	if !ok {
+		series = &metricSeries{labelValues: labelValues}
+		if vec.buckets != nil {
+			series.buckets = make([]uint64, len(vec.buckets))
+		}
+		vec.series[key] = series
+	}
+	return series
+}
+
+// add adds delta to the counter or gauge with labelValues.
+func (vec *metricVec) add(delta float64, labelValues ...string) {
+	vec.mutex.Lock()
+	defer vec.mutex.Unlock()
+	vec.with(labelValues).value += delta
+}
+
+// observe records value in the histogram with labelValues.
+func (vec *metricVec) observe(value float64, labelValues ...string) {
+	vec.mutex.Lock()
+	defer vec.mutex.Unlock()
+	series := vec.with(labelValues)
+	for index, bound := range vec.buckets {
+		if value <= bound {
+			series.buckets[index]++
+		}
+	}
+	series.count++
+	series.value += value
+}
+
+func (vec *metricVec) write(writer io.Writer) {
+	vec.mutex.Lock()
+	defer vec.mutex.Unlock()
+	fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s %s\n", vec.name, vec.help, vec.name, vec.kind)
+	keys := make([]string, 0, len(vec.series))
+	for key := range vec.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		series := vec.series[key]
+		labels := formatMetricLabels(vec.labels, series.labelValues)
+		if vec.kind != "histogram" {
+			fmt.Fprintf(writer, "%s%s %s\n", vec.name, labels, formatMetricValue(series.value))
+			continue
+		}
+		names := append(append([]string{}, vec.labels...), "le")
+		for index, bound := range vec.buckets {
+			values := append(append([]string{}, series.labelValues...), formatMetricValue(bound))
+			fmt.Fprintf(writer, "%s_bucket%s %d\n", vec.name, formatMetricLabels(names, values), series.buckets[index])
+		}
+		values := append(append([]string{}, series.labelValues...), "+Inf")
+		fmt.Fprintf(writer, "%s_bucket%s %d\n", vec.name, formatMetricLabels(names, values), series.count)
+		fmt.Fprintf(writer, "%s_sum%s %s\n", vec.name, labels, formatMetricValue(series.value))
+		fmt.Fprintf(writer, "%s_count%s %d\n", vec.name, labels, series.count)
+	}
+}
+
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatMetricLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for index, name := range names {
+		pairs[index] = name + `="` + metricLabelEscaper.Replace(values[index]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatMetricValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// proxyMetrics are the metrics of a ProxyHandler. They are kept across
+// reloads of its configuration.
+type proxyMetrics struct {
+	requests         *metricVec
+	requestDuration  *metricVec
+	upstreamDuration *metricVec
+	inFlight         *metricVec
+	websockets       *metricVec
+	requestBytes     *metricVec
+	responseBytes    *metricVec
+	backendErrors    *metricVec
+	configReloads    *metricVec
+	families         []*metricVec
+}
+
+func newProxyMetrics() *proxyMetrics {
+	metrics := &proxyMetrics{
+		requests:         newMetricVec("counter", "moxie_requests_total", "Requests completed, by route, backend and status class.", "route", "backend", "code"),
+		requestDuration:  newHistogramVec("moxie_request_duration_seconds", "Time taken to serve requests, by route.", "route"),
+		upstreamDuration: newHistogramVec("moxie_upstream_duration_seconds", "Time spent waiting for backends to respond, by route and backend.", "route", "backend"),
+		inFlight:         newMetricVec("gauge", "moxie_requests_in_flight", "Requests currently being served."),
+		websockets:       newMetricVec("gauge", "moxie_websocket_connections_active", "Websocket sessions currently open, by route.", "route"),
+		requestBytes:     newMetricVec("counter", "moxie_request_bytes_total", "Bytes received from clients, by route.", "route"),
+		responseBytes:    newMetricVec("counter", "moxie_response_bytes_total", "Bytes sent to clients, by route.", "route"),
+		backendErrors:    newMetricVec("counter", "moxie_backend_errors_total", "Failed attempts to reach a backend, by route, backend and type.", "route", "backend", "type"),
+		configReloads:    newMetricVec("counter", "moxie_config_reloads_total", "Configuration reloads, by result.", "result"),
+	}
+	metrics.families = []*metricVec{
+		metrics.requests, metrics.requestDuration, metrics.upstreamDuration, metrics.inFlight, metrics.websockets,
+		metrics.requestBytes, metrics.responseBytes, metrics.backendErrors, metrics.configReloads,
+	}
+	metrics.inFlight.add(0)
+	return metrics
+}
+
+// observeRequest records a completed request described by stats.
+func (metrics *proxyMetrics) observeRequest(stats *requestStats) {
+	code := strconv.Itoa(stats.Status/100) + "xx"
+	metrics.requests.add(1, stats.Route, stats.Backend, code)
+	metrics.requestDuration.observe(stats.Duration.Seconds(), stats.Route)
+	if len(stats.Backend) > 0 && !stats.Websocket {
+		metrics.upstreamDuration.observe(stats.UpstreamLatency.Seconds(), stats.Route, stats.Backend)
+	}
+	metrics.requestBytes.add(float64(stats.RequestBytes()), stats.Route)
+	metrics.responseBytes.add(float64(stats.ResponseBytes()), stats.Route)
+}
+
+// observeBackendError records a failed attempt to reach backendURL.
+func (metrics *proxyMetrics) observeBackendError(route, backendURL string, err error) {
+	metrics.backendErrors.add(1, route, backendURL, backendErrorType(err))
+}
+
+// backendErrorType names the kind of failure err describes: the circuit of
+// the backend was open, the backend did not respond in time, the client went
+// away, or the backend could not be reached.
+func backendErrorType(err error) string {
+	var circuitErr *circuitOpenError
+	if errors.As(err, &circuitErr) {
+		return "circuit_open"
+	}
+	var timeoutErr interface{ Timeout() bool }
+	if errors.As(err, &timeoutErr) && timeoutErr.Timeout() {
+		return "timeout"
+	}
+	if errors.Is(err, context.Canceled) {
+		return "canceled"
+	}
+	return "connection"
+}
+
+func (metrics *proxyMetrics) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	buffered := bufio.NewWriter(writer)
+	for _, family := range metrics.families {
+		family.write(buffered)
+	}
+	buffered.Flush()
+}
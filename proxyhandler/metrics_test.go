@@ -0,0 +1,140 @@
+package proxyhandler
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/jarcoal/httpmock"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricVecWritesExposition(t *testing.T) {
+	counter := newMetricVec("counter", "test_total", "Test counter.", "route")
+	counter.add(2, `say "hi"`)
+	counter.add(1, "plain")
+	histogram := newHistogramVec("test_seconds", "Test histogram.", "route")
+	histogram.observe(0.02, "a")
+	histogram.observe(3, "a")
+
+	var buffer bytes.Buffer
+	counter.write(&buffer)
+	histogram.write(&buffer)
+	exposition := buffer.String()
+	for _, expected := range []string{
+		"# HELP test_total Test counter.\n# TYPE test_total counter\n",
+		`test_total{route="plain"} 1` + "\n",
+		`test_total{route="say \"hi\""} 2` + "\n",
+		"# TYPE test_seconds histogram\n",
+		`test_seconds_bucket{route="a",le="0.01"} 0` + "\n",
+		`test_seconds_bucket{route="a",le="0.025"} 1` + "\n",
+		`test_seconds_bucket{route="a",le="5"} 2` + "\n",
+		`test_seconds_bucket{route="a",le="+Inf"} 2` + "\n",
+		`test_seconds_sum{route="a"} 3.02` + "\n",
+		`test_seconds_count{route="a"} 2` + "\n",
+	} {
+		if !strings.Contains(exposition, expected) {
+			t.Errorf("expected metric not found\nexpected: %v\nreceived: %v", expected, exposition)
+		}
+	}
+}
+
+func TestBackendErrorType(t *testing.T) {
+	var expectations = map[string]error{
+		"circuit_open": &circuitOpenError{backend: &backend{}},
+		"timeout":      &perTryTimeoutError{timeout: time.Second},
+		"canceled":     fmt.Errorf("request failed: %w", context.Canceled),
+		"connection":   fmt.Errorf("connection refused"),
+	}
+	for expected, err := range expectations {
+		if received := backendErrorType(err); received != expected {
+			t.Errorf("unexpected error type\nexpected: %v\nreceived: %v", expected, received)
+		}
+	}
+}
+
+func TestAdminHandlerServesMetrics(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	httpmock.RegisterResponder("POST", "http://endpoint.one/route1", func(request *http.Request) (*http.Response, error) {
+		ioutil.ReadAll(request.Body)
+		return httpmock.NewStringResponse(http.StatusCreated, "created"), nil
+	})
+	config := buildConfiguration()
+	config.Routes[0].Name = "items"
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	defer h.Close()
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/route1", strings.NewReader("new item")))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/other", nil))
+	h.Reload(config)
+	invalid := buildConfiguration()
+	invalid.DefaultRoute = "http://invalid%123.hostname"
+	h.Reload(invalid)
+
+	recorder := httptest.NewRecorder()
+	h.AdminHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type\nexpected: %v\nreceived: %v", "text/plain; version=0.0.4", contentType)
+	}
+	exposition := recorder.Body.String()
+	for _, expected := range []string{
+		`moxie_requests_total{route="items",backend="http://endpoint.one",code="2xx"} 1`,
+		`moxie_requests_total{route="default",backend="http://default.endpoint",code="5xx"} 1`,
+		`moxie_request_duration_seconds_count{route="items"} 1`,
+		`moxie_upstream_duration_seconds_count{route="items",backend="http://endpoint.one"} 1`,
+		`moxie_requests_in_flight 0`,
+		`moxie_request_bytes_total{route="items"} 8`,
+		`moxie_response_bytes_total{route="items"} 7`,
+		`moxie_backend_errors_total{route="default",backend="http://default.endpoint",type="connection"} 1`,
+		`moxie_config_reloads_total{result="success"} 1`,
+		`moxie_config_reloads_total{result="failure"} 1`,
+	} {
+		if !strings.Contains(exposition, expected+"\n") {
+			t.Errorf("expected metric not found\nexpected: %v\nreceived: %v", expected, exposition)
+		}
+	}
+}
+
+// abortingWriter aborts the request, as net/http handlers do with a panic,
+// when the response body is written.
+type abortingWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (writer abortingWriter) Write([]byte) (int, error) {
+	panic(http.ErrAbortHandler)
+}
+
+func TestProxyCountsAbortedRequestsOutOfFlight(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	httpmock.RegisterResponder("GET", "http://endpoint.one/route1", httpmock.NewStringResponder(http.StatusOK, "body"))
+	h, err := New(buildConfiguration())
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	defer h.Close()
+
+	func() {
+		defer func() {
+			if recovered := recover(); recovered != http.ErrAbortHandler {
+				t.Errorf("expected request to be aborted\nexpected: %v\nreceived: %v", http.ErrAbortHandler, recovered)
+			}
+		}()
+		h.ServeHTTP(abortingWriter{httptest.NewRecorder()}, httptest.NewRequest("GET", "/route1", nil))
+	}()
+
+	recorder := httptest.NewRecorder()
+	h.AdminHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(recorder.Body.String(), "moxie_requests_in_flight 0\n") {
+		t.Errorf("expected metric not found\nexpected: %v\nreceived: %v", "moxie_requests_in_flight 0", recorder.Body.String())
+	}
+}
@@ -0,0 +1,186 @@
+package proxyhandler
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OutlierDetectionConfiguration enables passive health checking of the
+// endpoints of a RouteRule from the responses to proxied requests. A request
+// fails when the endpoint cannot be reached, responds with a 5xx status or,
+// when MaxLatency is set, takes longer than MaxLatency to respond. An endpoint
+// is ejected from the route after ConsecutiveFailures failed requests in a
+// row, or when FailureRate of at least MinRequests requests within Interval
+// have failed. An ejected endpoint is readmitted after BaseEjectionTime, which
+// doubles each time the endpoint is ejected again, up to MaxEjectionTime.
+type OutlierDetectionConfiguration struct {
+	ConsecutiveFailures int           `yaml:"consecutive_failures"`
+	FailureRate         float64       `yaml:"failure_rate"`
+	MinRequests         int           `yaml:"min_requests"`
+	Interval            time.Duration `yaml:"interval"`
+	MaxLatency          time.Duration `yaml:"max_latency"`
+	BaseEjectionTime    time.Duration `yaml:"base_ejection_time"`
+	MaxEjectionTime     time.Duration `yaml:"max_ejection_time"`
+}
+
+// outlierSettings is a resolved OutlierDetectionConfiguration.
+type outlierSettings struct {
+	ConsecutiveFailures int
+	FailureRate         float64
+	MinRequests         int
+	Interval            time.Duration
+	MaxLatency          time.Duration
+	BaseEjectionTime    time.Duration
+	MaxEjectionTime     time.Duration
+}
+
+var defaultOutlierSettings = outlierSettings{
+	ConsecutiveFailures: 5,
+	MinRequests:         10,
+	Interval:            10 * time.Second,
+	BaseEjectionTime:    30 * time.Second,
+	MaxEjectionTime:     5 * time.Minute,
+}
+
+// validate returns the settings of the outlier detection, or nil when it is
+// not enabled.
+func (detection *OutlierDetectionConfiguration) validate() (*outlierSettings, error) {
+	if detection == nil {
+		return nil, nil
+	}
+	if detection.ConsecutiveFailures < 0 {
+		return nil, fmt.Errorf("consecutive failures is negative")
+	}
+	if detection.FailureRate < 0 || detection.FailureRate > 1 {
+		return nil, fmt.Errorf("failure rate must be between 0 and 1")
+	}
+	if detection.MinRequests < 0 {
+		return nil, fmt.Errorf("min requests is negative")
+	}
+	var durations = map[string]time.Duration{
+		"interval":           detection.Interval,
+		"max latency":        detection.MaxLatency,
+		"base ejection time": detection.BaseEjectionTime,
+		"max ejection time":  detection.MaxEjectionTime,
+	}
+	for name, duration := range durations {
+		if duration < 0 {
+			return nil, fmt.Errorf("%s is negative", name)
+		}
+	}
+
+	settings := defaultOutlierSettings
+	if detection.ConsecutiveFailures > 0 {
+		settings.ConsecutiveFailures = detection.ConsecutiveFailures
+	}
+	settings.FailureRate = detection.FailureRate
+	if detection.MinRequests > 0 {
+		settings.MinRequests = detection.MinRequests
+	}
+	if detection.Interval > 0 {
+		settings.Interval = detection.Interval
+	}
+	settings.MaxLatency = detection.MaxLatency
+	if detection.BaseEjectionTime > 0 {
+		settings.BaseEjectionTime = detection.BaseEjectionTime
+	}
+	if detection.MaxEjectionTime > 0 {
+		settings.MaxEjectionTime = detection.MaxEjectionTime
+	}
+	if settings.MaxEjectionTime < settings.BaseEjectionTime {
+		return nil, fmt.Errorf("max ejection time is less than base ejection time")
+	}
+	return &settings, nil
+}
+
+// failed reports whether a request which took latency to return response or
+// err counts as a failure of the backend.
+func (settings *outlierSettings) failed(err error, response *http.Response, latency time.Duration) bool {
+	if err != nil {
+		return true
+	}
+	if response.StatusCode >= 500 {
+		return true
+	}
+	return settings.MaxLatency > 0 && latency > settings.MaxLatency
+}
+
+// outlierState records the recent requests to a backend. ejectedUntil is
+// read without holding mutex so that choosing a backend is not serialized.
+type outlierState struct {
+	ejectedUntil int64
+	mutex        sync.Mutex
+	consecutive  int
+	windowStart  time.Time
+	requests     int
+	failures     int
+	ejections    int
+}
+
+// ejected reports whether the backend is ejected at now.
+func (state *outlierState) ejected(now time.Time) bool {
+	return now.UnixNano() < atomic.LoadInt64(&state.ejectedUntil)
+}
+
+// observe records the outcome of a request to the backend at target.
+func (state *outlierState) observe(settings *outlierSettings, target string, err error, response *http.Response, latency time.Duration) {
+	if settings == nil {
+		return
+	}
+	state.record(settings, target, settings.failed(err, response, latency), time.Now())
+}
+
+func (state *outlierState) record(settings *outlierSettings, target string, failed bool, now time.Time) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	// Requests which were in progress when the backend was ejected do not
+	// count towards its next ejection.
+	if state.ejected(now) {
+		return
+	}
+	if now.Sub(state.windowStart) >= settings.Interval {
+		state.windowStart = now
+		state.requests, state.failures = 0, 0
+	}
+	state.requests++
+	if failed {
+		state.failures++
+		state.consecutive++
+	} else {
+		state.consecutive = 0
+	}
+
+	var reason string
+	switch {
+	case state.consecutive >= settings.ConsecutiveFailures:
+		reason = fmt.Sprintf("%d consecutive failures", state.consecutive)
+	case settings.FailureRate > 0 && state.requests >= settings.MinRequests &&
+		float64(state.failures)/float64(state.requests) >= settings.FailureRate:
+		reason = fmt.Sprintf("%d of %d requests failed", state.failures, state.requests)
+	default:
+		return
+	}
+
+	// The ejection time only keeps growing while the backend keeps failing
+	// soon after it is readmitted.
+	readmitted := time.Unix(0, atomic.LoadInt64(&state.ejectedUntil))
+	if now.Sub(readmitted) > settings.MaxEjectionTime {
+		state.ejections = 0
+	}
+	duration := settings.BaseEjectionTime
+	for ejection := 0; ejection < state.ejections && duration < settings.MaxEjectionTime; ejection++ {
+		duration *= 2
+	}
+	if duration > settings.MaxEjectionTime {
+		duration = settings.MaxEjectionTime
+	}
+	state.ejections++
+	state.consecutive = 0
+	state.windowStart = time.Time{}
+	atomic.StoreInt64(&state.ejectedUntil, now.Add(duration).UnixNano())
+	log.Printf("outlier: ejecting backend %s for %s after %s", target, duration, reason)
+}
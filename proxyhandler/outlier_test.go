@@ -0,0 +1,116 @@
+package proxyhandler
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestOutlierDetectionValidateRejectsInvalidConfiguration(t *testing.T) {
+	expectations := map[string]OutlierDetectionConfiguration{
+		"consecutive failures is negative":                  {ConsecutiveFailures: -1},
+		"failure rate must be between 0 and 1":              {FailureRate: 1.5},
+		"min requests is negative":                          {MinRequests: -1},
+		"max latency is negative":                           {MaxLatency: -time.Second},
+		"max ejection time is less than base ejection time": {BaseEjectionTime: time.Hour, MaxEjectionTime: time.Minute},
+	}
+	for expectedError, detection := range expectations {
+		_, err := detection.validate()
+		if err == nil || err.Error() != expectedError {
+			t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+		}
+	}
+}
+
+func TestOutlierSettingsCountFailures(t *testing.T) {
+	settings := &outlierSettings{MaxLatency: time.Second}
+	expectations := []struct {
+		err      error
+		status   int
+		latency  time.Duration
+		expected bool
+	}{
+		{nil, 200, time.Millisecond, false},
+		{nil, 404, time.Millisecond, false},
+		{nil, 503, time.Millisecond, true},
+		{nil, 200, 2 * time.Second, true},
+		{fmt.Errorf("connection refused"), 0, time.Millisecond, true},
+	}
+	for _, expectation := range expectations {
+		var response *http.Response
+		if expectation.err == nil {
+			response = &http.Response{StatusCode: expectation.status}
+		}
+		if failed := settings.failed(expectation.err, response, expectation.latency); failed != expectation.expected {
+			t.Errorf("unexpected failure for %v\nexpected: %v\nreceived: %v", expectation, expectation.expected, failed)
+		}
+	}
+}
+
+func TestOutlierStateEjectsAfterConsecutiveFailures(t *testing.T) {
+	settings, _ := (&OutlierDetectionConfiguration{ConsecutiveFailures: 3}).validate()
+	state := &outlierState{}
+	now := time.Now()
+	state.record(settings, "http://a", true, now)
+	state.record(settings, "http://a", true, now)
+	state.record(settings, "http://a", false, now)
+	state.record(settings, "http://a", true, now)
+	state.record(settings, "http://a", true, now)
+	if state.ejected(now) {
+		t.Fatal("expected backend to be admitted after interrupted failures")
+	}
+	state.record(settings, "http://a", true, now)
+	if !state.ejected(now) {
+		t.Fatal("expected backend to be ejected")
+	}
+	if state.ejected(now.Add(settings.BaseEjectionTime)) {
+		t.Error("expected backend to be readmitted after the base ejection time")
+	}
+}
+
+func TestOutlierStateEjectsOnFailureRate(t *testing.T) {
+	settings, _ := (&OutlierDetectionConfiguration{FailureRate: 0.5, MinRequests: 4, Interval: time.Minute}).validate()
+	state := &outlierState{}
+	now := time.Now()
+	for _, failed := range []bool{true, false, true} {
+		state.record(settings, "http://a", failed, now)
+	}
+	if state.ejected(now) {
+		t.Fatal("expected backend to be admitted below the minimum requests")
+	}
+	state.record(settings, "http://a", false, now.Add(time.Minute))
+	if state.ejected(now.Add(time.Minute)) {
+		t.Fatal("expected failures of a previous interval to be forgotten")
+	}
+	for _, failed := range []bool{true, false, true} {
+		state.record(settings, "http://a", failed, now.Add(time.Minute))
+	}
+	if !state.ejected(now.Add(time.Minute)) {
+		t.Error("expected backend to be ejected")
+	}
+}
+
+func TestOutlierStateBacksOffExponentially(t *testing.T) {
+	settings, _ := (&OutlierDetectionConfiguration{
+		ConsecutiveFailures: 1,
+		BaseEjectionTime:    time.Second,
+		MaxEjectionTime:     5 * time.Second,
+	}).validate()
+	state := &outlierState{}
+	now := time.Now()
+	for _, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		state.record(settings, "http://a", true, now)
+		readmitted := time.Unix(0, state.ejectedUntil)
+		if duration := readmitted.Sub(now); duration != expected {
+			t.Errorf("unexpected ejection time\nexpected: %v\nreceived: %v", expected, duration)
+		}
+		now = readmitted
+	}
+
+	now = now.Add(settings.MaxEjectionTime + time.Second)
+	state.record(settings, "http://a", true, now)
+	if duration := time.Unix(0, state.ejectedUntil).Sub(now); duration != time.Second {
+		t.Errorf("expected ejection time to reset\nexpected: %v\nreceived: %v", time.Second, duration)
+	}
+}
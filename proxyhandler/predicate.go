@@ -0,0 +1,192 @@
+package proxyhandler
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ValueMatch matches a named value of a request, such as a header, query
+// parameter or cookie. When Value is set the request must carry it exactly,
+// when Pattern is set one of the values must match the regular expression,
+// and otherwise the value only needs to be present.
+type ValueMatch struct {
+	Name    string `yaml:"name"`
+	Value   string `yaml:"value"`
+	Pattern string `yaml:"pattern"`
+}
+
+type valueMatcher struct {
+	ValueMatch
+	pattern *regexp.Regexp
+}
+
+func (match ValueMatch) validate() (*valueMatcher, error) {
+	if len(match.Name) == 0 {
+		return nil, fmt.Errorf("name is empty")
+	}
+	if len(match.Value) > 0 && len(match.Pattern) > 0 {
+		return nil, fmt.Errorf("only one of value or pattern may be used for %s", match.Name)
+	}
+	matcher := &valueMatcher{ValueMatch: match}
+	if len(match.Pattern) > 0 {
+		pattern, err := regexp.Compile(match.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern for %s: %s", match.Name, err.Error())
+		}
+		matcher.pattern = pattern
+	}
+	return matcher, nil
+}
+
+func (matcher *valueMatcher) matches(values []string) bool {
+	for _, value := range values {
+		switch {
+		case matcher.pattern != nil:
+			if matcher.pattern.MatchString(value) {
+				return true
+			}
+		case len(matcher.Value) > 0:
+			if value == matcher.Value {
+				return true
+			}
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// requestPredicates are the conditions, beyond its Host and Path, which a
+// request must satisfy to be directed to a route.
+type requestPredicates struct {
+	methods map[string]struct{}
+	headers []*valueMatcher
+	query   []*valueMatcher
+	cookies []*valueMatcher
+	// clientCertificate matchers are named by a field of the verified
+	// client certificate.
+	clientCertificate []*valueMatcher
+}
+
+func newRequestPredicates(route RouteRule) (*requestPredicates, error) {
+	predicates := &requestPredicates{}
+	for _, method := range route.Methods {
+		if len(method) == 0 {
+			return nil, fmt.Errorf("method is empty")
+		}
+		if predicates.methods == nil {
+			predicates.methods = make(map[string]struct{})
+		}
+		predicates.methods[strings.ToUpper(method)] = struct{}{}
+	}
+	var err error
+	if predicates.headers, err = validateValueMatches(route.Headers); err != nil {
+		return nil, fmt.Errorf("invalid header match: %s", err.Error())
+	}
+	if predicates.query, err = validateValueMatches(route.Query); err != nil {
+		return nil, fmt.Errorf("invalid query match: %s", err.Error())
+	}
+	if predicates.cookies, err = validateValueMatches(route.Cookies); err != nil {
+		return nil, fmt.Errorf("invalid cookie match: %s", err.Error())
+	}
+	if predicates.clientCertificate, err = validateValueMatches(route.ClientCertificate); err != nil {
+		return nil, fmt.Errorf("invalid client certificate match: %s", err.Error())
+	}
+	for _, matcher := range predicates.clientCertificate {
+		if _, ok := clientCertificateFields[matcher.Name]; !ok {
+			return nil, fmt.Errorf("invalid client certificate match: unknown field %s, expected one of %s", matcher.Name, clientCertificateFieldNames())
+		}
+	}
+	return predicates, nil
+}
+
+func validateValueMatches(matches []ValueMatch) ([]*valueMatcher, error) {
+	matchers := make([]*valueMatcher, len(matches))
+	for index, match := range matches {
+		matcher, err := match.validate()
+		if err != nil {
+			return nil, err
+		}
+		matchers[index] = matcher
+	}
+	return matchers, nil
+}
+
+// matches reports whether request satisfies every predicate. A nil
+// requestPredicates matches every request.
+func (predicates *requestPredicates) matches(request *http.Request) bool {
+	if predicates == nil {
+		return true
+	}
+	if predicates.methods != nil {
+		if _, ok := predicates.methods[request.Method]; !ok {
+			return false
+		}
+	}
+	for _, matcher := range predicates.headers {
+		if !matcher.matches(request.Header[http.CanonicalHeaderKey(matcher.Name)]) {
+			return false
+		}
+	}
+	if len(predicates.query) > 0 {
+		query := request.URL.Query()
+		for _, matcher := range predicates.query {
+			if !matcher.matches(query[matcher.Name]) {
+				return false
+			}
+		}
+	}
+	for _, matcher := range predicates.cookies {
+		var values []string
+		for _, cookie := range request.Cookies() {
+			if cookie.Name == matcher.Name {
+				values = append(values, cookie.Value)
+			}
+		}
+		if !matcher.matches(values) {
+			return false
+		}
+	}
+	for _, matcher := range predicates.clientCertificate {
+		if !matcher.matches(clientCertificateValues(request, matcher.Name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// count is the number of predicates, used to prefer more specific routes.
+func (predicates *requestPredicates) count() int {
+	count := len(predicates.headers) + len(predicates.query) + len(predicates.cookies) + len(predicates.clientCertificate)
+	if predicates.methods != nil {
+		count++
+	}
+	return count
+}
+
+// signature describes the predicates such that routes with equal signatures
+// match exactly the same requests.
+func (predicates *requestPredicates) signature() string {
+	var parts []string
+	for method := range predicates.methods {
+		parts = append(parts, "method "+method)
+	}
+	describe := func(kind string, matchers []*valueMatcher) {
+		for _, matcher := range matchers {
+			name := matcher.Name
+			if kind == "header" {
+				name = http.CanonicalHeaderKey(name)
+			}
+			parts = append(parts, fmt.Sprintf("%s %s=%q~%q", kind, name, matcher.Value, matcher.Pattern))
+		}
+	}
+	describe("header", predicates.headers)
+	describe("query", predicates.query)
+	describe("cookie", predicates.cookies)
+	describe("client certificate", predicates.clientCertificate)
+	sort.Strings(parts)
+	return strings.Join(parts, "\n")
+}
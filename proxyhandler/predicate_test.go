@@ -0,0 +1,120 @@
+package proxyhandler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValueMatchValidation(t *testing.T) {
+	var invalidMatches = map[string]ValueMatch{
+		"name is empty": ValueMatch{Value: "true"},
+		"only one of value or pattern may be used": ValueMatch{Name: "X-Canary", Value: "true", Pattern: "t.*"},
+		"invalid pattern for X-Canary":             ValueMatch{Name: "X-Canary", Pattern: "("},
+	}
+	for expectedError, match := range invalidMatches {
+		_, err := match.validate()
+		if err == nil {
+			t.Fatalf("expected %v to be invalid", match)
+		}
+		if !strings.Contains(err.Error(), expectedError) {
+			t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err.Error())
+		}
+	}
+}
+
+func TestRouteValidationReportsInvalidPredicates(t *testing.T) {
+	expectedError := "invalid cookie match: name is empty"
+	route := RouteRule{Path: "/", Endpoint: "http://hostname", Cookies: []ValueMatch{ValueMatch{Value: "x"}}}
+	_, err := route.validate()
+	if err == nil {
+		t.Fatal("expected route to be invalid")
+	}
+	if !strings.Contains(err.Error(), expectedError) {
+		t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err.Error())
+	}
+}
+
+func TestPredicatesMatchRequest(t *testing.T) {
+	route, err := RouteRule{
+		Path:     "/upload",
+		Endpoint: "http://hostname",
+		Methods:  []string{"post", "PUT"},
+		Headers:  []ValueMatch{ValueMatch{Name: "x-canary", Value: "true"}, ValueMatch{Name: "Authorization"}},
+		Query:    []ValueMatch{ValueMatch{Name: "version", Pattern: "^v[0-9]+$"}},
+		Cookies:  []ValueMatch{ValueMatch{Name: "session"}},
+	}.validate()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	buildRequest := func() *http.Request {
+		request := httptest.NewRequest("POST", "/upload?version=v2", nil)
+		request.Header.Set("X-Canary", "true")
+		request.Header.Set("Authorization", "Bearer token")
+		request.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+		return request
+	}
+
+	if !route.Predicates.matches(buildRequest()) {
+		t.Error("expected request to match every predicate")
+	}
+
+	var mismatches = map[string]func(*http.Request){
+		"method":         func(r *http.Request) { r.Method = "GET" },
+		"header value":   func(r *http.Request) { r.Header.Set("X-Canary", "false") },
+		"header missing": func(r *http.Request) { r.Header.Del("Authorization") },
+		"query pattern":  func(r *http.Request) { r.URL.RawQuery = "version=latest" },
+		"cookie missing": func(r *http.Request) { r.Header.Del("Cookie") },
+	}
+	for name, mismatch := range mismatches {
+		request := buildRequest()
+		mismatch(request)
+		if route.Predicates.matches(request) {
+			t.Errorf("expected request with mismatched %s not to match", name)
+		}
+	}
+}
+
+func TestRouterPrefersRoutesWithMorePredicates(t *testing.T) {
+	r := buildRouter(t,
+		RouteRule{Path: "/api", Endpoint: "http://stable"},
+		RouteRule{Path: "/api", Endpoint: "http://canary", Headers: []ValueMatch{ValueMatch{Name: "X-Canary", Value: "true"}}},
+		RouteRule{Path: "/api/upload", Endpoint: "http://upload", Methods: []string{"POST"}},
+	)
+
+	canary := httptest.NewRequest("GET", "/api", nil)
+	canary.Header.Set("X-Canary", "true")
+	var expectations = map[*http.Request]string{
+		httptest.NewRequest("GET", "/api", nil): "http://stable",
+		canary:                                  "http://canary",
+		httptest.NewRequest("POST", "/api/upload", nil): "http://upload",
+		httptest.NewRequest("GET", "/api/upload", nil):  "http://stable",
+	}
+	for request, expectedEndpoint := range expectations {
+		if route := r.route(request); route.Endpoint != expectedEndpoint {
+			t.Errorf("unexpected route for %s %s\nexpected: %v\nreceived: %v", request.Method, request.URL.Path, expectedEndpoint, route.Endpoint)
+		}
+	}
+}
+
+func TestRouterAllowsSamePathWithDifferentPredicates(t *testing.T) {
+	config := buildConfiguration()
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/api", Endpoint: "http://one", Methods: []string{"GET"}},
+		&RouteRule{Path: "/api", Endpoint: "http://two", Methods: []string{"POST"}},
+	}
+	if _, err := config.validate(); err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	}
+
+	expectedError := "is shadowed by an earlier route"
+	config.Routes[1].Methods = []string{"get"}
+	_, err := config.validate()
+	if err == nil {
+		t.Fatal("expected config to be invalid")
+	}
+	if !strings.Contains(err.Error(), expectedError) {
+		t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err.Error())
+	}
+}
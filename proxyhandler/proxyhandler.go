@@ -3,20 +3,36 @@
 package proxyhandler
 
 import (
+	"bytes"
+	"context"
 	"fmt"
-	"github.com/koding/websocketproxy"
 	"io"
 	"log"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // ProxyHandler implements http.Handler and will override portions of the request URI
 // prior to completing the request.
 type ProxyHandler struct {
-	defaultHostURL *url.URL
-	routes         []*validRouteRule
+	// config holds the *validConfiguration currently used to route requests.
+	// Each request loads it once so that a Reload never changes the routes
+	// used by a request which is already in progress.
+	config     atomic.Value
+	transports *transportPool
+	backends   *backendRegistry
+	// protocols are served by the listener for the lifetime of the handler.
+	protocols *http.Protocols
+	metrics   *proxyMetrics
+	// reloadMutex serializes reloads, whether from a signal, a change to the
+	// configuration file or the admin API. Changes made by the admin API hold
+	// it from reading the configuration until they are applied, so that no
+	// reload is lost.
+	reloadMutex sync.Mutex
 }
 
 // New creates a valid ProxyHandler and returns its pointer. It will
@@ -26,99 +42,486 @@ func New(config *Configuration) (*ProxyHandler, error) {
 	if err != nil {
 		return nil, fmt.Errorf("invalid configuration: %s", err.Error())
 	}
-	handler := ProxyHandler{
-		defaultHostURL: validConfig.DefaultRoute,
-		routes:         validConfig.Routes,
+	validConfig.Source, err = cloneConfiguration(config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %s", err.Error())
+	}
+	transports := newTransportPool()
+	handler := ProxyHandler{transports: transports, backends: newBackendRegistry(transports), protocols: validConfig.Protocols, metrics: newProxyMetrics()}
+	handler.applyProtocols(validConfig)
+	if err := openAccessLogFor(validConfig, nil); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %s", err.Error())
 	}
-	handler.announceSetup()
+	openTracerFor(validConfig, nil)
+	handler.backends.bind(validConfig)
+	handler.config.Store(validConfig)
+	log.Println("New proxy created")
+	announceSetup(validConfig)
 	return &handler, nil
 }
 
-func (handler *ProxyHandler) announceSetup() {
-	log.Println("New proxy created")
-	log.Printf("Default proxy backend %s", handler.defaultHostURL.String())
-	for _, route := range handler.routes {
-		log.Printf("\tRoute %s -> %s", route.Path, route.Endpoint)
+// Reload validates config and replaces the routes used by the handler. Requests
+// already being served complete against the previous routes. An invalid config
+// is rejected and the previous routes remain active. Concurrent reloads are
+// applied one at a time.
+func (handler *ProxyHandler) Reload(config *Configuration) error {
+	handler.reloadMutex.Lock()
+	defer handler.reloadMutex.Unlock()
+	return handler.reload(config)
+}
+
+// reloadWith reloads the handler with a copy of the configuration it is
+// serving as modified by change. No other reload may happen in between, and
+// the handler is not reloaded when change returns an error.
+func (handler *ProxyHandler) reloadWith(change func(config *Configuration) error) error {
+	handler.reloadMutex.Lock()
+	defer handler.reloadMutex.Unlock()
+	config, err := cloneConfiguration(handler.configuration().Source)
+	if err != nil {
+		return err
 	}
+	if err := change(config); err != nil {
+		return err
+	}
+	return handler.reload(config)
+}
+
+// reload replaces the configuration of the handler with config. The
+// reloadMutex must be held.
+func (handler *ProxyHandler) reload(config *Configuration) error {
+	validConfig, err := config.validate()
+	if err == nil {
+		validConfig.Source, err = cloneConfiguration(config)
+	}
+	if err != nil {
+		log.Printf("Rejected configuration reload: %s", err.Error())
+		handler.metrics.configReloads.add(1, "failure")
+		return fmt.Errorf("invalid configuration: %s", err.Error())
+	}
+	if validConfig.Protocols.String() != handler.protocols.String() {
+		log.Printf("Listener protocol changes require a restart, still serving %s", handler.protocols.String())
+	}
+	handler.applyProtocols(validConfig)
+	previous := handler.configuration()
+	if err := openAccessLogFor(validConfig, previous); err != nil {
+		log.Printf("Rejected configuration reload: %s", err.Error())
+		handler.metrics.configReloads.add(1, "failure")
+		return fmt.Errorf("invalid configuration: %s", err.Error())
+	}
+	openTracerFor(validConfig, previous)
+	handler.backends.bind(validConfig)
+	handler.config.Store(validConfig)
+	handler.transports.retain(validConfig)
+	if previous.AccessLog != validConfig.AccessLog {
+		previous.AccessLog.close()
+	}
+	if previous.Tracer != validConfig.Tracer {
+		// Exporting the spans left in the previous tracer may take until
+		// the collector times out, which must not hold up other reloads.
+		go previous.Tracer.close()
+	}
+	handler.metrics.configReloads.add(1, "success")
+	log.Println("Proxy configuration reloaded")
+	announceSetup(validConfig)
+	return nil
+}
+
+// applyProtocols makes a config served by the handler offer the protocols of
+// its listener to TLS clients.
+func (handler *ProxyHandler) applyProtocols(config *validConfiguration) {
+	config.Protocols = handler.protocols
+	if config.TLSConfig != nil {
+		config.TLSConfig.NextProtos = nextProtos(handler.protocols)
+	}
+}
+
+// Close stops the health checks of the handler, closes its access log and
+// exports the spans it has recorded. The handler continues to serve requests,
+// treating every backend as healthy.
+func (handler *ProxyHandler) Close() error {
+	handler.backends.close()
+	handler.configuration().AccessLog.close()
+	handler.configuration().Tracer.close()
+	return nil
+}
+
+// openAccessLogFor opens the access log of config, reusing the access log of
+// previous when its settings are unchanged.
+func openAccessLogFor(config, previous *validConfiguration) error {
+	if config.AccessLogSettings == nil {
+		return nil
+	}
+	if previous != nil && previous.AccessLog != nil && previous.AccessLog.settings == *config.AccessLogSettings {
+		config.AccessLog = previous.AccessLog
+		return nil
+	}
+	logger, err := openAccessLog(*config.AccessLogSettings)
+	if err != nil {
+		return fmt.Errorf("invalid access log: %s", err.Error())
+	}
+	config.AccessLog = logger
+	return nil
+}
+
+// openTracerFor starts the tracer of config, reusing the tracer of previous
+// when its settings are unchanged.
+func openTracerFor(config, previous *validConfiguration) {
+	if config.TracingSettings == nil {
+		return
+	}
+	if previous != nil && previous.Tracer.sameSettings(config.TracingSettings) {
+		config.Tracer = previous.Tracer
+		return
+	}
+	config.Tracer = newTracer(*config.TracingSettings)
+}
+
+func (handler *ProxyHandler) configuration() *validConfiguration {
+	return handler.config.Load().(*validConfiguration)
+}
+
+func announceSetup(config *validConfiguration) {
+	log.Printf("Default proxy backend %s", config.DefaultRoute.String())
+	for _, route := range config.Routes {
+		log.Printf("\tRoute %s%s -> %s", route.Host, route.Path, describeBackends(route.Backends))
+	}
+}
+
+func describeBackends(backends []*backend) string {
+	urls := make([]string, len(backends))
+	for index, backend := range backends {
+		urls[index] = backend.URL.String()
+	}
+	return strings.Join(urls, ", ")
+}
+
+// pickBackend chooses the backend of route which serves request, or returns
+// nil when none of its backends are available. Draining backends are only
+// chosen when no other backend is available.
+func pickBackend(route *validRouteRule, request *http.Request) *backend {
+	now := time.Now()
+	picked := route.Balancer.pick(request, func(candidate *backend) bool {
+		return route.available(candidate, now)
+	})
+	if picked != nil {
+		return picked
+	}
+	return route.Balancer.pick(request, func(candidate *backend) bool {
+		return candidate.backendMode() == backendDraining && route.usable(candidate, now)
+	})
 }
 
 func (handler *ProxyHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
-	for _, route := range handler.routes {
-		if strings.HasPrefix(request.URL.Path, route.Path) {
-			switch route.EndpointURL.Scheme {
-			case "ws":
-				handler.handleWebsocketRequest(route.EndpointURL, writer, request)
-			case "http":
-				handler.handleHTTPRequest(route.EndpointURL, writer, request)
-			}
-			return
-		}
+	config := handler.configuration()
+	// The access log of config may have just been closed by a reload, in
+	// which case the configuration which replaced it is used.
+	for !config.AccessLog.acquire() {
+		config = handler.configuration()
+	}
+	defer config.AccessLog.release()
+	stats := &requestStats{Start: time.Now()}
+	recorder := newResponseRecorder(writer, stats)
+	if request.Body != nil && request.Body != http.NoBody {
+		request.Body = &countingReader{ReadCloser: request.Body, count: &stats.requestBytes}
+	}
+	stats.RequestID = assignRequestID(request, config.RequestIDHeader)
+	request.Header.Set(config.RequestIDHeader, stats.RequestID)
+	recorder.Header().Set(config.RequestIDHeader, stats.RequestID)
+	ctx := withRequestStats(request.Context(), stats)
+	serverSpan := config.Tracer.startServerSpan(request)
+	if serverSpan != nil {
+		ctx = withSpan(ctx, serverSpan)
 	}
-	handler.handleHTTPRequest(handler.defaultHostURL, writer, request)
+	request = request.WithContext(ctx)
+	handler.metrics.inFlight.add(1)
+	defer handler.metrics.inFlight.add(-1)
+	handler.serve(config, recorder, request)
+	stats.Status = recorder.status
+	if stats.Status == 0 {
+		stats.Status = http.StatusOK
+	}
+	serverSpan.setAttribute("moxie.route", stats.Route)
+	serverSpan.setAttribute("http.response.status_code", stats.Status)
+	if stats.Status >= 500 {
+		serverSpan.fail(http.StatusText(stats.Status))
+	}
+	serverSpan.finish()
+	stats.Duration = time.Since(stats.Start)
+	config.AccessLog.log(stats, request)
+	handler.metrics.observeRequest(stats)
 }
 
-func buildDownstreamRequestURL(upstreamRequestURL, routeRuleURL *url.URL) *url.URL {
-	return &url.URL{
-		Scheme:     routeRuleURL.Scheme,
-		Host:       routeRuleURL.Host,
-		Path:       upstreamRequestURL.Path,
-		RawPath:    upstreamRequestURL.RawPath,
-		ForceQuery: upstreamRequestURL.ForceQuery,
-		RawQuery:   upstreamRequestURL.RawQuery,
+// serve proxies request to the backend of the route it matches in config.
+func (handler *ProxyHandler) serve(config *validConfiguration, writer http.ResponseWriter, request *http.Request) {
+	route := config.router.route(request)
+	if route == nil {
+		route = config.DefaultRouteRule
+	}
+	stats := requestStatsFrom(request.Context())
+	stats.Route = route.name()
+	backend := pickBackend(route, request)
+	if backend == nil && route != config.DefaultRouteRule && config.FallbackToDefaultRoute {
+		logRequestf(request, "no healthy backend for route %s%s, using default route", route.Host, route.Path)
+		route = config.DefaultRouteRule
+		stats.Route = route.name()
+		backend = pickBackend(route, request)
+	}
+	if backend == nil {
+		writeError(config, writer, request, &proxyError{
+			Status:     http.StatusServiceUnavailable,
+			RetryAfter: route.retryAfter(time.Now()),
+			Err:        fmt.Errorf("no healthy backend for route %s%s", route.Host, route.Path),
+		})
+		return
+	}
+	switch backend.URL.Scheme {
+	case "ws", "wss":
+		handler.handleWebsocketRequest(config, route, backend, writer, request)
+	default:
+		handler.handleHTTPRequest(config, route, backend, writer, request)
 	}
 }
 
-func (handler *ProxyHandler) handleWebsocketRequest(routeEndpointURL *url.URL, upstreamWriter http.ResponseWriter, upstreamRequest *http.Request) {
+func (handler *ProxyHandler) handleWebsocketRequest(config *validConfiguration, route *validRouteRule, backend *backend, upstreamWriter http.ResponseWriter, upstreamRequest *http.Request) {
+	backend.begin()
+	defer backend.end()
+	stats := requestStatsFrom(upstreamRequest.Context())
+	stats.Backend = backend.URL.String()
+	stats.Websocket = true
+	handler.metrics.websockets.add(1, stats.Route)
+	defer handler.metrics.websockets.add(-1, stats.Route)
+	clientSpan := spanFrom(upstreamRequest.Context()).startClientSpan(upstreamRequest.Method)
+	clientSpan.setAttribute("server.address", backend.URL.Host)
+	defer clientSpan.finish()
 	websocketRequestBackend := func(r *http.Request) *url.URL {
-		return buildDownstreamRequestURL(r.URL, routeEndpointURL)
+		return buildDownstreamRequestURL(r.URL, route, backend.URL)
 	}
-	websocketProxy := websocketproxy.WebsocketProxy{
-		Backend:  websocketRequestBackend,
-		Upgrader: websocketproxy.DefaultUpgrader,
+	websocketRequestDirector := func(r *http.Request, header http.Header) {
+		header.Set(config.RequestIDHeader, stats.RequestID)
+		clientSpan.inject(header)
 	}
-	// disable CORS same-origin verification within proxy
-	websocketProxy.Upgrader.CheckOrigin = func(r *http.Request) bool { return true }
-	websocketProxy.ServeHTTP(upstreamWriter, upstreamRequest)
+	dialer, err := handler.transports.websocketDialer(route.TransportSettings)
+	if err != nil {
+		writeError(config, upstreamWriter, upstreamRequest, err)
+		return
+	}
+	proxy := &websocketProxy{
+		Director:       websocketRequestDirector,
+		Backend:        websocketRequestBackend,
+		Dialer:         dialer,
+		ResponseHeader: http.Header{config.RequestIDHeader: {stats.RequestID}},
+	}
+	logRequestf(upstreamRequest, "websocket %s -> %s", upstreamRequest.URL.String(), websocketRequestBackend(upstreamRequest).String())
+	proxy.serve(config, upstreamWriter, upstreamRequest)
 }
 
-func (handler *ProxyHandler) handleHTTPRequest(routeEndpointURL *url.URL, upstreamWriter http.ResponseWriter, upstreamRequest *http.Request) {
-	downstreamRequest, err := buildProxyRequest(upstreamRequest, routeEndpointURL)
-	if err != nil {
-		handleUnexpectedError(err, upstreamWriter)
+func (handler *ProxyHandler) handleHTTPRequest(config *validConfiguration, route *validRouteRule, selected *backend, upstreamWriter http.ResponseWriter, upstreamRequest *http.Request) {
+	if route.Timeout > 0 {
+		ctx, cancel := context.WithTimeout(upstreamRequest.Context(), route.Timeout)
+		defer cancel()
+		upstreamRequest = upstreamRequest.WithContext(ctx)
+	}
+
+	retry := route.Retry
+	var body []byte
+	if retry.allows(upstreamRequest) {
+		var buffered bool
+		var err error
+		body, buffered, err = bufferRequestBody(upstreamRequest, retry.MaxBodySize)
+		if err != nil {
+			writeError(config, upstreamWriter, upstreamRequest, &proxyError{Status: http.StatusBadRequest, Err: err})
+			return
+		}
+		if !buffered {
+			retry = nil
+		}
+	} else {
+		retry = nil
+	}
+
+	tried := []*backend{}
+	for attempt := 1; ; attempt++ {
+		tried = append(tried, selected)
+		downstreamResponse, done, err := handler.attemptHTTPRequest(config, route, selected, upstreamRequest, body)
+		if retry != nil && attempt < retry.Attempts && retry.retryable(err, downstreamResponse) {
+			if next := pickUntriedBackend(route, upstreamRequest, tried); next != nil {
+				if err == nil {
+					err = fmt.Errorf("status %d", downstreamResponse.StatusCode)
+					downstreamResponse.Body.Close()
+				}
+				done()
+				logRequestf(upstreamRequest, "retrying request %s after attempt %d failed: %s", upstreamRequest.URL.String(), attempt, err.Error())
+				if retry.wait(upstreamRequest.Context(), attempt) {
+					selected = next
+					continue
+				}
+				writeError(config, upstreamWriter, upstreamRequest, err)
+				return
+			}
+		}
+		defer done()
+		if err != nil {
+			writeError(config, upstreamWriter, upstreamRequest, err)
+			return
+		}
+		handler.writeHTTPResponse(config, upstreamWriter, upstreamRequest, downstreamResponse)
 		return
 	}
+}
 
-	log.Printf("proxy: request %s -> %s %s", upstreamRequest.URL.String(), downstreamRequest.Method, downstreamRequest.URL.String())
-	downstreamResponse, err := http.DefaultClient.Do(downstreamRequest)
+// attemptHTTPRequest sends upstreamRequest to backend, with body in place of
+// the upstream request body when it is not nil. done must be called once the
+// response is no longer used.
+func (handler *ProxyHandler) attemptHTTPRequest(config *validConfiguration, route *validRouteRule, backend *backend, upstreamRequest *http.Request, body []byte) (downstreamResponse *http.Response, done func(), err error) {
+	backend.begin()
+	clientSpan := spanFrom(upstreamRequest.Context()).startClientSpan(upstreamRequest.Method)
+	if clientSpan != nil {
+		upstreamRequest = upstreamRequest.WithContext(withSpan(upstreamRequest.Context(), clientSpan))
+	}
+	downstreamRequest, err := buildProxyRequest(upstreamRequest, route, backend.URL)
 	if err != nil {
-		handleUnexpectedError(err, upstreamWriter)
-		return
+		backend.end()
+		clientSpan.fail(err.Error())
+		clientSpan.finish()
+		return nil, func() {}, &proxyError{Status: http.StatusInternalServerError, Err: err}
+	}
+	clientSpan.setAttribute("server.address", backend.URL.Host)
+	clientSpan.setAttribute("url.full", downstreamRequest.URL.String())
+	if body != nil {
+		downstreamRequest.ContentLength = int64(len(body))
+		downstreamRequest.Body = io.NopCloser(bytes.NewReader(body))
+		if len(body) == 0 {
+			downstreamRequest.Body = nil
+		}
+	}
+	config.ForwardedHeaders.apply(downstreamRequest.Header, upstreamRequest)
+
+	ctx, cancel := context.WithCancel(downstreamRequest.Context())
+	downstreamRequest = downstreamRequest.WithContext(ctx)
+	done = func() {
+		cancel()
+		backend.end()
+		clientSpan.finish()
+	}
+
+	stats := requestStatsFrom(upstreamRequest.Context())
+	start := time.Now()
+	probe, ok := backend.circuit.acquire(route.CircuitBreaker, start)
+	if !ok {
+		err = &circuitOpenError{backend: backend, retryAfter: backend.circuit.retryAfter(route.CircuitBreaker, start)}
+		handler.metrics.observeBackendError(stats.Route, backend.URL.String(), err)
+		clientSpan.fail(err.Error())
+		return nil, done, err
+	}
+	logRequestf(upstreamRequest, "request %s -> %s %s", upstreamRequest.URL.String(), downstreamRequest.Method, downstreamRequest.URL.String())
+	transport := handler.transports.roundTripper(backend.URL, route.TransportSettings)
+	var timedOut func() bool
+	if route.Retry != nil && route.Retry.PerTryTimeout > 0 {
+		timer := time.AfterFunc(route.Retry.PerTryTimeout, cancel)
+		timedOut = func() bool { return !timer.Stop() }
+	}
+	stats.Backend = backend.URL.String()
+	roundTripStart := time.Now()
+	downstreamResponse, err = transport.RoundTrip(downstreamRequest)
+	stats.UpstreamLatency += time.Since(roundTripStart)
+	if timedOut != nil && timedOut() && err != nil {
+		err = &perTryTimeoutError{timeout: route.Retry.PerTryTimeout}
+	}
+	if err != nil {
+		handler.metrics.observeBackendError(stats.Route, stats.Backend, err)
+		clientSpan.fail(err.Error())
+	} else {
+		clientSpan.setAttribute("http.response.status_code", downstreamResponse.StatusCode)
+		if downstreamResponse.StatusCode >= 500 {
+			clientSpan.fail(http.StatusText(downstreamResponse.StatusCode))
+		}
+	}
+	// A request abandoned by the client says nothing about the health of the
+	// backend, unlike one which ran out of time waiting for it.
+	if upstreamRequest.Context().Err() == context.Canceled {
+		backend.circuit.release(route.CircuitBreaker, probe)
+		return downstreamResponse, done, err
+	}
+	backend.observe(route.OutlierDetection, backend.URL.String(), err, downstreamResponse, time.Since(start))
+	backend.circuit.observe(route.CircuitBreaker, backend.URL.String(), probe, err, downstreamResponse)
+	return downstreamResponse, done, err
+}
+
+// pickUntriedBackend chooses a backend of route for the next attempt of
+// request, preferring those which have not been tried.
+func pickUntriedBackend(route *validRouteRule, request *http.Request, tried []*backend) *backend {
+	now := time.Now()
+	untried := route.Balancer.pick(request, func(candidate *backend) bool {
+		for _, previous := range tried {
+			if candidate == previous {
+				return false
+			}
+		}
+		return route.available(candidate, now)
+	})
+	if untried != nil {
+		return untried
 	}
+	return pickBackend(route, request)
+}
 
+func (handler *ProxyHandler) writeHTTPResponse(config *validConfiguration, upstreamWriter http.ResponseWriter, upstreamRequest *http.Request, downstreamResponse *http.Response) {
 	defer downstreamResponse.Body.Close()
+	removeHopHeaders(downstreamResponse.Header)
+	// The request ID was set on the response before it was proxied, and must
+	// not be repeated when the backend echoes it.
+	downstreamResponse.Header.Del(config.RequestIDHeader)
 	copyHeaders(upstreamWriter.Header(), downstreamResponse.Header)
+	announceTrailers(upstreamWriter.Header(), downstreamResponse)
+	announced := len(downstreamResponse.Trailer)
 	upstreamWriter.WriteHeader(downstreamResponse.StatusCode)
-	io.Copy(upstreamWriter, downstreamResponse.Body)
+	err := copyResponseBody(upstreamWriter, downstreamResponse.Body, flushIntervalFor(downstreamResponse, config.FlushInterval))
+	if err != nil {
+		if upstreamRequest.Context().Err() == context.Canceled {
+			logRequestf(upstreamRequest, "request %s cancelled by client while copying response body", upstreamRequest.URL.String())
+			return
+		}
+		logRequestf(upstreamRequest, "error copying response body: %s", err.Error())
+		return
+	}
+	copyTrailers(upstreamWriter.Header(), downstreamResponse, announced)
 }
 
-func buildProxyRequest(upstreamRequest *http.Request, routeOverrideURL *url.URL) (*http.Request, error) {
-	proxiedRequestURL := buildDownstreamRequestURL(upstreamRequest.URL, routeOverrideURL)
+func buildProxyRequest(upstreamRequest *http.Request, route *validRouteRule, endpointURL *url.URL) (*http.Request, error) {
+	proxiedRequestURL := buildDownstreamRequestURL(upstreamRequest.URL, route, endpointURL)
 	// Unsure how this might return an error as parts for proxiedRequestURL should be valid.
-	proxyRequest, err := http.NewRequest(upstreamRequest.Method, proxiedRequestURL.String(), upstreamRequest.Body)
+	proxyRequest, err := http.NewRequestWithContext(upstreamRequest.Context(), upstreamRequest.Method, proxiedRequestURL.String(), upstreamRequest.Body)
 	if err != nil {
 		return nil, err
 	}
+	proxyRequest.ContentLength = upstreamRequest.ContentLength
+	if upstreamRequest.ContentLength == 0 {
+		proxyRequest.Body = nil
+	}
+	// Trailers of the client request are filled in once its body has been
+	// read, which is before the transport sends them.
+	proxyRequest.Trailer = upstreamRequest.Trailer
 	copyHeaders(proxyRequest.Header, upstreamRequest.Header)
+	removeHopHeaders(proxyRequest.Header)
+	spanFrom(upstreamRequest.Context()).inject(proxyRequest.Header)
 	return proxyRequest, nil
 }
 
-func handleUnexpectedError(err error, writer http.ResponseWriter) {
-	// No test coverage here, beware regressions within
-	log.Printf("proxy: http request error: %s", err.Error())
-	header := writer.Header()
-	header.Add("X-Error", fmt.Sprintf("unexpected error encountered: %s", err.Error()))
-	writer.WriteHeader(500)
-	writer.Write([]byte("error: " + err.Error()))
+// statusClientClosedRequest is recorded for requests abandoned by the client
+// before a response could be sent.
+const statusClientClosedRequest = 499
+
+// writeError logs err and responds to upstreamRequest with the error page for
+// its status. Requests cancelled by the client are only logged.
+func writeError(config *validConfiguration, writer http.ResponseWriter, upstreamRequest *http.Request, err error) {
+	if upstreamRequest.Context().Err() == context.Canceled {
+		logRequestf(upstreamRequest, "request %s cancelled by client: %s", upstreamRequest.URL.String(), err.Error())
+		writer.WriteHeader(statusClientClosedRequest)
+		return
+	}
+	classified := classifyError(err)
+	logRequestf(upstreamRequest, "request %s failed with status %d: %s", upstreamRequest.URL.String(), classified.Status, err.Error())
+	config.ErrorPages.write(writer, upstreamRequest, classified)
 }
 
 func copyHeaders(destination, source http.Header) {
@@ -2,27 +2,35 @@ package proxyhandler
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"github.com/jarcoal/httpmock"
 	"io/ioutil"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
 	"reflect"
+	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func beforeTest() {
 	httpmock.Activate()
+	newTransport = func(transportSettings) http.RoundTripper { return httpmock.DefaultTransport }
 	log.SetOutput(ioutil.Discard)
 }
 
 func afterTest() {
 	log.SetOutput(os.Stderr)
+	newTransport = buildTransport
 	httpmock.DeactivateAndReset()
 }
 
@@ -162,12 +170,15 @@ func TestResponseHeaderTransfer(t *testing.T) {
 		"Content-Range":  []string{"bytes 0-5/1862"},
 	}
 	mockResponder := httpmock.ResponderFromResponse(&http.Response{
-		Header: expectedHeader,
-		Body:   httpmock.NewRespBodyFromString(""),
+		// httptest.ResponseRecorder panics on the zero value of StatusCode.
+		StatusCode: 200,
+		Header:     expectedHeader,
+		Body:       httpmock.NewRespBodyFromString(""),
 	})
 	httpmock.RegisterResponder("GET", "http://defaulthost/", mockResponder)
 	recorder := httptest.NewRecorder()
 	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Request-Id", "header-transfer")
 
 	config := buildConfiguration()
 	config.DefaultRoute = "http://defaulthost"
@@ -177,6 +188,7 @@ func TestResponseHeaderTransfer(t *testing.T) {
 	}
 	h.ServeHTTP(recorder, req)
 
+	expectedHeader.Set("X-Request-Id", "header-transfer")
 	if !reflect.DeepEqual(recorder.Header(), expectedHeader) {
 		t.Fatalf("Unexpected headers\n\tExpected: %v\n\tActual: %v", expectedHeader, recorder.Header())
 	}
@@ -301,3 +313,654 @@ func BenchmarkRouteHandling(b *testing.B) {
 	}
 	fmt.Println(string(result))
 }
+
+func TestReloadReplacesRoutes(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	requestedHosts := []string{}
+	httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+		requestedHosts = append(requestedHosts, r.URL.Host)
+		return httpmock.NewStringResponse(200, ""), nil
+	})
+
+	config := buildConfiguration()
+	config.DefaultRoute = "http://oldhost"
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	config = buildConfiguration()
+	config.DefaultRoute = "http://newhost"
+	if err := h.Reload(config); err != nil {
+		t.Fatalf("unexpected error reloading: %s", err.Error())
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	expectedHosts := []string{"oldhost", "newhost"}
+	if !reflect.DeepEqual(requestedHosts, expectedHosts) {
+		t.Errorf("unexpected hosts requested\nexpected: %v\nreceived: %v", expectedHosts, requestedHosts)
+	}
+}
+
+func TestReloadRejectsInvalidConfiguration(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	success := false
+	httpmock.RegisterResponder("GET", "http://oldhost/", func(r *http.Request) (*http.Response, error) {
+		success = true
+		return httpmock.NewStringResponse(200, ""), nil
+	})
+
+	config := buildConfiguration()
+	config.DefaultRoute = "http://oldhost"
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+
+	expectedError := "invalid configuration"
+	invalidConfig := buildConfiguration()
+	invalidConfig.DefaultRoute = ""
+	err = h.Reload(invalidConfig)
+	if err == nil {
+		t.Fatal("expected invalid configuration to return an error")
+	}
+	if !strings.Contains(err.Error(), expectedError) {
+		t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err.Error())
+	}
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if !success {
+		t.Error("Expected previous configuration to remain active")
+	}
+}
+
+func TestReloadCompletesInflightRequests(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	httpmock.RegisterResponder("GET", "http://oldhost/", func(r *http.Request) (*http.Response, error) {
+		close(started)
+		<-release
+		return httpmock.NewStringResponse(200, "old"), nil
+	})
+	httpmock.RegisterResponder("GET", "http://newhost/", httpmock.NewStringResponder(200, "new"))
+
+	config := buildConfiguration()
+	config.DefaultRoute = "http://oldhost"
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+
+	inflight := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(inflight, httptest.NewRequest("GET", "/", nil))
+		close(done)
+	}()
+	<-started
+
+	config = buildConfiguration()
+	config.DefaultRoute = "http://newhost"
+	if err := h.Reload(config); err != nil {
+		t.Fatalf("unexpected error reloading: %s", err.Error())
+	}
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	close(release)
+	<-done
+
+	if inflight.Body.String() != "old" {
+		t.Errorf("unexpected in-flight response\nexpected: %v\nreceived: %v", "old", inflight.Body.String())
+	}
+	if recorder.Body.String() != "new" {
+		t.Errorf("unexpected response after reload\nexpected: %v\nreceived: %v", "new", recorder.Body.String())
+	}
+}
+
+func TestReloadAppliesConcurrentReloadsInTurn(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	goroutines := runtime.NumGoroutine()
+	h, err := New(buildConfiguration())
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	var wait sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			config := buildConfiguration()
+			config.Tracing = &TracingConfiguration{Endpoint: fmt.Sprintf("http://collector%d.example.com", i)}
+			if err := h.Reload(config); err != nil {
+				t.Errorf("unexpected error reloading: %s", err.Error())
+			}
+		}(i)
+	}
+	wait.Wait()
+	h.Close()
+
+	// Every tracer replaced by a reload must have been closed, stopping its
+	// goroutine.
+	for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > goroutines && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if running := runtime.NumGoroutine(); running > goroutines {
+		t.Errorf("expected replaced tracers to be closed\nexpected: %v\nreceived: %v", goroutines, running)
+	}
+}
+
+func TestReloadWaitsForChangesInProgress(t *testing.T) {
+	h, err := New(buildConfiguration())
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	defer h.Close()
+	reloaded := make(chan error, 1)
+	err = h.reloadWith(func(config *Configuration) error {
+		go func() {
+			reload := buildConfiguration()
+			reload.DefaultRoute = "http://reloaded"
+			reloaded <- h.Reload(reload)
+		}()
+		select {
+		case <-reloaded:
+			t.Fatal("expected reload to wait for the change in progress")
+		case <-time.After(50 * time.Millisecond):
+		}
+		config.DefaultRoute = "http://changed"
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error changing configuration: %s", err.Error())
+	}
+	if err := <-reloaded; err != nil {
+		t.Fatalf("unexpected error reloading: %s", err.Error())
+	}
+	if route := h.configuration().Source.DefaultRoute; route != "http://reloaded" {
+		t.Errorf("expected the reload to be applied after the change\nexpected: %v\nreceived: %v", "http://reloaded", route)
+	}
+}
+
+func TestProxyRoutesByHost(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	requestedHosts := []string{}
+	httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+		requestedHosts = append(requestedHosts, r.URL.Host)
+		return httpmock.NewStringResponse(200, ""), nil
+	})
+
+	config := buildConfiguration()
+	config.DefaultRoute = "http://defaulthost"
+	config.Routes = []*RouteRule{
+		&RouteRule{Host: "api.example.com", Path: "/v1", Endpoint: "http://api"},
+		&RouteRule{Host: "*.example.com", Path: "/v1", Endpoint: "http://www"},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	for _, target := range []string{"http://api.example.com/v1", "http://www.example.com/v1", "http://example.com/v1"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", target, nil))
+	}
+
+	expectedHosts := []string{"api", "www", "defaulthost"}
+	if !reflect.DeepEqual(requestedHosts, expectedHosts) {
+		t.Errorf("unexpected hosts requested\nexpected: %v\nreceived: %v", expectedHosts, requestedHosts)
+	}
+}
+
+func TestProxyBalancesAcrossEndpoints(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	requestedHosts := []string{}
+	httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+		requestedHosts = append(requestedHosts, r.URL.Host)
+		return httpmock.NewStringResponse(200, ""), nil
+	})
+
+	config := buildConfiguration()
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/", Endpoints: []Endpoint{{URL: "http://one"}, {URL: "http://two"}}},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	for i := 0; i < 4; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+
+	expectedHosts := []string{"one", "two", "one", "two"}
+	if !reflect.DeepEqual(requestedHosts, expectedHosts) {
+		t.Errorf("unexpected hosts requested\nexpected: %v\nreceived: %v", expectedHosts, requestedHosts)
+	}
+}
+
+func TestProxyRoutesAroundUnhealthyBackends(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	requestedHosts := []string{}
+	httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+		requestedHosts = append(requestedHosts, r.URL.Host)
+		return httpmock.NewStringResponse(200, ""), nil
+	})
+
+	config := buildConfiguration()
+	config.DefaultRoute = "http://defaulthost"
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/", Endpoints: []Endpoint{{URL: "http://one"}, {URL: "http://two"}}},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	defer h.Close()
+	backends := h.configuration().Routes[0].Backends
+
+	backends[0].setHealthy(false)
+	for i := 0; i < 2; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	expectedHosts := []string{"two", "two"}
+	if !reflect.DeepEqual(requestedHosts, expectedHosts) {
+		t.Errorf("unexpected hosts requested\nexpected: %v\nreceived: %v", expectedHosts, requestedHosts)
+	}
+
+	backends[1].setHealthy(false)
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("unexpected status\nexpected: %v\nreceived: %v", http.StatusServiceUnavailable, recorder.Code)
+	}
+
+	config.FallbackToDefaultRoute = true
+	if err := h.Reload(config); err != nil {
+		t.Fatalf("unable to reload proxyhandler: %s", err.Error())
+	}
+	requestedHosts = []string{}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	expectedHosts = []string{"defaulthost"}
+	if !reflect.DeepEqual(requestedHosts, expectedHosts) {
+		t.Errorf("unexpected hosts requested\nexpected: %v\nreceived: %v", expectedHosts, requestedHosts)
+	}
+
+	h.configuration().DefaultRouteRule.Backends[0].setHealthy(false)
+	requestedHosts = []string{}
+	recorder = httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("unexpected status\nexpected: %v\nreceived: %v", http.StatusServiceUnavailable, recorder.Code)
+	}
+	if len(requestedHosts) != 0 {
+		t.Errorf("unexpected hosts requested\nexpected: %v\nreceived: %v", []string{}, requestedHosts)
+	}
+}
+
+func TestProxyEjectsFailingBackends(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	requestedHosts := []string{}
+	httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+		requestedHosts = append(requestedHosts, r.URL.Host)
+		if r.URL.Host == "one" {
+			return httpmock.NewStringResponse(502, ""), nil
+		}
+		return httpmock.NewStringResponse(200, ""), nil
+	})
+
+	config := buildConfiguration()
+	config.Routes = []*RouteRule{
+		&RouteRule{
+			Path:             "/",
+			Endpoints:        []Endpoint{{URL: "http://one"}, {URL: "http://two"}},
+			OutlierDetection: &OutlierDetectionConfiguration{ConsecutiveFailures: 2},
+		},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	defer h.Close()
+	for i := 0; i < 6; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+
+	expectedHosts := []string{"one", "two", "one", "two", "two", "two"}
+	if !reflect.DeepEqual(requestedHosts, expectedHosts) {
+		t.Errorf("unexpected hosts requested\nexpected: %v\nreceived: %v", expectedHosts, requestedHosts)
+	}
+}
+
+func TestProxyFailsFastWhileCircuitIsOpen(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	requests := 0
+	httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+		requests++
+		return httpmock.NewStringResponse(500, ""), nil
+	})
+
+	config := buildConfiguration()
+	config.Routes = []*RouteRule{
+		&RouteRule{
+			Path:           "/",
+			Endpoint:       "http://one",
+			CircuitBreaker: &CircuitBreakerConfiguration{MinRequests: 2, OpenDuration: 90 * time.Second},
+		},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	defer h.Close()
+	var recorder *httptest.ResponseRecorder
+	for i := 0; i < 4; i++ {
+		recorder = httptest.NewRecorder()
+		h.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	}
+
+	if requests != 2 {
+		t.Errorf("unexpected backend requests\nexpected: %v\nreceived: %v", 2, requests)
+	}
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("unexpected status\nexpected: %v\nreceived: %v", http.StatusServiceUnavailable, recorder.Code)
+	}
+	if retryAfter := recorder.Header().Get("Retry-After"); retryAfter != "90" {
+		t.Errorf("unexpected Retry-After\nexpected: %v\nreceived: %v", "90", retryAfter)
+	}
+}
+
+func TestProxyIgnoresCancelledRequestsInBackendHealth(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	requests := 0
+	httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+		requests++
+		if cancel, ok := r.Context().Value(cancelKey{}).(context.CancelFunc); ok {
+			cancel()
+			return nil, context.Canceled
+		}
+		return httpmock.NewStringResponse(200, ""), nil
+	})
+
+	config := buildConfiguration()
+	config.Routes = []*RouteRule{
+		&RouteRule{
+			Path:             "/",
+			Endpoint:         "http://one",
+			OutlierDetection: &OutlierDetectionConfiguration{ConsecutiveFailures: 2},
+			CircuitBreaker:   &CircuitBreakerConfiguration{MinRequests: 2, OpenDuration: 90 * time.Second},
+		},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	defer h.Close()
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		ctx = context.WithValue(ctx, cancelKey{}, cancel)
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+	}
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+
+	if requests != 4 {
+		t.Errorf("unexpected backend requests\nexpected: %v\nreceived: %v", 4, requests)
+	}
+	if recorder.Code != http.StatusOK {
+		t.Errorf("unexpected status\nexpected: %v\nreceived: %v", http.StatusOK, recorder.Code)
+	}
+}
+
+func TestProxyCountsTimedOutRequestsInBackendHealth(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	var requests int32
+	httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&requests, 1)
+		<-r.Context().Done()
+		return nil, r.Context().Err()
+	})
+
+	config := buildConfiguration()
+	config.Routes = []*RouteRule{
+		&RouteRule{
+			Path:             "/",
+			Endpoint:         "http://one",
+			Timeout:          20 * time.Millisecond,
+			OutlierDetection: &OutlierDetectionConfiguration{ConsecutiveFailures: 2},
+			CircuitBreaker:   &CircuitBreakerConfiguration{MinRequests: 2, OpenDuration: 90 * time.Second},
+		},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	defer h.Close()
+	var recorder *httptest.ResponseRecorder
+	for i := 0; i < 3; i++ {
+		recorder = httptest.NewRecorder()
+		h.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	}
+
+	if requests := atomic.LoadInt32(&requests); requests != 2 {
+		t.Errorf("unexpected backend requests\nexpected: %v\nreceived: %v", 2, requests)
+	}
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("unexpected status\nexpected: %v\nreceived: %v", http.StatusServiceUnavailable, recorder.Code)
+	}
+}
+
+// cancelKey carries the function which cancels a test request in its context,
+// so a responder can simulate the client going away.
+type cancelKey struct{}
+
+func TestProxyRetriesOnAnotherEndpoint(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	requested := []string{}
+	httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+		body := []byte{}
+		if r.Body != nil {
+			body, _ = ioutil.ReadAll(r.Body)
+		}
+		requested = append(requested, r.Method+" "+r.URL.Host+" "+string(body))
+		if r.URL.Host == "one" {
+			return nil, fmt.Errorf("connection reset by peer")
+		}
+		return httpmock.NewStringResponse(200, ""), nil
+	})
+
+	config := buildConfiguration()
+	config.Routes = []*RouteRule{
+		&RouteRule{
+			Path:      "/",
+			Endpoints: []Endpoint{{URL: "http://one"}, {URL: "http://two"}},
+			Retry:     &RetryConfiguration{Backoff: time.Millisecond, MaxBackoff: time.Millisecond},
+		},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	defer h.Close()
+
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	if recorder.Code != 200 {
+		t.Errorf("unexpected status\nexpected: %v\nreceived: %v", 200, recorder.Code)
+	}
+	recorder = httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("POST", "/", strings.NewReader("payload")))
+	if recorder.Code != 502 {
+		t.Errorf("unexpected status\nexpected: %v\nreceived: %v", 502, recorder.Code)
+	}
+
+	config.Routes[0].Retry.Methods = []string{"POST"}
+	if err := h.Reload(config); err != nil {
+		t.Fatalf("unable to reload proxyhandler: %s", err.Error())
+	}
+	recorder = httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("POST", "/", strings.NewReader("payload")))
+	if recorder.Code != 200 {
+		t.Errorf("unexpected status\nexpected: %v\nreceived: %v", 200, recorder.Code)
+	}
+
+	expected := []string{"GET one ", "GET two ", "POST one payload", "POST one payload", "POST two payload"}
+	if !reflect.DeepEqual(requested, expected) {
+		t.Errorf("unexpected requests\nexpected: %v\nreceived: %v", expected, requested)
+	}
+}
+
+func TestProxyRetriesAfterPerTryTimeout(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	var attempts int32
+	httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			<-r.Context().Done()
+			return nil, r.Context().Err()
+		}
+		return httpmock.NewStringResponse(200, "ok"), nil
+	})
+
+	config := buildConfiguration()
+	config.Routes = []*RouteRule{
+		&RouteRule{
+			Path:     "/",
+			Endpoint: "http://one",
+			Retry:    &RetryConfiguration{Attempts: 2, PerTryTimeout: 10 * time.Millisecond, Backoff: time.Millisecond},
+		},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	defer h.Close()
+
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	if recorder.Code != 200 || recorder.Body.String() != "ok" {
+		t.Errorf("unexpected response\nexpected: %v\nreceived: %v %v", "200 ok", recorder.Code, recorder.Body.String())
+	}
+	if attempts := atomic.LoadInt32(&attempts); attempts != 2 {
+		t.Errorf("unexpected attempts\nexpected: %v\nreceived: %v", 2, attempts)
+	}
+}
+
+func TestProxyMapsBackendErrorsToStatus(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	httpmock.RegisterResponder("GET", "http://endpoint.one/route1/refused", httpmock.NewErrorResponder(&net.OpError{Op: "dial", Net: "tcp", Err: fmt.Errorf("connection refused")}))
+	httpmock.RegisterResponder("GET", "http://endpoint.one/route1/slow", httpmock.NewErrorResponder(context.DeadlineExceeded))
+
+	h, err := New(buildConfiguration())
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	defer h.Close()
+	expectations := map[string]int{"/route1/refused": 502, "/route1/slow": 504}
+	for target, expectedStatus := range expectations {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", target, nil)
+		request.Header.Set("Accept", "application/json")
+		h.ServeHTTP(recorder, request)
+		if recorder.Code != expectedStatus {
+			t.Errorf("unexpected status for %s\nexpected: %v\nreceived: %v", target, expectedStatus, recorder.Code)
+		}
+		if recorder.Header().Get("X-Error") != "" || strings.Contains(recorder.Body.String(), "connection refused") {
+			t.Errorf("error detail was exposed for %s: %s", target, recorder.Body.String())
+		}
+		if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "application/json") {
+			t.Errorf("unexpected content type\nexpected: %v\nreceived: %v", "application/json", contentType)
+		}
+	}
+
+	config := buildConfiguration()
+	config.Debug = true
+	if err := h.Reload(config); err != nil {
+		t.Fatalf("unable to reload proxyhandler: %s", err.Error())
+	}
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("GET", "/route1/refused", nil))
+	if !strings.Contains(recorder.Body.String(), "connection refused") {
+		t.Errorf("expected error detail in debug mode\nexpected: %v\nreceived: %v", "connection refused", recorder.Body.String())
+	}
+}
+
+func TestProxyAbortsBackendRequestWhenClientCancels(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	backendCancelled := make(chan struct{})
+	httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+		cancel()
+		<-r.Context().Done()
+		close(backendCancelled)
+		return nil, r.Context().Err()
+	})
+
+	h, err := New(buildConfiguration())
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	defer h.Close()
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("GET", "/route1", nil).WithContext(ctx))
+
+	select {
+	case <-backendCancelled:
+	default:
+		t.Error("expected backend request to be cancelled")
+	}
+	if recorder.Code != statusClientClosedRequest {
+		t.Errorf("unexpected status\nexpected: %v\nreceived: %v", statusClientClosedRequest, recorder.Code)
+	}
+}
+
+func TestProxyEnforcesRouteTimeout(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+		<-r.Context().Done()
+		return nil, r.Context().Err()
+	})
+
+	config := buildConfiguration()
+	config.Timeout = time.Hour
+	config.Routes[0].Timeout = 10 * time.Millisecond
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	defer h.Close()
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("GET", "/route1", nil))
+	if recorder.Code != http.StatusGatewayTimeout {
+		t.Errorf("unexpected status\nexpected: %v\nreceived: %v", http.StatusGatewayTimeout, recorder.Code)
+	}
+}
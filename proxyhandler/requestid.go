@@ -0,0 +1,67 @@
+package proxyhandler
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// defaultRequestIDHeader carries the ID of each request when
+// Configuration.RequestIDHeader is not set.
+const defaultRequestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength limits the length of request IDs accepted from clients.
+const maxRequestIDLength = 128
+
+// validateRequestIDHeader returns the canonical name of the request ID
+// header, or the default when name is empty.
+func validateRequestIDHeader(name string) (string, error) {
+	if len(name) == 0 {
+		return defaultRequestIDHeader, nil
+	}
+	for _, character := range name {
+		if !isTokenCharacter(character) {
+			return "", fmt.Errorf("invalid request id header: %q", name)
+		}
+	}
+	return http.CanonicalHeaderKey(name), nil
+}
+
+// assignRequestID returns the ID of request from header, or a new ID when the
+// request does not carry a usable one.
+func assignRequestID(request *http.Request, header string) string {
+	if id := request.Header.Get(header); validRequestID(id) {
+		return id
+	}
+	return newRequestID()
+}
+
+// validRequestID reports whether id is short and contains only printable
+// characters, so that it may safely be logged and forwarded.
+func validRequestID(id string) bool {
+	if len(id) == 0 || len(id) > maxRequestIDLength {
+		return false
+	}
+	for index := 0; index < len(id); index++ {
+		if id[index] <= ' ' || id[index] >= 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random version 4 UUID.
+func newRequestID() string {
+	var id [16]byte
+	rand.Read(id[:])
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:16])
+}
+
+// logRequestf logs a message about request, prefixed with its ID.
+func logRequestf(request *http.Request, format string, args ...interface{}) {
+	id := requestStatsFrom(request.Context()).RequestID
+	log.Printf("proxy: [%s] "+format, append([]interface{}{dashIfEmpty(id)}, args...)...)
+}
@@ -0,0 +1,128 @@
+package proxyhandler
+
+import (
+	"bytes"
+	"github.com/gorilla/websocket"
+	"github.com/jarcoal/httpmock"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestAssignRequestID(t *testing.T) {
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	var expectations = map[string]bool{
+		"client-id-1":            true,
+		"":                       false,
+		"has space":              false,
+		"line\nbreak":            false,
+		strings.Repeat("a", 129): false,
+		strings.Repeat("a", 128): true,
+	}
+	for incoming, honored := range expectations {
+		request := httptest.NewRequest("GET", "/", nil)
+		request.Header.Set("X-Request-Id", incoming)
+		id := assignRequestID(request, "X-Request-Id")
+		if honored && id != incoming {
+			t.Errorf("expected request id to be honored\nexpected: %v\nreceived: %v", incoming, id)
+		}
+		if !honored && !uuid.MatchString(id) {
+			t.Errorf("expected new request id\nexpected: %v\nreceived: %v", "version 4 uuid", id)
+		}
+	}
+
+	expectedError := `invalid request id header: "X Request"`
+	config := buildConfiguration()
+	config.RequestIDHeader = "X Request"
+	_, err := config.validate()
+	if err == nil || !strings.Contains(err.Error(), expectedError) {
+		t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+	}
+}
+
+func TestRequestIDIsForwardedReturnedAndLogged(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	var forwarded atomic.Value
+	httpmock.RegisterResponder("GET", "http://endpoint.one/route1", func(request *http.Request) (*http.Response, error) {
+		forwarded.Store(request.Header.Get("X-Correlation-Id"))
+		response := httpmock.NewStringResponse(http.StatusOK, "ok")
+		response.Header.Set("X-Correlation-Id", request.Header.Get("X-Correlation-Id"))
+		return response, nil
+	})
+	config := buildConfiguration()
+	config.RequestIDHeader = "x-correlation-id"
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	defer h.Close()
+
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("GET", "/route1", nil))
+	id := recorder.Header().Get("X-Correlation-Id")
+	if len(id) == 0 || forwarded.Load() != id {
+		t.Errorf("expected generated id to be forwarded\nexpected: %v\nreceived: %v", id, forwarded.Load())
+	}
+	if values := recorder.Header()["X-Correlation-Id"]; len(values) != 1 {
+		t.Errorf("expected echoed id not to be repeated\nexpected: %v\nreceived: %v", 1, len(values))
+	}
+	if !strings.Contains(logged.String(), "proxy: ["+id+"] request /route1 -> GET http://endpoint.one/route1") {
+		t.Errorf("expected request id in log\nexpected: %v\nreceived: %v", id, logged.String())
+	}
+
+	request := httptest.NewRequest("GET", "/missing", nil)
+	request.Header.Set("X-Correlation-Id", "from-client")
+	recorder = httptest.NewRecorder()
+	h.ServeHTTP(recorder, request)
+	if id := recorder.Header().Get("X-Correlation-Id"); id != "from-client" {
+		t.Errorf("expected incoming id to be returned with error\nexpected: %v\nreceived: %v", "from-client", id)
+	}
+	if !strings.Contains(logged.String(), "proxy: [from-client] request /missing failed with status 502") {
+		t.Errorf("expected request id in error log\nexpected: %v\nreceived: %v", "from-client", logged.String())
+	}
+}
+
+func TestRequestIDIsForwardedToWebsocketBackendAndClient(t *testing.T) {
+	var forwarded atomic.Value
+	upgrader := websocket.Upgrader{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded.Store(r.Header.Get("X-Request-Id"))
+		connection, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		connection.Close()
+	}))
+	defer backend.Close()
+
+	config := buildConfiguration()
+	config.Routes = []*RouteRule{{Path: "/ws", Endpoint: "ws://" + strings.TrimPrefix(backend.URL, "http://")}}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	defer h.Close()
+	proxy := httptest.NewServer(h)
+	defer proxy.Close()
+
+	header := http.Header{}
+	header.Set("X-Request-Id", "websocket-session")
+	connection, response, err := websocket.DefaultDialer.Dial("ws://"+strings.TrimPrefix(proxy.URL, "http://")+"/ws", header)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	connection.Close()
+	if forwarded.Load() != "websocket-session" {
+		t.Errorf("expected request id to be forwarded\nexpected: %v\nreceived: %v", "websocket-session", forwarded.Load())
+	}
+	if id := response.Header.Get("X-Request-Id"); id != "websocket-session" {
+		t.Errorf("expected request id in handshake response\nexpected: %v\nreceived: %v", "websocket-session", id)
+	}
+}
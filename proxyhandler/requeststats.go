@@ -0,0 +1,145 @@
+package proxyhandler
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// requestStats describe a request as it is proxied. They are collected for
+// every request and recorded in the access log once it completes.
+type requestStats struct {
+	Start     time.Time
+	RequestID string
+	// Route is the name of the route which served the request, and Backend
+	// the URL of the backend of its final attempt.
+	Route   string
+	Backend string
+	// UpstreamLatency is the time spent waiting for backends to respond,
+	// summed over every attempt.
+	UpstreamLatency time.Duration
+	Websocket       bool
+	Status          int
+	Duration        time.Duration
+	// requestBytes and responseBytes are updated atomically as bodies, or
+	// the messages of a websocket session, are copied.
+	requestBytes  int64
+	responseBytes int64
+}
+
+func (stats *requestStats) RequestBytes() int64 {
+	return atomic.LoadInt64(&stats.requestBytes)
+}
+
+func (stats *requestStats) ResponseBytes() int64 {
+	return atomic.LoadInt64(&stats.responseBytes)
+}
+
+type requestStatsKey struct{}
+
+func withRequestStats(ctx context.Context, stats *requestStats) context.Context {
+	return context.WithValue(ctx, requestStatsKey{}, stats)
+}
+
+// requestStatsFrom returns the stats of the request with ctx. Requests which
+// did not pass through ServeHTTP have stats which are discarded.
+func requestStatsFrom(ctx context.Context) *requestStats {
+	if stats, ok := ctx.Value(requestStatsKey{}).(*requestStats); ok {
+		return stats
+	}
+	return &requestStats{}
+}
+
+// countingReader counts the bytes read from a request body.
+type countingReader struct {
+	io.ReadCloser
+	count *int64
+}
+
+func (reader *countingReader) Read(buffer []byte) (int, error) {
+	read, err := reader.ReadCloser.Read(buffer)
+	atomic.AddInt64(reader.count, int64(read))
+	return read, err
+}
+
+// responseRecorder records the status and size of the response written to
+// its http.ResponseWriter. Connections hijacked from it, such as websocket
+// sessions, are counted in both directions.
+type responseRecorder struct {
+	http.ResponseWriter
+	stats  *requestStats
+	status int
+}
+
+func newResponseRecorder(writer http.ResponseWriter, stats *requestStats) *responseRecorder {
+	return &responseRecorder{ResponseWriter: writer, stats: stats}
+}
+
+func (recorder *responseRecorder) WriteHeader(status int) {
+	if recorder.status == 0 && (status >= 200 || status == http.StatusSwitchingProtocols) {
+		recorder.status = status
+	}
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *responseRecorder) Write(data []byte) (int, error) {
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+	written, err := recorder.ResponseWriter.Write(data)
+	atomic.AddInt64(&recorder.stats.responseBytes, int64(written))
+	return written, err
+}
+
+// Flush allows the streaming of responses through the recorder.
+func (recorder *responseRecorder) Flush() {
+	http.NewResponseController(recorder.ResponseWriter).Flush()
+}
+
+// Hijack allows websocket upgrades through the recorder. The upgrade response
+// is written directly to the connection, so a hijacked request is recorded
+// as switching protocols.
+func (recorder *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	connection, readWriter, err := http.NewResponseController(recorder.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	if recorder.status == 0 {
+		recorder.status = http.StatusSwitchingProtocols
+	}
+	counted := &countingConn{Conn: connection, stats: recorder.stats}
+	// Data the client sent before the connection was hijacked stays in the
+	// reader, which otherwise reads through the counting connection.
+	if readWriter.Reader.Buffered() == 0 {
+		readWriter.Reader.Reset(counted)
+	}
+	readWriter.Writer.Reset(counted)
+	return counted, readWriter, nil
+}
+
+func (recorder *responseRecorder) Unwrap() http.ResponseWriter {
+	return recorder.ResponseWriter
+}
+
+// countingConn counts the bytes read from and written to a hijacked
+// connection.
+type countingConn struct {
+	net.Conn
+	stats *requestStats
+}
+
+func (connection *countingConn) Read(buffer []byte) (int, error) {
+	read, err := connection.Conn.Read(buffer)
+	atomic.AddInt64(&connection.stats.requestBytes, int64(read))
+	return read, err
+}
+
+func (connection *countingConn) Write(data []byte) (int, error) {
+	written, err := connection.Conn.Write(data)
+	atomic.AddInt64(&connection.stats.responseBytes, int64(written))
+	return written, err
+}
@@ -0,0 +1,38 @@
+package proxyhandler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResponseRecorderRecordsFinalStatus(t *testing.T) {
+	stats := &requestStats{}
+	recorder := newResponseRecorder(httptest.NewRecorder(), stats)
+	recorder.WriteHeader(http.StatusAccepted)
+	recorder.WriteHeader(http.StatusInternalServerError)
+	recorder.Write([]byte("accepted"))
+	if recorder.status != http.StatusAccepted {
+		t.Errorf("unexpected status\nexpected: %v\nreceived: %v", http.StatusAccepted, recorder.status)
+	}
+	if stats.ResponseBytes() != int64(len("accepted")) {
+		t.Errorf("unexpected response bytes\nexpected: %v\nreceived: %v", len("accepted"), stats.ResponseBytes())
+	}
+
+	recorder = newResponseRecorder(httptest.NewRecorder(), &requestStats{})
+	recorder.Write([]byte("ok"))
+	if recorder.status != http.StatusOK {
+		t.Errorf("unexpected implicit status\nexpected: %v\nreceived: %v", http.StatusOK, recorder.status)
+	}
+}
+
+func TestRequestStatsFromContextWithoutStats(t *testing.T) {
+	request := httptest.NewRequest("GET", "/", nil)
+	if stats := requestStatsFrom(request.Context()); stats == nil {
+		t.Error("expected stats to be returned for a request without stats")
+	}
+	stats := &requestStats{}
+	if requestStatsFrom(withRequestStats(request.Context(), stats)) != stats {
+		t.Error("expected the stats of the request to be returned")
+	}
+}
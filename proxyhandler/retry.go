@@ -0,0 +1,237 @@
+package proxyhandler
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetryConfiguration enables retrying requests of a RouteRule which fail.
+// Attempts is the total number of times a request may be sent, each to a
+// different endpoint of the route where possible. PerTryTimeout limits how
+// long each attempt may wait for a response. Between attempts the proxy waits
+// for a random duration of up to Backoff, doubling for each attempt up to
+// MaxBackoff. RetryOn lists the failures which are retried: "connection_error"
+// for a backend which cannot be reached or fails to respond, "5xx" for any 5xx
+// status, or a particular status code such as "503". Only requests with one of
+// Methods, which defaults to the idempotent methods, are retried, and only
+// when their body is no larger than MaxBodySize as it must be buffered to be
+// sent again.
+type RetryConfiguration struct {
+	Attempts      int           `yaml:"attempts"`
+	PerTryTimeout time.Duration `yaml:"per_try_timeout"`
+	Backoff       time.Duration `yaml:"backoff"`
+	MaxBackoff    time.Duration `yaml:"max_backoff"`
+	RetryOn       []string      `yaml:"retry_on"`
+	Methods       []string      `yaml:"methods"`
+	MaxBodySize   int64         `yaml:"max_body_size"`
+}
+
+// retrySettings is a resolved RetryConfiguration.
+type retrySettings struct {
+	Attempts          int
+	PerTryTimeout     time.Duration
+	Backoff           time.Duration
+	MaxBackoff        time.Duration
+	MaxBodySize       int64
+	onConnectionError bool
+	on5xx             bool
+	onStatuses        map[int]struct{}
+	methods           map[string]struct{}
+}
+
+var defaultRetrySettings = retrySettings{
+	Attempts:    3,
+	Backoff:     25 * time.Millisecond,
+	MaxBackoff:  250 * time.Millisecond,
+	MaxBodySize: 64 * 1024,
+}
+
+var defaultRetryOn = []string{"connection_error", "502", "503", "504"}
+
+var idempotentMethods = []string{"GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE"}
+
+// validate returns the settings of the retries, or nil when retries are not
+// enabled.
+func (retry *RetryConfiguration) validate() (*retrySettings, error) {
+	if retry == nil {
+		return nil, nil
+	}
+	if retry.Attempts < 0 {
+		return nil, fmt.Errorf("attempts is negative")
+	}
+	var durations = map[string]time.Duration{
+		"per try timeout": retry.PerTryTimeout,
+		"backoff":         retry.Backoff,
+		"max backoff":     retry.MaxBackoff,
+	}
+	for name, duration := range durations {
+		if duration < 0 {
+			return nil, fmt.Errorf("%s is negative", name)
+		}
+	}
+	if retry.MaxBodySize < 0 {
+		return nil, fmt.Errorf("max body size is negative")
+	}
+
+	settings := defaultRetrySettings
+	if retry.Attempts > 0 {
+		settings.Attempts = retry.Attempts
+	}
+	settings.PerTryTimeout = retry.PerTryTimeout
+	if retry.Backoff > 0 {
+		settings.Backoff = retry.Backoff
+	}
+	if retry.MaxBackoff > 0 {
+		settings.MaxBackoff = retry.MaxBackoff
+	}
+	if settings.MaxBackoff < settings.Backoff {
+		return nil, fmt.Errorf("max backoff is less than backoff")
+	}
+	if retry.MaxBodySize > 0 {
+		settings.MaxBodySize = retry.MaxBodySize
+	}
+
+	retryOn := retry.RetryOn
+	if len(retryOn) == 0 {
+		retryOn = defaultRetryOn
+	}
+	settings.onStatuses = make(map[int]struct{})
+	for _, condition := range retryOn {
+		switch condition {
+		case "connection_error":
+			settings.onConnectionError = true
+		case "5xx":
+			settings.on5xx = true
+		default:
+			status, err := strconv.Atoi(condition)
+			if err != nil || status < 100 || status > 599 {
+				return nil, fmt.Errorf("invalid retry on: %s", condition)
+			}
+			settings.onStatuses[status] = struct{}{}
+		}
+	}
+
+	methods := retry.Methods
+	if len(methods) == 0 {
+		methods = idempotentMethods
+	}
+	settings.methods = make(map[string]struct{})
+	for _, method := range methods {
+		if len(method) == 0 {
+			return nil, fmt.Errorf("method is empty")
+		}
+		settings.methods[strings.ToUpper(method)] = struct{}{}
+	}
+	return &settings, nil
+}
+
+// allows reports whether request may be retried. A nil retrySettings never
+// retries.
+func (settings *retrySettings) allows(request *http.Request) bool {
+	if settings == nil || settings.Attempts < 2 {
+		return false
+	}
+	_, ok := settings.methods[request.Method]
+	return ok
+}
+
+// retryable reports whether an attempt which returned response or err should
+// be retried.
+func (settings *retrySettings) retryable(err error, response *http.Response) bool {
+	if err != nil {
+		if _, ok := err.(*circuitOpenError); ok {
+			return true
+		}
+		return settings.onConnectionError
+	}
+	if settings.on5xx && response.StatusCode >= 500 {
+		return true
+	}
+	_, ok := settings.onStatuses[response.StatusCode]
+	return ok
+}
+
+// backoff is how long to wait before the attempt following attempt, chosen at
+// random up to an exponentially increasing limit.
+func (settings *retrySettings) backoff(attempt int) time.Duration {
+	limit := settings.Backoff
+	for retry := 1; retry < attempt && limit < settings.MaxBackoff; retry++ {
+		limit *= 2
+	}
+	if limit > settings.MaxBackoff {
+		limit = settings.MaxBackoff
+	}
+	if limit <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(limit) + 1))
+}
+
+// wait pauses for the backoff following attempt, returning false if ctx is
+// done first.
+func (settings *retrySettings) wait(ctx context.Context, attempt int) bool {
+	timer := time.NewTimer(settings.backoff(attempt))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// bufferRequestBody reads the body of request so that it may be sent more
+// than once. When the body is larger than limit the part already read is
+// restored to the request and ok is false.
+func bufferRequestBody(request *http.Request, limit int64) (body []byte, ok bool, err error) {
+	if request.Body == nil || request.Body == http.NoBody {
+		return nil, true, nil
+	}
+	if request.ContentLength > limit {
+		return nil, false, nil
+	}
+	body, err = io.ReadAll(io.LimitReader(request.Body, limit+1))
+	if err != nil {
+		return nil, false, fmt.Errorf("reading request body: %s", err.Error())
+	}
+	if int64(len(body)) > limit {
+		request.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), request.Body), request.Body}
+		return nil, false, nil
+	}
+	return body, true, nil
+}
+
+// perTryTimeoutError is returned by an attempt which did not receive a
+// response within the per try timeout.
+type perTryTimeoutError struct {
+	timeout time.Duration
+}
+
+func (e *perTryTimeoutError) Error() string {
+	return fmt.Sprintf("no response within per try timeout of %s", e.timeout)
+}
+
+func (e *perTryTimeoutError) Timeout() bool {
+	return true
+}
+
+// circuitOpenError is returned by an attempt to use a backend whose circuit
+// is open.
+type circuitOpenError struct {
+	backend    *backend
+	retryAfter time.Duration
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("circuit of backend %s is open", e.backend.URL.String())
+}
@@ -0,0 +1,99 @@
+package proxyhandler
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryValidateRejectsInvalidConfiguration(t *testing.T) {
+	expectations := map[string]RetryConfiguration{
+		"attempts is negative":             {Attempts: -1},
+		"per try timeout is negative":      {PerTryTimeout: -time.Second},
+		"max backoff is less than backoff": {Backoff: time.Second, MaxBackoff: time.Millisecond},
+		"max body size is negative":        {MaxBodySize: -1},
+		"invalid retry on: reset":          {RetryOn: []string{"reset"}},
+		"invalid retry on: 99":             {RetryOn: []string{"99"}},
+		"method is empty":                  {Methods: []string{""}},
+	}
+	for expectedError, retry := range expectations {
+		_, err := retry.validate()
+		if err == nil || err.Error() != expectedError {
+			t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+		}
+	}
+}
+
+func TestRetryAllowsIdempotentMethodsByDefault(t *testing.T) {
+	settings, _ := (&RetryConfiguration{}).validate()
+	expectations := map[string]bool{"GET": true, "PUT": true, "DELETE": true, "POST": false, "PATCH": false}
+	for method, expected := range expectations {
+		if allowed := settings.allows(httptest.NewRequest(method, "/", nil)); allowed != expected {
+			t.Errorf("unexpected retry of %s\nexpected: %v\nreceived: %v", method, expected, allowed)
+		}
+	}
+
+	settings, _ = (&RetryConfiguration{Methods: []string{"post"}}).validate()
+	if !settings.allows(httptest.NewRequest("POST", "/", nil)) {
+		t.Error("expected configured method to be retried")
+	}
+}
+
+func TestRetryRetryableConditions(t *testing.T) {
+	settings, _ := (&RetryConfiguration{RetryOn: []string{"5xx", "429"}}).validate()
+	expectations := []struct {
+		err      error
+		status   int
+		expected bool
+	}{
+		{nil, 200, false},
+		{nil, 429, true},
+		{nil, 500, true},
+		{fmt.Errorf("connection reset"), 0, false},
+		{&circuitOpenError{}, 0, true},
+	}
+	for _, expectation := range expectations {
+		var response *http.Response
+		if expectation.err == nil {
+			response = &http.Response{StatusCode: expectation.status}
+		}
+		if retryable := settings.retryable(expectation.err, response); retryable != expectation.expected {
+			t.Errorf("unexpected retry for %v\nexpected: %v\nreceived: %v", expectation, expectation.expected, retryable)
+		}
+	}
+}
+
+func TestRetryBackoffIsBounded(t *testing.T) {
+	settings, _ := (&RetryConfiguration{Backoff: 10 * time.Millisecond, MaxBackoff: 30 * time.Millisecond}).validate()
+	limits := map[int]time.Duration{1: 10 * time.Millisecond, 2: 20 * time.Millisecond, 3: 30 * time.Millisecond, 10: 30 * time.Millisecond}
+	for attempt, limit := range limits {
+		for i := 0; i < 100; i++ {
+			if backoff := settings.backoff(attempt); backoff < 0 || backoff > limit {
+				t.Fatalf("unexpected backoff after attempt %d\nexpected: <= %v\nreceived: %v", attempt, limit, backoff)
+			}
+		}
+	}
+}
+
+func TestBufferRequestBody(t *testing.T) {
+	request := httptest.NewRequest("POST", "/", strings.NewReader("small"))
+	body, ok, err := bufferRequestBody(request, 5)
+	if err != nil || !ok || string(body) != "small" {
+		t.Errorf("unexpected buffered body\nexpected: %v\nreceived: %v %v %v", "small", string(body), ok, err)
+	}
+
+	request = httptest.NewRequest("POST", "/", ioutil.NopCloser(strings.NewReader("too large")))
+	request.ContentLength = -1
+	body, ok, err = bufferRequestBody(request, 5)
+	if err != nil || ok || body != nil {
+		t.Errorf("expected large body not to be buffered\nexpected: %v\nreceived: %v %v", false, ok, err)
+	}
+	if restored, _ := ioutil.ReadAll(request.Body); !bytes.Equal(restored, []byte("too large")) {
+		t.Errorf("unexpected restored body\nexpected: %v\nreceived: %v", "too large", string(restored))
+	}
+}
@@ -0,0 +1,122 @@
+package proxyhandler
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// PathRewrite replaces each match of the regular expression Pattern in the
+// request path, as escaped in the request URL, with Replacement. Replacement
+// may refer to capture groups in Pattern as $1 or ${name}.
+type PathRewrite struct {
+	Pattern     string `yaml:"pattern"`
+	Replacement string `yaml:"replacement"`
+}
+
+// pathRewriter changes the escaped path of a request matched by a RouteRule
+// before it is sent to the backend, so that escaped characters such as %2F
+// are not decoded. A nil pathRewriter leaves the path unchanged.
+type pathRewriter struct {
+	prefix        string
+	stripPrefix   bool
+	replacePrefix string
+	pattern       *regexp.Regexp
+	replacement   string
+}
+
+func newPathRewriter(route RouteRule) (*pathRewriter, error) {
+	options := 0
+	if route.StripPrefix {
+		options++
+	}
+	if len(route.ReplacePrefix) > 0 {
+		options++
+	}
+	if route.Rewrite != nil {
+		options++
+	}
+	if options == 0 {
+		return nil, nil
+	}
+	if options > 1 {
+		return nil, fmt.Errorf("only one of strip prefix, replace prefix or rewrite may be used")
+	}
+
+	rewriter := &pathRewriter{
+		prefix:        escapePath(strings.TrimSuffix(route.Path, "/")),
+		stripPrefix:   route.StripPrefix,
+		replacePrefix: escapePath(route.ReplacePrefix),
+	}
+	if route.Rewrite != nil {
+		pattern, err := regexp.Compile(route.Rewrite.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rewrite pattern: %s", err.Error())
+		}
+		rewriter.pattern = pattern
+		rewriter.replacement = route.Rewrite.Replacement
+	}
+	return rewriter, nil
+}
+
+func (rewriter *pathRewriter) rewrite(path string) string {
+	if rewriter == nil {
+		return path
+	}
+	switch {
+	case rewriter.pattern != nil:
+		path = rewriter.pattern.ReplaceAllString(path, rewriter.replacement)
+	case rewriter.stripPrefix:
+		path = strings.TrimPrefix(path, rewriter.prefix)
+	default:
+		path = joinURLPath(rewriter.replacePrefix, strings.TrimPrefix(path, rewriter.prefix))
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
+
+// escapePath returns path escaped as it would be in a URL.
+func escapePath(path string) string {
+	return (&url.URL{Path: path}).EscapedPath()
+}
+
+// joinURLPath joins base and path with exactly one slash between them.
+func joinURLPath(base, path string) string {
+	if len(path) == 0 {
+		return base
+	}
+	if len(base) == 0 {
+		return path
+	}
+	return strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(path, "/")
+}
+
+// buildDownstreamRequestURL builds the URL of the request sent to the
+// endpointURL chosen for route. The path of the upstream request is rewritten
+// by the route and appended to any path present in the endpoint.
+func buildDownstreamRequestURL(upstreamRequestURL *url.URL, route *validRouteRule, endpointURL *url.URL) *url.URL {
+	downstreamURL := &url.URL{
+		Scheme:     endpointURL.Scheme,
+		Host:       endpointURL.Host,
+		Path:       upstreamRequestURL.Path,
+		RawPath:    upstreamRequestURL.RawPath,
+		ForceQuery: upstreamRequestURL.ForceQuery,
+		RawQuery:   upstreamRequestURL.RawQuery,
+	}
+	if route.PathRewriter == nil && len(endpointURL.Path) == 0 {
+		return downstreamURL
+	}
+	escapedPath := joinURLPath(endpointURL.EscapedPath(), route.PathRewriter.rewrite(upstreamRequestURL.EscapedPath()))
+	path, err := url.PathUnescape(escapedPath)
+	if err != nil {
+		// The rewrite produced an invalid escape, so the path is sent as
+		// written.
+		path = escapedPath
+	}
+	downstreamURL.Path = path
+	downstreamURL.RawPath = escapedPath
+	return downstreamURL
+}
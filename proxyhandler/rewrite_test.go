@@ -0,0 +1,124 @@
+package proxyhandler
+
+import (
+	"github.com/jarcoal/httpmock"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRewriteChangesDownstreamPath(t *testing.T) {
+	var routes = map[string]RouteRule{
+		"/foo/x":          RouteRule{Path: "/foo", Endpoint: "http://backend"},
+		"/x":              RouteRule{Path: "/foo", Endpoint: "http://backend", StripPrefix: true},
+		"/bar/x":          RouteRule{Path: "/foo", Endpoint: "http://backend", ReplacePrefix: "/bar"},
+		"/api/foo/x":      RouteRule{Path: "/foo", Endpoint: "http://backend/api"},
+		"/api/x":          RouteRule{Path: "/foo", Endpoint: "http://backend/api/", StripPrefix: true},
+		"/v2/x/resources": RouteRule{Path: "/foo", Endpoint: "http://backend", Rewrite: &PathRewrite{Pattern: "^/foo/(.*)$", Replacement: "/v2/$1/resources"}},
+	}
+	upstreamURL, _ := url.Parse("http://moxie/foo/x?query=1")
+	for expectedPath, route := range routes {
+		validRoute, err := route.validate()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		downstreamURL := buildDownstreamRequestURL(upstreamURL, validRoute, validRoute.EndpointURL)
+		if downstreamURL.Path != expectedPath {
+			t.Errorf("unexpected path\nexpected: %v\nreceived: %v", expectedPath, downstreamURL.Path)
+		}
+		if downstreamURL.RawQuery != "query=1" {
+			t.Errorf("unexpected query\nexpected: %v\nreceived: %v", "query=1", downstreamURL.RawQuery)
+		}
+	}
+}
+
+func TestStripPrefixOfEntirePath(t *testing.T) {
+	route := RouteRule{Path: "/foo", Endpoint: "http://backend", StripPrefix: true}
+	validRoute, err := route.validate()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	upstreamURL, _ := url.Parse("http://moxie/foo")
+	if path := buildDownstreamRequestURL(upstreamURL, validRoute, validRoute.EndpointURL).Path; path != "/" {
+		t.Errorf("unexpected path\nexpected: %v\nreceived: %v", "/", path)
+	}
+}
+
+func TestUnchangedPathKeepsEncoding(t *testing.T) {
+	route := RouteRule{Path: "/foo", Endpoint: "http://backend"}
+	validRoute, err := route.validate()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	upstreamURL, _ := url.Parse("http://moxie/foo/a%2Fb")
+	expected := "http://backend/foo/a%2Fb"
+	if actual := buildDownstreamRequestURL(upstreamURL, validRoute, validRoute.EndpointURL).String(); actual != expected {
+		t.Errorf("unexpected url\nexpected: %v\nreceived: %v", expected, actual)
+	}
+}
+
+func TestRewriteKeepsEncodedSlashes(t *testing.T) {
+	var routes = map[string]RouteRule{
+		"http://backend/bar/a%2Fb":          RouteRule{Path: "/foo", Endpoint: "http://backend", ReplacePrefix: "/bar"},
+		"http://backend/api/a%2Fb":          RouteRule{Path: "/foo", Endpoint: "http://backend/api", StripPrefix: true},
+		"http://backend/v2/a%2Fb/resources": RouteRule{Path: "/foo", Endpoint: "http://backend", Rewrite: &PathRewrite{Pattern: "^/foo/(.*)$", Replacement: "/v2/$1/resources"}},
+	}
+	upstreamURL, _ := url.Parse("http://moxie/foo/a%2Fb")
+	for expected, route := range routes {
+		validRoute, err := route.validate()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		if actual := buildDownstreamRequestURL(upstreamURL, validRoute, validRoute.EndpointURL).String(); actual != expected {
+			t.Errorf("unexpected url\nexpected: %v\nreceived: %v", expected, actual)
+		}
+	}
+}
+
+func TestValidateRejectsConflictingRewrites(t *testing.T) {
+	expectedError := "only one of strip prefix, replace prefix or rewrite may be used"
+	route := RouteRule{Path: "/foo", Endpoint: "http://backend", StripPrefix: true, ReplacePrefix: "/bar"}
+	_, err := route.validate()
+	if err == nil {
+		t.Fatal("expected route to be invalid")
+	}
+	if !strings.Contains(err.Error(), expectedError) {
+		t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err.Error())
+	}
+}
+
+func TestValidateRejectsInvalidRewritePattern(t *testing.T) {
+	expectedError := "invalid rewrite pattern"
+	route := RouteRule{Path: "/foo", Endpoint: "http://backend", Rewrite: &PathRewrite{Pattern: "(", Replacement: "/"}}
+	_, err := route.validate()
+	if err == nil {
+		t.Fatal("expected route to be invalid")
+	}
+	if !strings.Contains(err.Error(), expectedError) {
+		t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err.Error())
+	}
+}
+
+func TestDefaultRoutePathIsHonored(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	success := false
+	httpmock.RegisterResponder("GET", "http://defaulthost/base/path", func(r *http.Request) (*http.Response, error) {
+		success = true
+		return httpmock.NewStringResponse(200, ""), nil
+	})
+
+	config := buildConfiguration()
+	config.DefaultRoute = "http://defaulthost/base"
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/path", nil))
+	if !success {
+		t.Error("Expected default route path to prefix the request path")
+	}
+}
@@ -0,0 +1,140 @@
+package proxyhandler
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// router selects the most specific validRouteRule for a request. Route paths
+// are stored in a radix tree keyed by path segment so a route only matches
+// requests whose path begins with every segment of the route path, meaning
+// "/foo" matches "/foo" and "/foo/bar" but not "/foobar". The route with the
+// longest matching path is preferred, regardless of its position in
+// Configuration.Routes.
+type router struct {
+	root *routerNode
+}
+
+// routerNode is a node of the radix tree. segments is the label of the edge
+// from the parent node and routes are those whose path ends at this node,
+// ordered from the most to least specific Host and then by the number of
+// predicates.
+type routerNode struct {
+	segments []string
+	children []*routerNode
+	routes   []*validRouteRule
+}
+
+func newRouter(routes []*validRouteRule) (*router, error) {
+	r := &router{root: &routerNode{}}
+	for index, route := range routes {
+		node := r.root.insert(pathSegments(route.Path))
+		for _, existing := range node.routes {
+			if strings.EqualFold(existing.Host, route.Host) && existing.Predicates.signature() == route.Predicates.signature() {
+				return nil, &routeRuleError{
+					Index: index,
+					Err:   fmt.Errorf("path %s is shadowed by an earlier route with the same host, path and predicates", route.Path),
+				}
+			}
+		}
+		node.routes = append(node.routes, route)
+		sort.SliceStable(node.routes, func(i, j int) bool {
+			first, second := node.routes[i], node.routes[j]
+			if hostSpecificity(first.Host) != hostSpecificity(second.Host) {
+				return hostSpecificity(first.Host) > hostSpecificity(second.Host)
+			}
+			return first.Predicates.count() > second.Predicates.count()
+		})
+	}
+	return r, nil
+}
+
+// route returns the most specific route matching request or nil if none of the
+// routes match.
+func (r *router) route(request *http.Request) *validRouteRule {
+	matched := r.root.lookup(pathSegments(request.URL.Path), nil)
+	for index := len(matched) - 1; index >= 0; index-- {
+		for _, route := range matched[index].routes {
+			if route.matches(request) {
+				return route
+			}
+		}
+	}
+	return nil
+}
+
+// insert returns the node for segments, creating and splitting nodes as
+// required.
+func (node *routerNode) insert(segments []string) *routerNode {
+	if len(segments) == 0 {
+		return node
+	}
+	for _, child := range node.children {
+		common := commonSegments(child.segments, segments)
+		if common == 0 {
+			continue
+		}
+		if common < len(child.segments) {
+			split := &routerNode{
+				segments: child.segments[common:],
+				children: child.children,
+				routes:   child.routes,
+			}
+			child.segments = child.segments[:common]
+			child.children = []*routerNode{split}
+			child.routes = nil
+		}
+		return child.insert(segments[common:])
+	}
+	child := &routerNode{segments: segments}
+	node.children = append(node.children, child)
+	return child
+}
+
+// lookup appends to matched each node with routes along the path of segments,
+// from the least to the most specific.
+func (node *routerNode) lookup(segments []string, matched []*routerNode) []*routerNode {
+	if len(node.routes) > 0 {
+		matched = append(matched, node)
+	}
+	for _, child := range node.children {
+		if len(segments) >= len(child.segments) && commonSegments(child.segments, segments) == len(child.segments) {
+			return child.lookup(segments[len(child.segments):], matched)
+		}
+	}
+	return matched
+}
+
+func commonSegments(a, b []string) int {
+	common := 0
+	for common < len(a) && common < len(b) && a[common] == b[common] {
+		common++
+	}
+	return common
+}
+
+// pathSegments splits path on "/" ignoring empty segments, so that "/foo/"
+// and "/foo" are equivalent.
+func pathSegments(path string) []string {
+	segments := []string{}
+	for _, segment := range strings.Split(path, "/") {
+		if len(segment) > 0 {
+			segments = append(segments, segment)
+		}
+	}
+	return segments
+}
+
+// hostSpecificity ranks host patterns so that exact hosts are preferred over
+// wildcards, longer wildcards over shorter ones and any host pattern over none.
+func hostSpecificity(host string) int {
+	if len(host) == 0 {
+		return 0
+	}
+	if strings.HasPrefix(host, "*.") {
+		return len(host)
+	}
+	return 1 << 16
+}
@@ -0,0 +1,106 @@
+package proxyhandler
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func buildRouter(t *testing.T, routes ...RouteRule) *router {
+	validRoutes := make([]*validRouteRule, len(routes))
+	for index, route := range routes {
+		validRoute, err := route.validate()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		validRoutes[index] = validRoute
+	}
+	r, err := newRouter(validRoutes)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	return r
+}
+
+func assertRoutes(t *testing.T, r *router, expectations map[string]string) {
+	for target, expectedEndpoint := range expectations {
+		route := r.route(httptest.NewRequest("GET", target, nil))
+		actualEndpoint := ""
+		if route != nil {
+			actualEndpoint = route.Endpoint
+		}
+		if actualEndpoint != expectedEndpoint {
+			t.Errorf("unexpected route for %s\nexpected: %v\nreceived: %v", target, expectedEndpoint, actualEndpoint)
+		}
+	}
+}
+
+func TestRouterMatchesWholeSegments(t *testing.T) {
+	r := buildRouter(t, RouteRule{Path: "/foo", Endpoint: "http://foo"})
+	assertRoutes(t, r, map[string]string{
+		"/foo":     "http://foo",
+		"/foo/":    "http://foo",
+		"/foo/bar": "http://foo",
+		"/foobar":  "",
+		"/":        "",
+	})
+}
+
+func TestRouterPrefersLongestPath(t *testing.T) {
+	r := buildRouter(t,
+		RouteRule{Path: "/", Endpoint: "http://root"},
+		RouteRule{Path: "/a", Endpoint: "http://a"},
+		RouteRule{Path: "/a/b/c", Endpoint: "http://abc"},
+		RouteRule{Path: "/a/b/d", Endpoint: "http://abd"},
+		RouteRule{Path: "/a/b/", Endpoint: "http://ab"},
+	)
+	assertRoutes(t, r, map[string]string{
+		"/":        "http://root",
+		"/other":   "http://root",
+		"/a":       "http://a",
+		"/a/x":     "http://a",
+		"/a/b":     "http://ab",
+		"/a/b/c/d": "http://abc",
+		"/a/b/d":   "http://abd",
+		"/a/b/cd":  "http://ab",
+		"/a/bc/d":  "http://a",
+	})
+}
+
+func TestRouterPrefersMostSpecificHost(t *testing.T) {
+	r := buildRouter(t,
+		RouteRule{Path: "/v1", Endpoint: "http://any"},
+		RouteRule{Path: "/v1", Host: "*.example.com", Endpoint: "http://wildcard"},
+		RouteRule{Path: "/v1", Host: "*.api.example.com", Endpoint: "http://apiwildcard"},
+		RouteRule{Path: "/v1", Host: "www.example.com", Endpoint: "http://www"},
+		RouteRule{Path: "/v1/users", Endpoint: "http://users"},
+	)
+	assertRoutes(t, r, map[string]string{
+		"http://www.example.com/v1":       "http://www",
+		"http://eu.api.example.com/v1":    "http://apiwildcard",
+		"http://blog.example.com/v1":      "http://wildcard",
+		"http://other.com/v1":             "http://any",
+		"http://www.example.com/v1/users": "http://users",
+	})
+}
+
+func TestValidationReportsShadowedRoutes(t *testing.T) {
+	expectedError := "invalid RouteRule: path /foo/ is shadowed by an earlier route with the same host, path and predicates"
+	config := buildConfiguration()
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/foo", Endpoint: "http://one"},
+		&RouteRule{Path: "/foo", Host: "example.com", Endpoint: "http://two"},
+		&RouteRule{Path: "/foo/", Endpoint: "http://three"},
+	}
+
+	_, err := config.validate()
+	if err == nil {
+		t.Fatal("expected config to be invalid")
+	}
+	if !strings.Contains(err.Error(), expectedError) {
+		t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err.Error())
+	}
+	if routeErr, ok := err.(*routeRuleError); !ok || routeErr.Index != 2 {
+		t.Errorf("expected error to identify the shadowed route\nreceived: %#v", err)
+	}
+}
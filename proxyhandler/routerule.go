@@ -2,32 +2,182 @@ package proxyhandler
 
 import (
 	"fmt"
+	"net"
+	"net/http"
 	"net/url"
+	"strings"
+	"time"
 )
 
 // RouteRule represents a route which the proxyHandler can use to direct requests to
-// appropriate backend system. Path is the requested path in the URL received by the
-// proxyHandler. Endpoint is the backend host to direct the traffic to.
+// appropriate backend system. Name identifies the route in logs and defaults to
+// its Host and Path. Path is the requested path in the URL received by the
+// proxyHandler. Host optionally restricts the route to requests for a single
+// host, such as "api.example.com", or any subdomain of a wildcard host, such as
+// "*.example.com". Endpoint is the backend host to direct the traffic to. Any path
+// in Endpoint is prepended to the path sent to the backend. Endpoints may be
+// used instead of Endpoint to spread traffic across several backends, which
+// must share a scheme, chosen according to LoadBalancing. HealthCheck
+// optionally enables active health checks which remove failing endpoints from
+// the route, and OutlierDetection ejects endpoints whose requests are failing.
+// CircuitBreaker stops requests being sent to a failing endpoint of an http
+// route until it recovers, and Retry sends failed requests again. Timeout
+// limits how long an http request, including any retries, may wait for its
+// response, overriding Configuration.Timeout. Transport optionally overrides
+// Configuration.Transport for this route.
+//
+// The path sent to the backend may be changed by one of StripPrefix, which
+// removes Path from the start of the request path, ReplacePrefix, which
+// replaces Path with its value, or Rewrite.
+//
+// Methods, Headers, Query and Cookies optionally restrict the route to
+// requests with one of the listed methods and every listed header, query
+// parameter and cookie. ClientCertificate restricts the route to clients
+// which presented a verified certificate matching every listed field, named
+// one of "subject", "common_name", "issuer", "serial", "fingerprint",
+// "dns_san", "email_san", "uri_san" or "ip_san". Routes with more of these
+// predicates are preferred over routes with the same Host and Path and fewer
+// predicates.
 type RouteRule struct {
-	Path     string
-	Endpoint string
+	Name              string                         `yaml:"name"`
+	Path              string                         `yaml:"path"`
+	Host              string                         `yaml:"host"`
+	Endpoint          string                         `yaml:"endpoint"`
+	Endpoints         []Endpoint                     `yaml:"endpoints"`
+	LoadBalancing     LoadBalancingConfiguration     `yaml:"load_balancing"`
+	HealthCheck       *HealthCheckConfiguration      `yaml:"health_check"`
+	OutlierDetection  *OutlierDetectionConfiguration `yaml:"outlier_detection"`
+	CircuitBreaker    *CircuitBreakerConfiguration   `yaml:"circuit_breaker"`
+	Retry             *RetryConfiguration            `yaml:"retry"`
+	Timeout           time.Duration                  `yaml:"timeout"`
+	Transport         *TransportConfiguration        `yaml:"transport"`
+	StripPrefix       bool                           `yaml:"strip_prefix"`
+	ReplacePrefix     string                         `yaml:"replace_prefix"`
+	Rewrite           *PathRewrite                   `yaml:"rewrite"`
+	Methods           []string                       `yaml:"methods"`
+	Headers           []ValueMatch                   `yaml:"headers"`
+	Query             []ValueMatch                   `yaml:"query"`
+	Cookies           []ValueMatch                   `yaml:"cookies"`
+	ClientCertificate []ValueMatch                   `yaml:"client_certificate"`
 }
 
+// validRouteRule is a validated RouteRule. EndpointURL is the URL of the first
+// of its Backends, whose scheme is shared by every backend.
 type validRouteRule struct {
 	RouteRule
-	EndpointURL *url.URL
+	EndpointURL       *url.URL
+	Backends          []*backend
+	Balancer          balancer
+	HealthCheck       *healthCheckSettings
+	OutlierDetection  *outlierSettings
+	CircuitBreaker    *circuitBreakerSettings
+	Retry             *retrySettings
+	TransportSettings transportSettings
+	PathRewriter      *pathRewriter
+	Predicates        *requestPredicates
 }
 
 var validSchemes = map[string]struct{}{
-	"ws":   struct{}{},
-	"http": struct{}{},
+	"ws":    struct{}{},
+	"wss":   struct{}{},
+	"http":  struct{}{},
+	"https": struct{}{},
 }
 
 func (route RouteRule) validate() (*validRouteRule, error) {
 	if len(route.Path) == 0 {
 		return nil, fmt.Errorf("path is empty")
 	}
-	endpointURL, err := url.Parse(route.Endpoint)
+	if err := validateHostPattern(route.Host); err != nil {
+		return nil, err
+	}
+	backends, err := route.validateEndpoints()
+	if err != nil {
+		return nil, err
+	}
+	balancer, err := newBalancer(route.LoadBalancing, backends)
+	if err != nil {
+		return nil, fmt.Errorf("invalid load balancing: %s", err.Error())
+	}
+	healthCheck, err := route.HealthCheck.validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid health check: %s", err.Error())
+	}
+	outlierDetection, err := route.OutlierDetection.validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid outlier detection: %s", err.Error())
+	}
+	circuitBreaker, err := route.CircuitBreaker.validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid circuit breaker: %s", err.Error())
+	}
+	if circuitBreaker != nil && isWebsocketScheme(backends[0].URL.Scheme) {
+		return nil, fmt.Errorf("circuit breaker is not supported for websocket routes")
+	}
+	if route.Timeout < 0 {
+		return nil, fmt.Errorf("timeout is negative")
+	}
+	retry, err := route.Retry.validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid retry: %s", err.Error())
+	}
+	if retry != nil && isWebsocketScheme(backends[0].URL.Scheme) {
+		return nil, fmt.Errorf("retry is not supported for websocket routes")
+	}
+	if err := route.Transport.validate(); err != nil {
+		return nil, fmt.Errorf("invalid transport: %s", err.Error())
+	}
+	pathRewriter, err := newPathRewriter(route)
+	if err != nil {
+		return nil, err
+	}
+	predicates, err := newRequestPredicates(route)
+	if err != nil {
+		return nil, err
+	}
+	validRoute := validRouteRule{
+		RouteRule:         route,
+		EndpointURL:       backends[0].URL,
+		Backends:          backends,
+		Balancer:          balancer,
+		HealthCheck:       healthCheck,
+		OutlierDetection:  outlierDetection,
+		CircuitBreaker:    circuitBreaker,
+		Retry:             retry,
+		TransportSettings: route.Transport.apply(defaultTransportSettings),
+		PathRewriter:      pathRewriter,
+		Predicates:        predicates,
+	}
+	return &validRoute, nil
+}
+
+func (route RouteRule) validateEndpoints() ([]*backend, error) {
+	if len(route.Endpoints) == 0 {
+		endpointURL, err := parseEndpoint(route.Endpoint)
+		if err != nil {
+			return nil, err
+		}
+		return []*backend{newBackend(endpointURL, 1)}, nil
+	}
+	if len(route.Endpoint) > 0 {
+		return nil, fmt.Errorf("only one of endpoint or endpoints may be used")
+	}
+	backends := make([]*backend, len(route.Endpoints))
+	for index, endpoint := range route.Endpoints {
+		backend, err := endpoint.validate()
+		if err != nil {
+			return nil, fmt.Errorf("invalid endpoint %s: %s", endpoint.URL, err.Error())
+		}
+		if index > 0 && backend.URL.Scheme != backends[0].URL.Scheme {
+			return nil, fmt.Errorf("endpoints have different schemes: %s and %s", backends[0].URL.Scheme, backend.URL.Scheme)
+		}
+		backends[index] = backend
+	}
+	return backends, nil
+}
+
+func parseEndpoint(endpoint string) (*url.URL, error) {
+	endpointURL, err := url.Parse(endpoint)
 	if err != nil {
 		return nil, fmt.Errorf("parsing endpoint: %s", err.Error())
 	}
@@ -40,12 +190,77 @@ func (route RouteRule) validate() (*validRouteRule, error) {
 	if _, ok := validSchemes[endpointURL.Scheme]; !ok {
 		return nil, fmt.Errorf("unsupported scheme: %s", endpointURL.Scheme)
 	}
-	validRoute := validRouteRule{
-		RouteRule: RouteRule{
-			Path:     route.Path,
-			Endpoint: route.Endpoint,
-		},
-		EndpointURL: endpointURL,
+	return endpointURL, nil
+}
+
+// isWebsocketScheme reports whether scheme is proxied as a websocket.
+func isWebsocketScheme(scheme string) bool {
+	return scheme == "ws" || scheme == "wss"
+}
+
+func validateHostPattern(host string) error {
+	if len(host) == 0 {
+		return nil
 	}
-	return &validRoute, nil
+	name := strings.TrimPrefix(host, "*.")
+	if len(name) == 0 || strings.ContainsAny(name, "*/:") {
+		return fmt.Errorf("invalid host: %s", host)
+	}
+	return nil
+}
+
+// available reports whether candidate, one of the Backends of the route, may
+// be chosen to serve a request at now. Draining and disabled backends are not
+// available.
+func (route *validRouteRule) available(candidate *backend, now time.Time) bool {
+	return candidate.backendMode() == backendActive && route.usable(candidate, now)
+}
+
+// usable reports whether candidate is able to serve requests, regardless of
+// whether it is draining.
+func (route *validRouteRule) usable(candidate *backend, now time.Time) bool {
+	return candidate.healthy() && !candidate.ejected(now) && candidate.circuit.available(route.CircuitBreaker, now)
+}
+
+// retryAfter is how long until the first of the open circuits of the route
+// will allow requests, or zero when none of the circuits are open.
+func (route *validRouteRule) retryAfter(now time.Time) time.Duration {
+	var retryAfter time.Duration
+	for _, candidate := range route.Backends {
+		if wait := candidate.circuit.retryAfter(route.CircuitBreaker, now); wait > 0 && (retryAfter == 0 || wait < retryAfter) {
+			retryAfter = wait
+		}
+	}
+	return retryAfter
+}
+
+// name identifies the route in logs.
+func (route *validRouteRule) name() string {
+	if len(route.Name) > 0 {
+		return route.Name
+	}
+	return route.Host + route.Path
+}
+
+// matches reports whether request satisfies the Host and predicates of the
+// route. The Path is matched by the router.
+func (route *validRouteRule) matches(request *http.Request) bool {
+	return route.matchesHost(request.Host) && route.Predicates.matches(request)
+}
+
+// matchesHost reports whether host, which may include a port, satisfies the
+// Host of the route. Hosts are compared without regard to case.
+func (route *validRouteRule) matchesHost(host string) bool {
+	if len(route.Host) == 0 {
+		return true
+	}
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	pattern := strings.ToLower(route.Host)
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:]) && len(host) > len(pattern)-1
+	}
+	return host == pattern
 }
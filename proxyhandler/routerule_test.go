@@ -134,3 +134,94 @@ func TestValidateVerifiesEndpoint(t *testing.T) {
 		t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err.Error())
 	}
 }
+
+func TestValidateChecksHostPattern(t *testing.T) {
+	for _, host := range []string{"", "api.example.com", "*.example.com"} {
+		route := RouteRule{Path: "/", Host: host, Endpoint: "http://hostname"}
+		if _, err := route.validate(); err != nil {
+			t.Errorf("expected host %q to be valid: %s", host, err.Error())
+		}
+	}
+
+	expectedError := "invalid host"
+	for _, host := range []string{"*", "api.*.com", "example.com:80", "*."} {
+		route := RouteRule{Path: "/", Host: host, Endpoint: "http://hostname"}
+		_, err := route.validate()
+		if err == nil {
+			t.Fatalf("expected host %q to be invalid", host)
+		}
+		if !strings.Contains(err.Error(), expectedError) {
+			t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err.Error())
+		}
+	}
+}
+
+func TestMatchesHost(t *testing.T) {
+	var expectations = map[string]map[string]bool{
+		"": {"anything.com": true},
+		"api.example.com": {
+			"api.example.com":      true,
+			"API.Example.com:8080": true,
+			"www.example.com":      false,
+			"api.example.com.evil": false,
+		},
+		"*.example.com": {
+			"api.example.com":   true,
+			"a.b.example.com:1": true,
+			"example.com":       false,
+			"badexample.com":    false,
+		},
+	}
+	for pattern, hosts := range expectations {
+		route, err := RouteRule{Path: "/", Host: pattern, Endpoint: "http://hostname"}.validate()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		for host, expected := range hosts {
+			if actual := route.matchesHost(host); actual != expected {
+				t.Errorf("unexpected match of %q against %q\nexpected: %v\nreceived: %v", host, pattern, expected, actual)
+			}
+		}
+	}
+}
+
+func TestValidateEndpoints(t *testing.T) {
+	route := RouteRule{
+		Path:      "/",
+		Endpoints: []Endpoint{{URL: "http://one"}, {URL: "http://two", Weight: 3}},
+	}
+	validRoute, err := route.validate()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if len(validRoute.Backends) != 2 || validRoute.Backends[1].Weight != 3 {
+		t.Errorf("unexpected backends\nexpected: %v\nreceived: %v", 2, len(validRoute.Backends))
+	}
+	if validRoute.EndpointURL.String() != "http://one" {
+		t.Errorf("unexpected endpointURL\nexpected: %v\nreceived: %v", "http://one", validRoute.EndpointURL)
+	}
+
+	expectations := map[string]RouteRule{
+		"only one of endpoint or endpoints may be used": {
+			Path: "/", Endpoint: "http://one", Endpoints: []Endpoint{{URL: "http://two"}},
+		},
+		"endpoints have different schemes: http and ws": {
+			Path: "/", Endpoints: []Endpoint{{URL: "http://one"}, {URL: "ws://two"}},
+		},
+		"invalid endpoint http://: host is empty": {
+			Path: "/", Endpoints: []Endpoint{{URL: "http://"}},
+		},
+		"circuit breaker is not supported for websocket routes": {
+			Path: "/", Endpoint: "ws://one", CircuitBreaker: &CircuitBreakerConfiguration{},
+		},
+		"invalid load balancing: unknown load balancing strategy: fastest": {
+			Path: "/", Endpoints: []Endpoint{{URL: "http://one"}}, LoadBalancing: LoadBalancingConfiguration{Strategy: "fastest"},
+		},
+	}
+	for expectedError, route := range expectations {
+		_, err := route.validate()
+		if err == nil || err.Error() != expectedError {
+			t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package proxyhandler
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hopHeaders are meaningful only for a single connection and must not be
+// forwarded by a proxy. See RFC 7230 section 6.1.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// streamingContentTypes are flushed to the client after every write.
+var streamingContentTypes = []string{
+	"text/event-stream",
+	"application/grpc",
+}
+
+// removeHopHeaders deletes the hop-by-hop headers from header, including any
+// header named by the Connection header. "Te: trailers" is retained as it is
+// required by some protocols, such as gRPC, to reach the backend.
+func removeHopHeaders(header http.Header) {
+	for _, connectionValue := range header["Connection"] {
+		for _, name := range strings.Split(connectionValue, ",") {
+			if name = strings.TrimSpace(name); len(name) > 0 {
+				header.Del(name)
+			}
+		}
+	}
+	acceptsTrailers := false
+	for _, te := range header["Te"] {
+		for _, coding := range strings.Split(te, ",") {
+			if strings.EqualFold(strings.TrimSpace(coding), "trailers") {
+				acceptsTrailers = true
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+	if acceptsTrailers {
+		header.Set("Te", "trailers")
+	}
+}
+
+// flushIntervalFor returns how often the body of response should be flushed to
+// the client. A negative interval flushes after every write and zero disables
+// periodic flushing.
+func flushIntervalFor(response *http.Response, configured time.Duration) time.Duration {
+	if response.ContentLength == -1 {
+		return -1
+	}
+	mediaType, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	for _, streamingType := range streamingContentTypes {
+		if mediaType == streamingType {
+			return -1
+		}
+	}
+	return configured
+}
+
+// announceTrailers sets the Trailer header for each trailer the backend
+// declared so that the client is told to expect them.
+func announceTrailers(destination http.Header, response *http.Response) {
+	if len(response.Trailer) == 0 {
+		return
+	}
+	names := make([]string, 0, len(response.Trailer))
+	for name := range response.Trailer {
+		names = append(names, name)
+	}
+	destination.Add("Trailer", strings.Join(names, ", "))
+}
+
+// copyTrailers copies the trailers received from the backend once its body has
+// been read. Trailers which were not announced are sent using
+// http.TrailerPrefix.
+func copyTrailers(destination http.Header, response *http.Response, announced int) {
+	for name, values := range response.Trailer {
+		if len(response.Trailer) != announced {
+			name = http.TrailerPrefix + name
+		}
+		for _, value := range values {
+			destination.Add(name, value)
+		}
+	}
+}
+
+// copyResponseBody streams body to writer, flushing according to flushInterval.
+func copyResponseBody(writer http.ResponseWriter, body io.Reader, flushInterval time.Duration) error {
+	controller := http.NewResponseController(writer)
+	var destination io.Writer = writer
+	if flushInterval != 0 {
+		latencyWriter := &maxLatencyWriter{
+			destination: writer,
+			flush:       controller.Flush,
+			latency:     flushInterval,
+		}
+		defer latencyWriter.stop()
+		destination = latencyWriter
+	}
+
+	buffer := make([]byte, 32*1024)
+	for {
+		read, readErr := body.Read(buffer)
+		if read > 0 {
+			if _, err := destination.Write(buffer[:read]); err != nil {
+				return err
+			}
+		}
+		if readErr == io.EOF {
+			return nil
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
+
+// maxLatencyWriter flushes writes to destination no later than latency after
+// they are made. A negative latency flushes after every write.
+type maxLatencyWriter struct {
+	destination io.Writer
+	flush       func() error
+	latency     time.Duration
+
+	mutex        sync.Mutex
+	timer        *time.Timer
+	flushPending bool
+}
+
+func (writer *maxLatencyWriter) Write(data []byte) (int, error) {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	written, err := writer.destination.Write(data)
+	if writer.latency < 0 {
+		writer.flush()
+		return written, err
+	}
+	if writer.flushPending {
+		return written, err
+	}
+	if writer.timer == nil {
+		writer.timer = time.AfterFunc(writer.latency, writer.delayedFlush)
+	} else {
+		writer.timer.Reset(writer.latency)
+	}
+	writer.flushPending = true
+	return written, err
+}
+
+func (writer *maxLatencyWriter) delayedFlush() {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	if !writer.flushPending {
+		return
+	}
+	writer.flush()
+	writer.flushPending = false
+}
+
+func (writer *maxLatencyWriter) stop() {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	writer.flushPending = false
+	if writer.timer != nil {
+		writer.timer.Stop()
+	}
+}
@@ -0,0 +1,229 @@
+package proxyhandler
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/jarcoal/httpmock"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRemoveHopHeaders(t *testing.T) {
+	header := http.Header{
+		"Connection":          []string{"X-Hop, keep-alive"},
+		"Keep-Alive":          []string{"timeout=5"},
+		"X-Hop":               []string{"remove me"},
+		"Proxy-Authorization": []string{"Basic Zm9vOmJhcg=="},
+		"Transfer-Encoding":   []string{"chunked"},
+		"Upgrade":             []string{"h2c"},
+		"Te":                  []string{"gzip, trailers"},
+		"X-End-To-End":        []string{"keep me"},
+	}
+	expectedHeader := http.Header{
+		"Te":           []string{"trailers"},
+		"X-End-To-End": []string{"keep me"},
+	}
+
+	removeHopHeaders(header)
+	if !reflect.DeepEqual(header, expectedHeader) {
+		t.Errorf("unexpected headers\nexpected: %v\nreceived: %v", expectedHeader, header)
+	}
+}
+
+func TestFlushIntervalForStreamingResponses(t *testing.T) {
+	configured := time.Second
+	var responses = map[string]*http.Response{
+		"event stream":   &http.Response{ContentLength: 10, Header: http.Header{"Content-Type": []string{"text/event-stream; charset=utf-8"}}},
+		"unknown length": &http.Response{ContentLength: -1, Header: http.Header{}},
+	}
+	for name, response := range responses {
+		if interval := flushIntervalFor(response, configured); interval != -1 {
+			t.Errorf("expected %s to flush immediately\nexpected: %v\nreceived: %v", name, -1, interval)
+		}
+	}
+
+	response := &http.Response{ContentLength: 10, Header: http.Header{"Content-Type": []string{"text/plain"}}}
+	if interval := flushIntervalFor(response, configured); interval != configured {
+		t.Errorf("unexpected flush interval\nexpected: %v\nreceived: %v", configured, interval)
+	}
+}
+
+func TestHopHeadersAreNotProxied(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	httpmock.RegisterResponder("GET", "http://defaulthost/", func(r *http.Request) (*http.Response, error) {
+		if _, ok := r.Header["X-Hop"]; ok {
+			t.Errorf("expected request header named by Connection to be removed\nreceived: %v", r.Header)
+		}
+		if _, ok := r.Header["Proxy-Authorization"]; ok {
+			t.Errorf("expected Proxy-Authorization to be removed\nreceived: %v", r.Header)
+		}
+		response := httpmock.NewStringResponse(200, "")
+		response.Header.Set("Connection", "X-Backend-Hop")
+		response.Header.Set("X-Backend-Hop", "remove me")
+		response.Header.Set("Keep-Alive", "timeout=5")
+		return response, nil
+	})
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Connection", "X-Hop")
+	req.Header.Set("X-Hop", "remove me")
+	req.Header.Set("Proxy-Authorization", "Basic Zm9vOmJhcg==")
+	recorder := httptest.NewRecorder()
+
+	config := buildConfiguration()
+	config.DefaultRoute = "http://defaulthost"
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	h.ServeHTTP(recorder, req)
+
+	for _, name := range []string{"Connection", "X-Backend-Hop", "Keep-Alive"} {
+		if _, ok := recorder.Header()[name]; ok {
+			t.Errorf("expected response header %s to be removed\nreceived: %v", name, recorder.Header())
+		}
+	}
+}
+
+func TestTrailersAreProxied(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		w.WriteHeader(200)
+		w.Write([]byte("body"))
+		w.Header().Set("X-Checksum", "abc123")
+		w.Header().Set(http.TrailerPrefix+"X-Unannounced", "surprise")
+	}))
+	defer backend.Close()
+
+	config := buildConfiguration()
+	config.DefaultRoute = backend.URL
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	proxy := httptest.NewServer(h)
+	defer proxy.Close()
+
+	response, err := http.Get(proxy.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	ioutil.ReadAll(response.Body)
+	response.Body.Close()
+
+	for name, expected := range map[string]string{"X-Checksum": "abc123", "X-Unannounced": "surprise"} {
+		if actual := response.Trailer.Get(name); actual != expected {
+			t.Errorf("unexpected trailer %s\nexpected: %v\nreceived: %v", name, expected, actual)
+		}
+	}
+}
+
+func TestStreamingResponsesAreFlushed(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: first\n\n"))
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer backend.Close()
+
+	config := buildConfiguration()
+	config.DefaultRoute = backend.URL
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	proxy := httptest.NewServer(h)
+	defer proxy.Close()
+	defer close(release)
+
+	response, err := http.Get(proxy.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	defer response.Body.Close()
+
+	received := make(chan string)
+	go func() {
+		line, _ := bufio.NewReader(response.Body).ReadString('\n')
+		received <- line
+	}()
+	select {
+	case line := <-received:
+		if line != "data: first\n" {
+			t.Errorf("unexpected event\nexpected: %q\nreceived: %q", "data: first\n", line)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("expected streamed event to be flushed before the response completed")
+	}
+}
+
+func TestGRPCTrailersAreProxiedOverH2C(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	backendProtocols := new(http.Protocols)
+	backendProtocols.SetUnencryptedHTTP2(true)
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.Header.Get("Te") != "trailers" {
+			w.WriteHeader(http.StatusHTTPVersionNotSupported)
+			return
+		}
+		ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("\x00\x00\x00\x00\x00"))
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "ok")
+	}))
+	backend.Config.Protocols = backendProtocols
+	backend.Start()
+	defer backend.Close()
+
+	h2c := true
+	config := buildConfiguration()
+	config.H2C = true
+	config.Routes = []*RouteRule{{Path: "/", Endpoint: backend.URL, Transport: &TransportConfiguration{H2C: &h2c}}}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	defer h.Close()
+	proxy := httptest.NewUnstartedServer(h)
+	proxy.Config.Protocols = h.Protocols()
+	proxy.Start()
+	defer proxy.Close()
+
+	clientProtocols := new(http.Protocols)
+	clientProtocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: clientProtocols}}
+	request, _ := http.NewRequest("POST", proxy.URL+"/helloworld.Greeter/SayHello", bytes.NewReader([]byte("\x00\x00\x00\x00\x00")))
+	request.Header.Set("Content-Type", "application/grpc")
+	request.Header.Set("Te", "trailers")
+	response, err := client.Do(request)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	defer response.Body.Close()
+	ioutil.ReadAll(response.Body)
+	if response.StatusCode != http.StatusOK || response.ProtoMajor != 2 {
+		t.Fatalf("unexpected response\nexpected: %v\nreceived: %v %v", "200 over HTTP/2", response.StatusCode, response.Proto)
+	}
+	expectedTrailer := http.Header{"Grpc-Status": []string{"0"}, "Grpc-Message": []string{"ok"}}
+	if !reflect.DeepEqual(response.Trailer, expectedTrailer) {
+		t.Errorf("unexpected trailers\nexpected: %v\nreceived: %v", expectedTrailer, response.Trailer)
+	}
+}
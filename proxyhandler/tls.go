@@ -0,0 +1,192 @@
+package proxyhandler
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// TLSConfiguration enables TLS termination on the listener. Each of the
+// Certificates is offered to clients whose server name it is valid for, and
+// the first is offered to any other client. MinVersion is the lowest TLS
+// version accepted, one of "1.0", "1.1", "1.2" or "1.3", and defaults to
+// "1.2". CipherSuites optionally restricts the cipher suites used by TLS 1.2
+// and earlier to those named, such as
+// "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256". When RedirectPort is set, plain
+// HTTP requests to that port are redirected to HTTPS. ClientAuth enables
+// mutual TLS and is one of "none", the default, "optional", which verifies a
+// certificate only when the client presents one, or "require", which rejects
+// clients without a valid certificate. Client certificates are verified
+// against the PEM bundle at ClientCAFile. HTTP2 allows clients to negotiate
+// HTTP/2 and defaults to true.
+type TLSConfiguration struct {
+	Certificates []CertificateConfiguration `yaml:"certificates"`
+	MinVersion   string                     `yaml:"min_version"`
+	CipherSuites []string                   `yaml:"cipher_suites"`
+	RedirectPort int                        `yaml:"redirect_port"`
+	ClientAuth   string                     `yaml:"client_auth"`
+	ClientCAFile string                     `yaml:"client_ca_file"`
+	HTTP2        *bool                      `yaml:"http2"`
+}
+
+// CertificateConfiguration names the PEM encoded certificate chain and
+// private key files of a certificate.
+type CertificateConfiguration struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"":         tls.NoClientCert,
+	"none":     tls.NoClientCert,
+	"optional": tls.VerifyClientCertIfGiven,
+	"require":  tls.RequireAndVerifyClientCert,
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// validate loads the certificates of the configuration and returns the
+// tls.Config used by the listener, or nil when TLS is not enabled.
+func (config TLSConfiguration) validate() (*tls.Config, error) {
+	if config.RedirectPort < 0 || config.RedirectPort > 65535 {
+		return nil, fmt.Errorf("invalid redirect port: %d", config.RedirectPort)
+	}
+	if len(config.Certificates) == 0 {
+		if len(config.MinVersion) > 0 || len(config.CipherSuites) > 0 || config.RedirectPort > 0 ||
+			len(config.ClientAuth) > 0 || len(config.ClientCAFile) > 0 || config.HTTP2 != nil {
+			return nil, fmt.Errorf("no certificates configured")
+		}
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if len(config.MinVersion) > 0 {
+		version, ok := tlsVersions[config.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unsupported min version: %s", config.MinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+	for _, name := range config.CipherSuites {
+		id, ok := cipherSuiteID(name)
+		if !ok {
+			return nil, fmt.Errorf("unsupported cipher suite: %s", name)
+		}
+		tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+	}
+	for _, certificate := range config.Certificates {
+		if len(certificate.CertFile) == 0 || len(certificate.KeyFile) == 0 {
+			return nil, fmt.Errorf("certificate requires cert file and key file")
+		}
+		pair, err := tls.LoadX509KeyPair(certificate.CertFile, certificate.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading certificate %s: %s", certificate.CertFile, err.Error())
+		}
+		tlsConfig.Certificates = append(tlsConfig.Certificates, pair)
+	}
+
+	clientAuth, ok := clientAuthTypes[config.ClientAuth]
+	if !ok {
+		return nil, fmt.Errorf("unsupported client auth: %s", config.ClientAuth)
+	}
+	if clientAuth != tls.NoClientCert {
+		if len(config.ClientCAFile) == 0 {
+			return nil, fmt.Errorf("client auth requires client ca file")
+		}
+		pool, err := loadCertPool(config.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientAuth, tlsConfig.ClientCAs = clientAuth, pool
+	} else if len(config.ClientCAFile) > 0 {
+		return nil, fmt.Errorf("client ca file requires client auth")
+	}
+	return tlsConfig, nil
+}
+
+// cipherSuiteID returns the ID of the secure cipher suite called name.
+func cipherSuiteID(name string) (uint16, bool) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite.ID, true
+		}
+	}
+	return 0, false
+}
+
+// listenerProtocols returns the protocols served by a listener, which uses TLS
+// when tlsEnabled.
+func (config *Configuration) listenerProtocols(tlsEnabled bool) *http.Protocols {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(tlsEnabled && (config.TLS.HTTP2 == nil || *config.TLS.HTTP2))
+	protocols.SetUnencryptedHTTP2(!tlsEnabled && config.H2C)
+	return protocols
+}
+
+// nextProtos are the ALPN protocols offered by a TLS listener serving
+// protocols.
+func nextProtos(protocols *http.Protocols) []string {
+	if protocols.HTTP2() {
+		return []string{"h2", "http/1.1"}
+	}
+	return []string{"http/1.1"}
+}
+
+// Protocols returns the protocols the listener serving the handler should
+// accept. They are chosen by the configuration the handler was created with
+// and are not changed by Reload.
+func (handler *ProxyHandler) Protocols() *http.Protocols {
+	protocols := *handler.protocols
+	return &protocols
+}
+
+// TLSConfig returns the tls.Config for a listener serving the handler, or nil
+// when the configuration the handler was created with does not enable TLS.
+// Certificates and settings replaced by Reload are used by new connections.
+func (handler *ProxyHandler) TLSConfig() *tls.Config {
+	initial := handler.configuration().TLSConfig
+	if initial == nil {
+		return nil
+	}
+	tlsConfig := initial.Clone()
+	tlsConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		// A reloaded configuration without TLS keeps the previous settings.
+		if current := handler.configuration().TLSConfig; current != nil {
+			return current, nil
+		}
+		return nil, nil
+	}
+	return tlsConfig
+}
+
+// RedirectToHTTPS returns a handler which redirects every request to the same
+// URL using https on port.
+func RedirectToHTTPS(port int) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		host := request.Host
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			host = hostname
+		}
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		if port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(port))
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		target := "https://" + host + request.URL.RequestURI()
+		status := http.StatusPermanentRedirect
+		if request.Method == "GET" || request.Method == "HEAD" {
+			status = http.StatusMovedPermanently
+		}
+		http.Redirect(writer, request, target, status)
+	})
+}
@@ -0,0 +1,266 @@
+package proxyhandler
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/jarcoal/httpmock"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeCertificate writes a self signed certificate for hosts and its key to
+// dir, returning the certificate and key file names.
+func writeCertificate(t *testing.T, dir, name string, hosts ...string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: hosts[0]},
+		DNSNames:              hosts,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	certFile := filepath.Join(dir, name+".pem")
+	keyFile := filepath.Join(dir, name+"-key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+func servedCertificateName(t *testing.T, address, serverName string) string {
+	connection, err := tls.Dial("tcp", address, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	defer connection.Close()
+	return connection.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestTLSConfigSelectsCertificateByServerName(t *testing.T) {
+	dir := t.TempDir()
+	certA, keyA := writeCertificate(t, dir, "a", "a.example.com")
+	certB, keyB := writeCertificate(t, dir, "b", "b.example.com", "*.b.example.com")
+	config := buildConfiguration()
+	config.TLS.Certificates = []CertificateConfiguration{{CertFile: certA, KeyFile: keyA}, {CertFile: certB, KeyFile: keyB}}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	defer h.Close()
+
+	server := httptest.NewUnstartedServer(http.NotFoundHandler())
+	server.TLS = h.TLSConfig()
+	server.StartTLS()
+	defer server.Close()
+	address := strings.TrimPrefix(server.URL, "https://")
+
+	expectations := map[string]string{
+		"a.example.com":     "a.example.com",
+		"b.example.com":     "b.example.com",
+		"www.b.example.com": "b.example.com",
+		"other.example.com": "a.example.com",
+	}
+	for serverName, expected := range expectations {
+		if name := servedCertificateName(t, address, serverName); name != expected {
+			t.Errorf("unexpected certificate for %s\nexpected: %v\nreceived: %v", serverName, expected, name)
+		}
+	}
+
+	certC, keyC := writeCertificate(t, dir, "c", "c.example.com")
+	config.TLS.Certificates = []CertificateConfiguration{{CertFile: certC, KeyFile: keyC}}
+	if err := h.Reload(config); err != nil {
+		t.Fatalf("unable to reload proxyhandler: %s", err.Error())
+	}
+	if name := servedCertificateName(t, address, "a.example.com"); name != "c.example.com" {
+		t.Errorf("reloaded certificate not served\nexpected: %v\nreceived: %v", "c.example.com", name)
+	}
+}
+
+func TestTLSConfigurationValidate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCertificate(t, dir, "a", "a.example.com")
+	certificates := []CertificateConfiguration{{CertFile: certFile, KeyFile: keyFile}}
+
+	tlsConfig, err := TLSConfiguration{
+		Certificates: certificates,
+		MinVersion:   "1.3",
+		CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+	}.validate()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if tlsConfig.MinVersion != tls.VersionTLS13 || len(tlsConfig.CipherSuites) != 1 {
+		t.Errorf("unexpected tls config\nexpected: %v\nreceived: %v %v", "1.3 with 1 cipher suite", tlsConfig.MinVersion, tlsConfig.CipherSuites)
+	}
+	if tlsConfig, err := (TLSConfiguration{}).validate(); tlsConfig != nil || err != nil {
+		t.Errorf("expected tls to be disabled\nexpected: %v\nreceived: %v %v", nil, tlsConfig, err)
+	}
+
+	expectations := map[string]TLSConfiguration{
+		"no certificates configured":                         {MinVersion: "1.2"},
+		"unsupported min version: 1.4":                       {Certificates: certificates, MinVersion: "1.4"},
+		"unsupported cipher suite: TLS_RSA_WITH_RC4_128_SHA": {Certificates: certificates, CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}},
+		"certificate requires cert file and key file":        {Certificates: []CertificateConfiguration{{CertFile: certFile}}},
+		"invalid redirect port: 70000":                       {Certificates: certificates, RedirectPort: 70000},
+		"loading certificate " + keyFile:                     {Certificates: []CertificateConfiguration{{CertFile: keyFile, KeyFile: keyFile}}},
+		"unsupported client auth: always":                    {Certificates: certificates, ClientAuth: "always"},
+		"client auth requires client ca file":                {Certificates: certificates, ClientAuth: "require"},
+		"client ca file requires client auth":                {Certificates: certificates, ClientCAFile: certFile},
+		"no certificates found in ca file " + keyFile:        {Certificates: certificates, ClientAuth: "optional", ClientCAFile: keyFile},
+	}
+	for expectedError, config := range expectations {
+		_, err := config.validate()
+		if err == nil || !strings.HasPrefix(err.Error(), expectedError) {
+			t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+		}
+	}
+}
+
+func TestTLSConfigRequiresClientCertificate(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	dir := t.TempDir()
+	certFile, keyFile := writeCertificate(t, dir, "server", "server.example.com")
+	clientCert, clientKey := writeCertificate(t, dir, "client", "client.example.com")
+	config := buildConfiguration()
+	config.TLS = TLSConfiguration{
+		Certificates: []CertificateConfiguration{{CertFile: certFile, KeyFile: keyFile}},
+		ClientAuth:   "require",
+		ClientCAFile: clientCert,
+	}
+	config.ForwardedHeaders.ClientCertificateHeaders = map[string]string{"X-Client-Cert-Subject": "subject"}
+	httpmock.RegisterResponder("GET", "http://default.endpoint/", func(request *http.Request) (*http.Response, error) {
+		return httpmock.NewStringResponse(http.StatusOK, request.Header.Get("X-Client-Cert-Subject")), nil
+	})
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	defer h.Close()
+
+	server := httptest.NewUnstartedServer(h)
+	server.TLS = h.TLSConfig()
+	server.StartTLS()
+	defer server.Close()
+	roots, _ := loadCertPool(certFile)
+	tlsConfig := &tls.Config{RootCAs: roots, ServerName: "server.example.com"}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	if response, err := client.Get(server.URL + "/"); err == nil {
+		response.Body.Close()
+		t.Fatal("expected client without certificate to be rejected")
+	}
+
+	pair, err := tls.LoadX509KeyPair(clientCert, clientKey)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	tlsConfig.Certificates = []tls.Certificate{pair}
+	client = &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	response, err := client.Get(server.URL + "/")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	defer response.Body.Close()
+	body, _ := ioutil.ReadAll(response.Body)
+	if string(body) != "CN=client.example.com" {
+		t.Errorf("unexpected forwarded subject\nexpected: %v\nreceived: %v", "CN=client.example.com", string(body))
+	}
+}
+
+func TestTLSListenerNegotiatesHTTP2(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	httpmock.RegisterResponder("GET", "http://default.endpoint/", httpmock.NewStringResponder(http.StatusOK, "ok"))
+	dir := t.TempDir()
+	certFile, keyFile := writeCertificate(t, dir, "server", "server.example.com")
+	roots, _ := loadCertPool(certFile)
+
+	disabled := false
+	for _, http2 := range []*bool{nil, &disabled} {
+		config := buildConfiguration()
+		config.TLS = TLSConfiguration{Certificates: []CertificateConfiguration{{CertFile: certFile, KeyFile: keyFile}}, HTTP2: http2}
+		h, err := New(config)
+		if err != nil {
+			t.Fatalf("unable to create proxyhandler: %s", err.Error())
+		}
+		server := httptest.NewUnstartedServer(h)
+		server.Config.Protocols = h.Protocols()
+		server.TLS = h.TLSConfig()
+		server.StartTLS()
+
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: roots, ServerName: "server.example.com"},
+			ForceAttemptHTTP2: true,
+		}}
+		response, err := client.Get(server.URL + "/")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		response.Body.Close()
+		expected := 2
+		if http2 != nil {
+			expected = 1
+		}
+		if response.ProtoMajor != expected {
+			t.Errorf("unexpected protocol\nexpected: HTTP/%d\nreceived: %v", expected, response.Proto)
+		}
+		server.Close()
+		h.Close()
+	}
+
+	expectedError := "h2c is not supported with tls"
+	config := buildConfiguration()
+	config.TLS = TLSConfiguration{Certificates: []CertificateConfiguration{{CertFile: certFile, KeyFile: keyFile}}}
+	config.H2C = true
+	_, err := config.validate()
+	if err == nil || !strings.Contains(err.Error(), expectedError) {
+		t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	expectations := []struct {
+		method, target, host string
+		port                 int
+		status               int
+		location             string
+	}{
+		{"GET", "/path?query=1", "example.com", 443, http.StatusMovedPermanently, "https://example.com/path?query=1"},
+		{"GET", "/", "example.com:80", 8443, http.StatusMovedPermanently, "https://example.com:8443/"},
+		{"POST", "/form", "[::1]:80", 443, http.StatusPermanentRedirect, "https://[::1]/form"},
+	}
+	for _, expectation := range expectations {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(expectation.method, expectation.target, nil)
+		request.Host = expectation.host
+		RedirectToHTTPS(expectation.port).ServeHTTP(recorder, request)
+		if recorder.Code != expectation.status || recorder.Header().Get("Location") != expectation.location {
+			t.Errorf("unexpected redirect\nexpected: %v %v\nreceived: %v %v", expectation.status, expectation.location, recorder.Code, recorder.Header().Get("Location"))
+		}
+	}
+}
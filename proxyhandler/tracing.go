@@ -0,0 +1,520 @@
+package proxyhandler
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TracingConfiguration enables distributed tracing. A server span is recorded
+// for each request and a client span for each attempt to reach a backend,
+// including retries. The trace context of a request is read from its W3C
+// traceparent and tracestate headers, or a new trace is started, and is sent
+// to backends in the same headers. Spans are exported in batches of up to
+// BatchSize, at least every FlushInterval, to the OTLP/HTTP collector at
+// Endpoint using the JSON encoding, with Headers added to each export
+// request. An Endpoint without a path is sent spans at /v1/traces.
+// SampleRatio is the fraction of new traces which are recorded, while
+// requests which carry a trace context are recorded when their parent was.
+type TracingConfiguration struct {
+	Endpoint      string            `yaml:"endpoint"`
+	ServiceName   string            `yaml:"service_name"`
+	Headers       map[string]string `yaml:"headers"`
+	SampleRatio   *float64          `yaml:"sample_ratio"`
+	BatchSize     int               `yaml:"batch_size"`
+	FlushInterval time.Duration     `yaml:"flush_interval"`
+	Timeout       time.Duration     `yaml:"timeout"`
+}
+
+// tracingSettings is a resolved TracingConfiguration.
+type tracingSettings struct {
+	Endpoint      string
+	ServiceName   string
+	Headers       http.Header
+	SampleRatio   float64
+	BatchSize     int
+	FlushInterval time.Duration
+	Timeout       time.Duration
+}
+
+var defaultTracingSettings = tracingSettings{
+	ServiceName:   "moxie",
+	SampleRatio:   1,
+	BatchSize:     512,
+	FlushInterval: 5 * time.Second,
+	Timeout:       10 * time.Second,
+}
+
+// maxQueuedSpans limits the spans waiting to be exported. Further spans are
+// dropped while the collector cannot keep up.
+const maxQueuedSpans = 2048
+
+// validate returns the settings of tracing, or nil when it is not enabled.
+func (tracing *TracingConfiguration) validate() (*tracingSettings, error) {
+	if tracing == nil {
+		return nil, nil
+	}
+	if len(tracing.Endpoint) == 0 {
+		return nil, fmt.Errorf("endpoint is missing")
+	}
+	endpoint, err := url.Parse(tracing.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint: %s", err.Error())
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported endpoint scheme: %s", endpoint.Scheme)
+	}
+	if len(endpoint.Path) == 0 || endpoint.Path == "/" {
+		endpoint.Path = "/v1/traces"
+	}
+	if tracing.SampleRatio != nil && (*tracing.SampleRatio < 0 || *tracing.SampleRatio > 1) {
+		return nil, fmt.Errorf("sample ratio must be between 0 and 1")
+	}
+	if tracing.BatchSize < 0 {
+		return nil, fmt.Errorf("batch size is negative")
+	}
+	if tracing.FlushInterval < 0 {
+		return nil, fmt.Errorf("flush interval is negative")
+	}
+	if tracing.Timeout < 0 {
+		return nil, fmt.Errorf("timeout is negative")
+	}
+
+	settings := defaultTracingSettings
+	settings.Endpoint = endpoint.String()
+	if len(tracing.ServiceName) > 0 {
+		settings.ServiceName = tracing.ServiceName
+	}
+	if len(tracing.Headers) > 0 {
+		settings.Headers = http.Header{}
+		for name, value := range tracing.Headers {
+			settings.Headers.Set(name, value)
+		}
+	}
+	if tracing.SampleRatio != nil {
+		settings.SampleRatio = *tracing.SampleRatio
+	}
+	if tracing.BatchSize > 0 {
+		settings.BatchSize = tracing.BatchSize
+	}
+	if tracing.FlushInterval > 0 {
+		settings.FlushInterval = tracing.FlushInterval
+	}
+	if tracing.Timeout > 0 {
+		settings.Timeout = tracing.Timeout
+	}
+	return &settings, nil
+}
+
+// spanContext identifies a span within a trace, as carried by the W3C
+// traceparent and tracestate headers.
+type spanContext struct {
+	TraceID    [16]byte
+	SpanID     [8]byte
+	Sampled    bool
+	TraceState string
+}
+
+// parseTraceparent reads the trace context in header, reporting false when
+// it does not carry a valid one.
+func parseTraceparent(header http.Header) (spanContext, bool) {
+	var parent spanContext
+	value := strings.TrimSpace(header.Get("Traceparent"))
+	// Later versions may append fields, which are ignored.
+	if len(value) < 55 || (len(value) > 55 && value[55] != '-') {
+		return parent, false
+	}
+	fields := strings.Split(value[:55], "-")
+	if len(fields) != 4 || len(fields[0]) != 2 || len(fields[1]) != 32 || len(fields[2]) != 16 || len(fields[3]) != 2 {
+		return parent, false
+	}
+	if fields[0] == "ff" || (fields[0] == "00" && len(value) != 55) {
+		return parent, false
+	}
+	for _, field := range fields {
+		if field != strings.ToLower(field) {
+			return parent, false
+		}
+	}
+	if _, err := hex.DecodeString(fields[0]); err != nil {
+		return parent, false
+	}
+	if _, err := hex.Decode(parent.TraceID[:], []byte(fields[1])); err != nil || parent.TraceID == [16]byte{} {
+		return parent, false
+	}
+	if _, err := hex.Decode(parent.SpanID[:], []byte(fields[2])); err != nil || parent.SpanID == [8]byte{} {
+		return parent, false
+	}
+	flags, err := hex.DecodeString(fields[3])
+	if err != nil {
+		return parent, false
+	}
+	parent.Sampled = flags[0]&1 == 1
+	parent.TraceState = strings.Join(header.Values("Tracestate"), ",")
+	return parent, true
+}
+
+// inject replaces the trace context in header with identity.
+func (identity spanContext) inject(header http.Header) {
+	flags := "00"
+	if identity.Sampled {
+		flags = "01"
+	}
+	header.Set("Traceparent", fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(identity.TraceID[:]), hex.EncodeToString(identity.SpanID[:]), flags))
+	header.Del("Tracestate")
+	if len(identity.TraceState) > 0 {
+		header.Set("Tracestate", identity.TraceState)
+	}
+}
+
+const (
+	spanKindServer = 2
+	spanKindClient = 3
+)
+
+// span is an operation recorded in a trace. Spans which are not sampled are
+// only used to propagate their context. The methods of a nil span, which is
+// used when tracing is disabled, do nothing.
+type span struct {
+	tracer     *tracer
+	context    spanContext
+	parentID   [8]byte
+	name       string
+	kind       int
+	start      time.Time
+	end        time.Time
+	attributes map[string]interface{}
+	failed     bool
+	message    string
+	once       sync.Once
+}
+
+// setAttribute records value, a string, bool or int, under key.
+func (span *span) setAttribute(key string, value interface{}) {
+	if span == nil {
+		return
+	}
+	span.attributes[key] = value
+}
+
+// fail marks the operation of span as having failed with message.
+func (span *span) fail(message string) {
+	if span == nil {
+		return
+	}
+	span.failed = true
+	span.message = message
+}
+
+// finish ends span and queues it for export. Only the first call has any
+// effect.
+func (span *span) finish() {
+	if span == nil {
+		return
+	}
+	span.once.Do(func() {
+		span.end = time.Now()
+		if span.context.Sampled {
+			span.tracer.enqueue(span)
+		}
+	})
+}
+
+// inject replaces the trace context in header with that of span.
+func (span *span) inject(header http.Header) {
+	if span == nil {
+		return
+	}
+	span.context.inject(header)
+}
+
+type spanKey struct{}
+
+func withSpan(ctx context.Context, span *span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// spanFrom returns the span of the request with ctx, or nil when the request
+// is not traced.
+func spanFrom(ctx context.Context) *span {
+	span, _ := ctx.Value(spanKey{}).(*span)
+	return span
+}
+
+// tracer records spans and exports them to a collector. Spans finished after
+// the tracer is closed, by requests still in flight when a reload replaced it,
+// are dropped rather than holding up those requests to export them.
+type tracer struct {
+	settings  tracingSettings
+	client    *http.Client
+	mutex     sync.Mutex
+	queued    []*span
+	closed    bool
+	flush     chan struct{}
+	stop      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+func newTracer(settings tracingSettings) *tracer {
+	tracer := &tracer{
+		settings: settings,
+		client:   &http.Client{Timeout: settings.Timeout},
+		flush:    make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go tracer.run()
+	return tracer
+}
+
+// sameSettings reports whether tracer was created from settings.
+func (tracer *tracer) sameSettings(settings *tracingSettings) bool {
+	return tracer != nil && settings != nil && reflect.DeepEqual(tracer.settings, *settings)
+}
+
+func randomID(id []byte) {
+	for {
+		rand.Read(id)
+		for _, value := range id {
+			if value != 0 {
+				return
+			}
+		}
+	}
+}
+
+// startServerSpan starts the span of request, continuing the trace of its
+// traceparent header when it has one. A nil tracer records nothing.
+func (tracer *tracer) startServerSpan(request *http.Request) *span {
+	if tracer == nil {
+		return nil
+	}
+	span := &span{tracer: tracer, name: request.Method, kind: spanKindServer, start: time.Now(), attributes: map[string]interface{}{}}
+	if parent, ok := parseTraceparent(request.Header); ok {
+		span.context = parent
+		span.parentID = parent.SpanID
+	} else {
+		randomID(span.context.TraceID[:])
+		// The trace ID is random, so its leading bytes sample new traces at
+		// the configured ratio.
+		span.context.Sampled = float64(binary.BigEndian.Uint64(span.context.TraceID[:8])>>11) < tracer.settings.SampleRatio*(1<<53)
+	}
+	randomID(span.context.SpanID[:])
+	span.setAttribute("http.request.method", request.Method)
+	span.setAttribute("url.path", request.URL.Path)
+	span.setAttribute("server.address", request.Host)
+	span.setAttribute("client.address", clientHost(request))
+	return span
+}
+
+// startClientSpan starts a span for a request sent on behalf of parent.
+func (parent *span) startClientSpan(method string) *span {
+	if parent == nil {
+		return nil
+	}
+	span := &span{tracer: parent.tracer, context: parent.context, parentID: parent.context.SpanID, name: method, kind: spanKindClient, start: time.Now(), attributes: map[string]interface{}{}}
+	randomID(span.context.SpanID[:])
+	return span
+}
+
+func (tracer *tracer) enqueue(span *span) {
+	tracer.mutex.Lock()
+	defer tracer.mutex.Unlock()
+	if tracer.closed || len(tracer.queued) >= maxQueuedSpans {
+		return
+	}
+	tracer.queued = append(tracer.queued, span)
+	if len(tracer.queued) >= tracer.settings.BatchSize {
+		select {
+		case tracer.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (tracer *tracer) run() {
+	defer close(tracer.stopped)
+	ticker := time.NewTicker(tracer.settings.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-tracer.flush:
+		case <-tracer.stop:
+			tracer.export()
+			return
+		}
+		tracer.export()
+	}
+}
+
+// export sends the queued spans to the collector in batches.
+func (tracer *tracer) export() {
+	for {
+		tracer.mutex.Lock()
+		batch := tracer.queued
+		if len(batch) > tracer.settings.BatchSize {
+			batch = batch[:tracer.settings.BatchSize]
+		}
+		tracer.queued = tracer.queued[len(batch):]
+		tracer.mutex.Unlock()
+		if len(batch) == 0 {
+			return
+		}
+		if err := tracer.send(batch); err != nil {
+			log.Printf("tracing: error exporting %d spans: %s", len(batch), err.Error())
+		}
+	}
+}
+
+func (tracer *tracer) send(batch []*span) error {
+	body, err := json.Marshal(tracer.encode(batch))
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest("POST", tracer.settings.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	copyHeaders(request.Header, tracer.settings.Headers)
+	request.Header.Set("Content-Type", "application/json")
+	response, err := tracer.client.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("collector responded with status %d", response.StatusCode)
+	}
+	return nil
+}
+
+// close stops the tracer once its queued spans have been exported. It may be
+// called more than once.
+func (tracer *tracer) close() {
+	if tracer == nil {
+		return
+	}
+	tracer.closeOnce.Do(func() {
+		tracer.mutex.Lock()
+		tracer.closed = true
+		tracer.mutex.Unlock()
+		close(tracer.stop)
+	})
+	<-tracer.stopped
+}
+
+// The OTLP/HTTP JSON encoding of an export request.
+type otlpExportRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	TraceState        string          `json:"traceState,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+func encodeOTLPAttribute(key string, value interface{}) otlpAttribute {
+	attribute := otlpAttribute{Key: key}
+	switch typed := value.(type) {
+	case bool:
+		attribute.Value.BoolValue = &typed
+	case int:
+		encoded := strconv.Itoa(typed)
+		attribute.Value.IntValue = &encoded
+	default:
+		encoded := fmt.Sprint(typed)
+		attribute.Value.StringValue = &encoded
+	}
+	return attribute
+}
+
+func (tracer *tracer) encode(batch []*span) otlpExportRequest {
+	spans := make([]otlpSpan, len(batch))
+	for index, span := range batch {
+		encoded := otlpSpan{
+			TraceID:           hex.EncodeToString(span.context.TraceID[:]),
+			SpanID:            hex.EncodeToString(span.context.SpanID[:]),
+			TraceState:        span.context.TraceState,
+			Name:              span.name,
+			Kind:              span.kind,
+			StartTimeUnixNano: strconv.FormatInt(span.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.end.UnixNano(), 10),
+		}
+		if span.parentID != [8]byte{} {
+			encoded.ParentSpanID = hex.EncodeToString(span.parentID[:])
+		}
+		keys := make([]string, 0, len(span.attributes))
+		for key := range span.attributes {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			encoded.Attributes = append(encoded.Attributes, encodeOTLPAttribute(key, span.attributes[key]))
+		}
+		if span.failed {
+			encoded.Status = otlpStatus{Code: 2, Message: span.message}
+		}
+		spans[index] = encoded
+	}
+	return otlpExportRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []otlpAttribute{encodeOTLPAttribute("service.name", tracer.settings.ServiceName)}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "moxie"}, Spans: spans}},
+	}}}
+}
@@ -0,0 +1,256 @@
+package proxyhandler
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	valid := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	header := http.Header{}
+	header.Set("Traceparent", valid)
+	header.Add("Tracestate", "vendor=one")
+	header.Add("Tracestate", "other=two")
+	parent, ok := parseTraceparent(header)
+	if !ok {
+		t.Fatal("expected traceparent to be valid")
+	}
+	if traceID := hex.EncodeToString(parent.TraceID[:]); traceID != "4bf92f3577b34da6a3ce929d0e0e4736" || !parent.Sampled {
+		t.Errorf("unexpected trace context\nexpected: %v\nreceived: %v %v", "4bf92f3577b34da6a3ce929d0e0e4736 sampled", traceID, parent.Sampled)
+	}
+	if parent.TraceState != "vendor=one,other=two" {
+		t.Errorf("unexpected tracestate\nexpected: %v\nreceived: %v", "vendor=one,other=two", parent.TraceState)
+	}
+	injected := http.Header{}
+	parent.inject(injected)
+	if injected.Get("Traceparent") != valid || injected.Get("Tracestate") != parent.TraceState {
+		t.Errorf("unexpected injected context\nexpected: %v\nreceived: %v", valid, injected)
+	}
+
+	var expectations = map[string]bool{
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-future": true,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra":  false,
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01":        false,
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01":        false,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01":        false,
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01":        false,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7":           false,
+		"00-4bf92f3577b34da6a3ce929d0e0e473z-00f067aa0ba902b7-01":        false,
+	}
+	for value, expected := range expectations {
+		header := http.Header{}
+		header.Set("Traceparent", value)
+		if _, ok := parseTraceparent(header); ok != expected {
+			t.Errorf("unexpected validity of %s\nexpected: %v\nreceived: %v", value, expected, ok)
+		}
+	}
+}
+
+func TestTracingConfigurationValidate(t *testing.T) {
+	settings, err := (&TracingConfiguration{Endpoint: "http://collector:4318"}).validate()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if settings.Endpoint != "http://collector:4318/v1/traces" || settings.ServiceName != "moxie" || settings.SampleRatio != 1 {
+		t.Errorf("unexpected settings\nexpected: %v\nreceived: %+v", "defaults with /v1/traces", *settings)
+	}
+
+	ratio := 1.5
+	var expectations = map[string]*TracingConfiguration{
+		"invalid tracing: endpoint is missing":                  {},
+		"invalid tracing: unsupported endpoint scheme: grpc":    {Endpoint: "grpc://collector:4317"},
+		"invalid tracing: sample ratio must be between 0 and 1": {Endpoint: "http://collector", SampleRatio: &ratio},
+		"invalid tracing: batch size is negative":               {Endpoint: "http://collector", BatchSize: -1},
+	}
+	for expectedError, tracing := range expectations {
+		config := buildConfiguration()
+		config.Tracing = tracing
+		_, err := config.validate()
+		if err == nil || !strings.Contains(err.Error(), expectedError) {
+			t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+		}
+	}
+}
+
+// collectorStub is an OTLP/HTTP collector which keeps the spans it receives.
+type collectorStub struct {
+	*httptest.Server
+	mutex sync.Mutex
+	spans []otlpSpan
+}
+
+func newCollectorStub() *collectorStub {
+	collector := &collectorStub{}
+	collector.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var exported otlpExportRequest
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" || json.NewDecoder(r.Body).Decode(&exported) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		collector.mutex.Lock()
+		defer collector.mutex.Unlock()
+		for _, resourceSpans := range exported.ResourceSpans {
+			for _, scopeSpans := range resourceSpans.ScopeSpans {
+				collector.spans = append(collector.spans, scopeSpans.Spans...)
+			}
+		}
+	}))
+	return collector
+}
+
+func (collector *collectorStub) received() []otlpSpan {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+	return append([]otlpSpan{}, collector.spans...)
+}
+
+func TestProxyExportsSpansForEachAttempt(t *testing.T) {
+	collector := newCollectorStub()
+	defer collector.Close()
+	var attempts int32
+	var traceparents sync.Map
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempt := atomic.AddInt32(&attempts, 1)
+		traceparents.Store(attempt, r.Header.Get("Traceparent"))
+		if attempt == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer backend.Close()
+
+	config := buildConfiguration()
+	config.Routes[0] = &RouteRule{Name: "api", Path: "/api", Endpoint: backend.URL, Retry: &RetryConfiguration{Attempts: 2, Backoff: time.Millisecond}}
+	config.Tracing = &TracingConfiguration{Endpoint: collector.URL}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	request := httptest.NewRequest("GET", "/api", nil)
+	request.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	request.Header.Set("Tracestate", "vendor=one")
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status\nexpected: %v\nreceived: %v", http.StatusOK, recorder.Code)
+	}
+	h.Close()
+
+	spans := collector.received()
+	if len(spans) != 3 {
+		t.Fatalf("unexpected number of spans\nexpected: %v\nreceived: %v", 3, len(spans))
+	}
+	var server otlpSpan
+	clients := map[string]otlpSpan{}
+	for _, span := range spans {
+		if span.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || span.TraceState != "vendor=one" {
+			t.Errorf("expected span to continue the incoming trace\nexpected: %v\nreceived: %+v", "4bf92f3577b34da6a3ce929d0e0e4736", span)
+		}
+		if span.Kind == spanKindServer {
+			server = span
+		} else {
+			clients[span.SpanID] = span
+		}
+	}
+	if server.ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("unexpected server span parent\nexpected: %v\nreceived: %v", "00f067aa0ba902b7", server.ParentSpanID)
+	}
+	for attempt := int32(1); attempt <= 2; attempt++ {
+		traceparent, _ := traceparents.Load(attempt)
+		fields := strings.Split(traceparent.(string), "-")
+		client, ok := clients[fields[2]]
+		if !ok || client.ParentSpanID != server.SpanID {
+			t.Errorf("expected attempt %d to carry its client span\nexpected: %v\nreceived: %v", attempt, server.SpanID, traceparent)
+		}
+		if failed := client.Status.Code == 2; failed != (attempt == 1) {
+			t.Errorf("unexpected status of attempt %d\nexpected: %v\nreceived: %+v", attempt, attempt == 1, client.Status)
+		}
+	}
+}
+
+func TestProxyStartsTraceWithoutTraceparent(t *testing.T) {
+	collector := newCollectorStub()
+	defer collector.Close()
+	var traceparent atomic.Value
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent.Store(r.Header.Get("Traceparent"))
+	}))
+	defer backend.Close()
+
+	ratio := 0.0
+	config := buildConfiguration()
+	config.Routes[0] = &RouteRule{Path: "/api", Endpoint: backend.URL}
+	config.Tracing = &TracingConfiguration{Endpoint: collector.URL, SampleRatio: &ratio}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api", nil))
+	h.Close()
+
+	header := http.Header{}
+	header.Set("Traceparent", traceparent.Load().(string))
+	if parent, ok := parseTraceparent(header); !ok || parent.Sampled {
+		t.Errorf("expected an unsampled trace to be started\nexpected: %v\nreceived: %v", "valid traceparent with flags 00", header.Get("Traceparent"))
+	}
+	if spans := collector.received(); len(spans) != 0 {
+		t.Errorf("expected unsampled spans not to be exported\nexpected: %v\nreceived: %v", 0, len(spans))
+	}
+}
+
+func TestTracerCloseIsIdempotent(t *testing.T) {
+	collector := newCollectorStub()
+	defer collector.Close()
+
+	config := buildConfiguration()
+	config.Tracing = &TracingConfiguration{Endpoint: collector.URL}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	tracer := h.configuration().Tracer
+	h.Close()
+	config.Tracing = &TracingConfiguration{Endpoint: collector.URL + "/other"}
+	if err := h.Reload(config); err != nil {
+		t.Fatalf("unable to reload proxyhandler: %s", err.Error())
+	}
+	h.Close()
+
+	tracer.enqueue(&span{})
+	if len(tracer.queued) != 0 {
+		t.Errorf("expected spans finished after close to be dropped\nexpected: %v\nreceived: %v", 0, len(tracer.queued))
+	}
+}
+
+func TestReloadDoesNotWaitForPreviousTracer(t *testing.T) {
+	release := make(chan struct{})
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer collector.Close()
+	defer close(release)
+
+	config := buildConfiguration()
+	config.Tracing = &TracingConfiguration{Endpoint: collector.URL}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	defer h.Close()
+	h.configuration().Tracer.enqueue(&span{})
+
+	start := time.Now()
+	config.Tracing = nil
+	if err := h.Reload(config); err != nil {
+		t.Fatalf("unable to reload proxyhandler: %s", err.Error())
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected reload not to wait for spans to be exported\nexpected: %v\nreceived: %v", "under 1s", elapsed)
+	}
+}
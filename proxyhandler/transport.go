@@ -0,0 +1,278 @@
+package proxyhandler
+
+import (
+	"fmt"
+	"github.com/gorilla/websocket"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// TransportConfiguration controls the connections made to backends. Zero
+// values fall back to the defaults used by http.DefaultTransport. When set on
+// a RouteRule, any non-zero field overrides the value set on the
+// Configuration. HTTP2 allows HTTP/2 to be negotiated with https backends and
+// H2C sends requests to http backends using HTTP/2 without TLS, which those
+// backends must support, as is common for gRPC services. TLS controls the
+// verification of https and wss backends and replaces the whole TLS section
+// of the Configuration when set on a RouteRule.
+type TransportConfiguration struct {
+	DialTimeout           time.Duration            `yaml:"dial_timeout"`
+	TLSHandshakeTimeout   time.Duration            `yaml:"tls_handshake_timeout"`
+	ResponseHeaderTimeout time.Duration            `yaml:"response_header_timeout"`
+	IdleConnTimeout       time.Duration            `yaml:"idle_conn_timeout"`
+	MaxIdleConnsPerHost   int                      `yaml:"max_idle_conns_per_host"`
+	DisableKeepAlives     *bool                    `yaml:"disable_keep_alives"`
+	HTTP2                 *bool                    `yaml:"http2"`
+	H2C                   *bool                    `yaml:"h2c"`
+	TLS                   *BackendTLSConfiguration `yaml:"tls"`
+}
+
+// transportSettings is a resolved TransportConfiguration. It is comparable so
+// it may be used to key the transport shared by requests to a backend.
+type transportSettings struct {
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	IdleConnTimeout       time.Duration
+	MaxIdleConnsPerHost   int
+	DisableKeepAlives     bool
+	HTTP2                 bool
+	H2C                   bool
+	TLS                   backendTLSSettings
+}
+
+var defaultTransportSettings = transportSettings{
+	DialTimeout:         30 * time.Second,
+	TLSHandshakeTimeout: 10 * time.Second,
+	IdleConnTimeout:     90 * time.Second,
+	MaxIdleConnsPerHost: http.DefaultMaxIdleConnsPerHost,
+	HTTP2:               true,
+}
+
+func (transport *TransportConfiguration) validate() error {
+	if transport == nil {
+		return nil
+	}
+	var durations = map[string]time.Duration{
+		"dial timeout":            transport.DialTimeout,
+		"tls handshake timeout":   transport.TLSHandshakeTimeout,
+		"response header timeout": transport.ResponseHeaderTimeout,
+		"idle conn timeout":       transport.IdleConnTimeout,
+	}
+	for name, duration := range durations {
+		if duration < 0 {
+			return fmt.Errorf("%s is negative", name)
+		}
+	}
+	if transport.MaxIdleConnsPerHost < 0 {
+		return fmt.Errorf("max idle conns per host is negative")
+	}
+	if err := transport.TLS.validate(); err != nil {
+		return fmt.Errorf("invalid tls: %s", err.Error())
+	}
+	return nil
+}
+
+// apply returns settings overridden by each non-zero field of transport.
+func (transport *TransportConfiguration) apply(settings transportSettings) transportSettings {
+	if transport == nil {
+		return settings
+	}
+	if transport.DialTimeout > 0 {
+		settings.DialTimeout = transport.DialTimeout
+	}
+	if transport.TLSHandshakeTimeout > 0 {
+		settings.TLSHandshakeTimeout = transport.TLSHandshakeTimeout
+	}
+	if transport.ResponseHeaderTimeout > 0 {
+		settings.ResponseHeaderTimeout = transport.ResponseHeaderTimeout
+	}
+	if transport.IdleConnTimeout > 0 {
+		settings.IdleConnTimeout = transport.IdleConnTimeout
+	}
+	if transport.MaxIdleConnsPerHost > 0 {
+		settings.MaxIdleConnsPerHost = transport.MaxIdleConnsPerHost
+	}
+	if transport.DisableKeepAlives != nil {
+		settings.DisableKeepAlives = *transport.DisableKeepAlives
+	}
+	if transport.HTTP2 != nil {
+		settings.HTTP2 = *transport.HTTP2
+	}
+	if transport.H2C != nil {
+		settings.H2C = *transport.H2C
+	}
+	if transport.TLS != nil {
+		settings.TLS = transport.TLS.settings()
+	}
+	return settings
+}
+
+// newTransport builds the http.RoundTripper used to reach a backend. It is a
+// variable so that tests may substitute a mock transport.
+var newTransport = buildTransport
+
+func buildTransport(settings transportSettings) http.RoundTripper {
+	tlsConfig, err := settings.TLS.clientConfig()
+	if err != nil {
+		return failingTransport{err: err}
+	}
+	dialer := &net.Dialer{
+		Timeout:   settings.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   settings.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: settings.ResponseHeaderTimeout,
+		IdleConnTimeout:       settings.IdleConnTimeout,
+		MaxIdleConnsPerHost:   settings.MaxIdleConnsPerHost,
+		DisableKeepAlives:     settings.DisableKeepAlives,
+		Protocols:             transportProtocols(settings),
+	}
+}
+
+// transportProtocols returns the protocols used to reach a backend. h2c is
+// only used for http backends when HTTP/1 is not also allowed, so a transport
+// using it speaks HTTP/2 to every backend.
+func transportProtocols(settings transportSettings) *http.Protocols {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(!settings.H2C)
+	protocols.SetHTTP2(settings.HTTP2 || settings.H2C)
+	protocols.SetUnencryptedHTTP2(settings.H2C)
+	return protocols
+}
+
+// failingTransport fails every request with err. It is used when the files
+// named by the TLS settings of a transport can no longer be loaded, and is not
+// kept by the transportPool so that the files are loaded again by the next
+// request.
+type failingTransport struct {
+	err error
+}
+
+func (transport failingTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, transport.err
+}
+
+// buildWebsocketDialer builds the dialer used to reach ws and wss backends.
+func buildWebsocketDialer(settings transportSettings) (*websocket.Dialer, error) {
+	tlsConfig, err := settings.TLS.clientConfig()
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{
+		Timeout:   settings.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	return &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		NetDialContext:   dialer.DialContext,
+		HandshakeTimeout: settings.TLSHandshakeTimeout,
+		TLSClientConfig:  tlsConfig,
+	}, nil
+}
+
+type transportKey struct {
+	backend  string
+	settings transportSettings
+}
+
+func newTransportKey(backendURL *url.URL, settings transportSettings) transportKey {
+	return transportKey{backend: backendURL.Scheme + "://" + backendURL.Host, settings: settings}
+}
+
+// transportPool shares one http.RoundTripper, and so one pool of connections,
+// between every request made to the same backend with the same settings. It
+// also shares the websocket.Dialer of each settings so that their TLS files
+// are not loaded for every connection.
+type transportPool struct {
+	mutex      sync.RWMutex
+	transports map[transportKey]http.RoundTripper
+	dialers    map[transportSettings]*websocket.Dialer
+}
+
+func newTransportPool() *transportPool {
+	return &transportPool{
+		transports: make(map[transportKey]http.RoundTripper),
+		dialers:    make(map[transportSettings]*websocket.Dialer),
+	}
+}
+
+func (pool *transportPool) roundTripper(backendURL *url.URL, settings transportSettings) http.RoundTripper {
+	key := newTransportKey(backendURL, settings)
+	pool.mutex.RLock()
+	transport, ok := pool.transports[key]
+	pool.mutex.RUnlock()
+	if ok {
+		return transport
+	}
+
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	if transport, ok := pool.transports[key]; ok {
+		return transport
+	}
+	transport = newTransport(settings)
+	if _, failed := transport.(failingTransport); !failed {
+		pool.transports[key] = transport
+	}
+	return transport
+}
+
+func (pool *transportPool) websocketDialer(settings transportSettings) (*websocket.Dialer, error) {
+	pool.mutex.RLock()
+	dialer, ok := pool.dialers[settings]
+	pool.mutex.RUnlock()
+	if ok {
+		return dialer, nil
+	}
+
+	dialer, err := buildWebsocketDialer(settings)
+	if err != nil {
+		return nil, err
+	}
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	if existing, ok := pool.dialers[settings]; ok {
+		return existing, nil
+	}
+	pool.dialers[settings] = dialer
+	return dialer, nil
+}
+
+// retain closes and forgets any transport or dialer which is not used by
+// config. Those which load TLS files are forgotten too, so that a reload picks
+// up certificates which have been replaced.
+func (pool *transportPool) retain(config *validConfiguration) {
+	var used = map[transportKey]struct{}{}
+	var usedSettings = map[transportSettings]struct{}{}
+	for _, route := range append([]*validRouteRule{config.DefaultRouteRule}, config.Routes...) {
+		usedSettings[route.TransportSettings] = struct{}{}
+		for _, backend := range route.Backends {
+			used[newTransportKey(backend.URL, route.TransportSettings)] = struct{}{}
+		}
+	}
+
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	for settings := range pool.dialers {
+		if _, ok := usedSettings[settings]; !ok || settings.TLS.loadsFiles() {
+			delete(pool.dialers, settings)
+		}
+	}
+	for key, transport := range pool.transports {
+		if _, ok := used[key]; ok && !key.settings.TLS.loadsFiles() {
+			continue
+		}
+		if closer, ok := transport.(interface{ CloseIdleConnections() }); ok {
+			closer.CloseIdleConnections()
+		}
+		delete(pool.transports, key)
+	}
+}
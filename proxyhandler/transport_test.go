@@ -0,0 +1,139 @@
+package proxyhandler
+
+import (
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTransportConfigurationOverridesDefaults(t *testing.T) {
+	disabled := false
+	config := buildConfiguration()
+	config.Transport = TransportConfiguration{DialTimeout: 5 * time.Second}
+	config.Routes[0].Transport = &TransportConfiguration{
+		ResponseHeaderTimeout: 2 * time.Second,
+		HTTP2:                 &disabled,
+	}
+
+	validConfig, err := config.validate()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	expectedDefault := defaultTransportSettings
+	expectedDefault.DialTimeout = 5 * time.Second
+	if validConfig.TransportSettings != expectedDefault {
+		t.Errorf("unexpected default transport\nexpected: %+v\nreceived: %+v", expectedDefault, validConfig.TransportSettings)
+	}
+	expectedRoute := expectedDefault
+	expectedRoute.ResponseHeaderTimeout = 2 * time.Second
+	expectedRoute.HTTP2 = false
+	if validConfig.Routes[0].TransportSettings != expectedRoute {
+		t.Errorf("unexpected route transport\nexpected: %+v\nreceived: %+v", expectedRoute, validConfig.Routes[0].TransportSettings)
+	}
+}
+
+func TestTransportConfigurationRejectsNegativeValues(t *testing.T) {
+	expectedError := "invalid transport: dial timeout is negative"
+	config := buildConfiguration()
+	config.Transport = TransportConfiguration{DialTimeout: -1}
+
+	_, err := config.validate()
+	if err == nil {
+		t.Fatal("expected config to be invalid")
+	}
+	if !strings.Contains(err.Error(), expectedError) {
+		t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err.Error())
+	}
+
+	expectedError = "invalid transport: max idle conns per host is negative"
+	config = buildConfiguration()
+	config.Routes[0].Transport = &TransportConfiguration{MaxIdleConnsPerHost: -1}
+	_, err = config.validate()
+	if err == nil {
+		t.Fatal("expected config to be invalid")
+	}
+	if !strings.Contains(err.Error(), expectedError) {
+		t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err.Error())
+	}
+}
+
+func TestBuildTransportAppliesSettings(t *testing.T) {
+	settings := defaultTransportSettings
+	settings.ResponseHeaderTimeout = 3 * time.Second
+	settings.MaxIdleConnsPerHost = 42
+	settings.HTTP2 = false
+
+	transport := buildTransport(settings).(*http.Transport)
+	if transport.ResponseHeaderTimeout != settings.ResponseHeaderTimeout {
+		t.Errorf("unexpected response header timeout\nexpected: %v\nreceived: %v", settings.ResponseHeaderTimeout, transport.ResponseHeaderTimeout)
+	}
+	if transport.MaxIdleConnsPerHost != settings.MaxIdleConnsPerHost {
+		t.Errorf("unexpected max idle conns per host\nexpected: %v\nreceived: %v", settings.MaxIdleConnsPerHost, transport.MaxIdleConnsPerHost)
+	}
+	if transport.Protocols.HTTP2() || transport.Protocols.UnencryptedHTTP2() || !transport.Protocols.HTTP1() {
+		t.Errorf("unexpected protocols\nexpected: %v\nreceived: %v", "{HTTP1}", transport.Protocols)
+	}
+
+	settings.H2C = true
+	transport = buildTransport(settings).(*http.Transport)
+	if transport.Protocols.HTTP1() || !transport.Protocols.UnencryptedHTTP2() {
+		t.Errorf("unexpected protocols\nexpected: %v\nreceived: %v", "{HTTP2,UnencryptedHTTP2}", transport.Protocols)
+	}
+}
+
+func TestTransportPoolReusesTransportPerBackend(t *testing.T) {
+	pool := newTransportPool()
+	one, _ := url.Parse("http://one")
+	onePath, _ := url.Parse("http://one/path")
+	two, _ := url.Parse("http://two")
+
+	transport := pool.roundTripper(one, defaultTransportSettings)
+	if pool.roundTripper(onePath, defaultTransportSettings) != transport {
+		t.Error("expected transport to be reused for the same backend")
+	}
+	if pool.roundTripper(two, defaultTransportSettings) == transport {
+		t.Error("expected a different transport for another backend")
+	}
+	tuned := defaultTransportSettings
+	tuned.DialTimeout = time.Second
+	if pool.roundTripper(one, tuned) == transport {
+		t.Error("expected a different transport for different settings")
+	}
+}
+
+func TestTransportPoolRetainsTransportsInUse(t *testing.T) {
+	pool := newTransportPool()
+	config, err := buildConfiguration().validate()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	stale, _ := url.Parse("http://stale")
+	used := pool.roundTripper(config.Routes[0].EndpointURL, config.Routes[0].TransportSettings)
+	pool.roundTripper(stale, defaultTransportSettings)
+
+	pool.retain(config)
+	if len(pool.transports) != 1 {
+		t.Errorf("unexpected number of transports\nexpected: %v\nreceived: %v", 1, len(pool.transports))
+	}
+	if pool.roundTripper(config.Routes[0].EndpointURL, config.Routes[0].TransportSettings) != used {
+		t.Error("expected transport in use to be retained")
+	}
+}
+
+func TestTransportPoolDoesNotKeepFailingTransports(t *testing.T) {
+	pool := newTransportPool()
+	backend, _ := url.Parse("https://one")
+	settings := defaultTransportSettings
+	settings.TLS = backendTLSSettings{CAFile: filepath.Join(t.TempDir(), "ca.pem")}
+
+	if _, failed := pool.roundTripper(backend, settings).(failingTransport); !failed {
+		t.Fatal("expected a failing transport while the ca file is missing")
+	}
+	if len(pool.transports) != 0 {
+		t.Errorf("unexpected number of transports\nexpected: %v\nreceived: %v", 0, len(pool.transports))
+	}
+}
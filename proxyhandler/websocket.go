@@ -0,0 +1,124 @@
+package proxyhandler
+
+import (
+	"fmt"
+	"github.com/gorilla/websocket"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// websocketUpgrader accepts websocket handshakes from clients. CORS
+// same-origin verification is disabled within the proxy and left to the
+// backends.
+var websocketUpgrader = &websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     func(r *http.Request) bool { return true },
+}
+
+// websocketProxy relays a websocket session between a client and the backend
+// at the URL returned by Backend. Director may add headers to the handshake
+// sent to the backend, and ResponseHeader is added to the handshake response
+// sent to the client.
+type websocketProxy struct {
+	Director       func(incoming *http.Request, out http.Header)
+	Backend        func(*http.Request) *url.URL
+	Dialer         *websocket.Dialer
+	ResponseHeader http.Header
+}
+
+// websocketForwardedHeaders describe the client of a websocket session and
+// are passed to the backend like those of http requests, subject to the
+// ForwardedHeaders of the configuration.
+var websocketForwardedHeaders = []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "Forwarded"}
+
+// backendHeader returns the headers of the handshake sent to the backend of
+// request.
+func (proxy *websocketProxy) backendHeader(config *validConfiguration, request *http.Request) http.Header {
+	header := http.Header{}
+	if origin := request.Header.Get("Origin"); len(origin) > 0 {
+		header.Add("Origin", origin)
+	}
+	for _, protocol := range request.Header[http.CanonicalHeaderKey("Sec-WebSocket-Protocol")] {
+		header.Add("Sec-WebSocket-Protocol", protocol)
+	}
+	for _, name := range append([]string{"Cookie"}, websocketForwardedHeaders...) {
+		for _, value := range request.Header[name] {
+			header.Add(name, value)
+		}
+	}
+	if len(request.Host) > 0 {
+		header.Set("Host", request.Host)
+	}
+	config.ForwardedHeaders.apply(header, request)
+	if proxy.Director != nil {
+		proxy.Director(request, header)
+	}
+	return header
+}
+
+// serve relays the websocket session of request, answering with the error
+// pages of config when the backend cannot be reached.
+func (proxy *websocketProxy) serve(config *validConfiguration, writer http.ResponseWriter, request *http.Request) {
+	backendURL := proxy.Backend(request)
+	backendConnection, response, err := proxy.Dialer.DialContext(request.Context(), backendURL.String(), proxy.backendHeader(config, request))
+	if err != nil {
+		if response == nil {
+			writeError(config, writer, request, &proxyError{
+				Status: http.StatusBadGateway,
+				Err:    fmt.Errorf("unable to dial websocket backend %s: %s", backendURL.String(), err.Error()),
+			})
+			return
+		}
+		// Relay the response of a backend which refused the handshake.
+		logRequestf(request, "websocket backend %s refused handshake with status %d", backendURL.String(), response.StatusCode)
+		copyHeaders(writer.Header(), response.Header)
+		writer.WriteHeader(response.StatusCode)
+		io.Copy(writer, response.Body)
+		response.Body.Close()
+		return
+	}
+	defer backendConnection.Close()
+
+	upgradeHeader := http.Header{}
+	copyHeaders(upgradeHeader, proxy.ResponseHeader)
+	if protocol := response.Header.Get("Sec-Websocket-Protocol"); len(protocol) > 0 {
+		upgradeHeader.Set("Sec-Websocket-Protocol", protocol)
+	}
+	for _, cookie := range response.Header.Values("Set-Cookie") {
+		upgradeHeader.Add("Set-Cookie", cookie)
+	}
+	clientConnection, err := websocketUpgrader.Upgrade(writer, request, upgradeHeader)
+	if err != nil {
+		logRequestf(request, "unable to upgrade websocket %s: %s", request.URL.String(), err.Error())
+		return
+	}
+	defer clientConnection.Close()
+
+	errs := make(chan error, 2)
+	go relayWebsocketMessages(clientConnection, backendConnection, errs)
+	go relayWebsocketMessages(backendConnection, clientConnection, errs)
+	<-errs
+}
+
+// relayWebsocketMessages copies messages from source to destination until
+// either connection fails, passing on the close message of source.
+func relayWebsocketMessages(destination, source *websocket.Conn, errs chan<- error) {
+	for {
+		messageType, message, err := source.ReadMessage()
+		if err != nil {
+			closeMessage := websocket.FormatCloseMessage(websocket.CloseNormalClosure, fmt.Sprintf("%v", err))
+			if closeErr, ok := err.(*websocket.CloseError); ok && closeErr.Code != websocket.CloseNoStatusReceived {
+				closeMessage = websocket.FormatCloseMessage(closeErr.Code, closeErr.Text)
+			}
+			errs <- err
+			destination.WriteMessage(websocket.CloseMessage, closeMessage)
+			return
+		}
+		if err := destination.WriteMessage(messageType, message); err != nil {
+			errs <- err
+			return
+		}
+	}
+}
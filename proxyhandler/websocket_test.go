@@ -0,0 +1,164 @@
+package proxyhandler
+
+import (
+	"bytes"
+	"github.com/gorilla/websocket"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestWebsocketProxyRelaysMessages(t *testing.T) {
+	upgrader := websocket.Upgrader{Subprotocols: []string{"echo"}}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		connection, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer connection.Close()
+		messageType, message, err := connection.ReadMessage()
+		if err != nil {
+			return
+		}
+		connection.WriteMessage(messageType, append([]byte("echo: "), message...))
+	}))
+	defer backend.Close()
+
+	config := buildConfiguration()
+	config.Routes = []*RouteRule{{Path: "/ws", Endpoint: "ws://" + strings.TrimPrefix(backend.URL, "http://")}}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	defer h.Close()
+	proxy := httptest.NewServer(h)
+	defer proxy.Close()
+
+	dialer := websocket.Dialer{Subprotocols: []string{"echo"}}
+	connection, _, err := dialer.Dial("ws://"+strings.TrimPrefix(proxy.URL, "http://")+"/ws", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	defer connection.Close()
+	if protocol := connection.Subprotocol(); protocol != "echo" {
+		t.Errorf("unexpected subprotocol\nexpected: %v\nreceived: %v", "echo", protocol)
+	}
+	if err := connection.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	_, message, err := connection.ReadMessage()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if string(message) != "echo: hello" {
+		t.Errorf("unexpected message\nexpected: %v\nreceived: %v", "echo: hello", string(message))
+	}
+}
+
+func TestWebsocketProxyRelaysRefusedHandshake(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+	}))
+	defer backend.Close()
+
+	config := buildConfiguration()
+	config.Routes = []*RouteRule{{Path: "/ws", Endpoint: "ws://" + strings.TrimPrefix(backend.URL, "http://")}}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	defer h.Close()
+	proxy := httptest.NewServer(h)
+	defer proxy.Close()
+
+	_, response, err := websocket.DefaultDialer.Dial("ws://"+strings.TrimPrefix(proxy.URL, "http://")+"/ws", nil)
+	if err == nil {
+		t.Fatal("expected handshake to be refused")
+	}
+	if response == nil || response.StatusCode != http.StatusForbidden {
+		t.Errorf("unexpected status\nexpected: %v\nreceived: %v", http.StatusForbidden, response)
+	}
+}
+
+func TestWebsocketProxyAnswersUnreachableBackendWithErrorPage(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+
+	backend := httptest.NewServer(http.NotFoundHandler())
+	backend.Close()
+	config := buildConfiguration()
+	config.Routes = []*RouteRule{{Path: "/ws", Endpoint: "ws://" + strings.TrimPrefix(backend.URL, "http://")}}
+	config.ErrorPages = ErrorPagesConfiguration{JSON: `{"code":{{.Status}}}`}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	defer h.Close()
+
+	request := httptest.NewRequest("GET", "/ws", nil)
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Upgrade", "websocket")
+	request.Header.Set("Sec-WebSocket-Version", "13")
+	request.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	request.Header.Set("Accept", "application/json")
+	request.Header.Set("X-Request-Id", "unreachable")
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusBadGateway {
+		t.Errorf("unexpected status\nexpected: %v\nreceived: %v", http.StatusBadGateway, recorder.Code)
+	}
+	if body := recorder.Body.String(); body != `{"code":502}` {
+		t.Errorf("unexpected error page\nexpected: %v\nreceived: %v", `{"code":502}`, body)
+	}
+	if !strings.Contains(logged.String(), "proxy: [unreachable] request /ws failed with status 502") {
+		t.Errorf("expected request id in log\nexpected: %v\nreceived: %v", "unreachable", logged.String())
+	}
+}
+
+func TestWebsocketProxyForwardsHeaders(t *testing.T) {
+	var forwardedFor atomic.Value
+	upgrader := websocket.Upgrader{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwardedFor.Store(r.Header.Get("X-Forwarded-For"))
+		header := http.Header{}
+		header.Add("Set-Cookie", "first=1")
+		header.Add("Set-Cookie", "second=2")
+		connection, err := upgrader.Upgrade(w, r, header)
+		if err != nil {
+			return
+		}
+		connection.Close()
+	}))
+	defer backend.Close()
+
+	config := buildConfiguration()
+	config.Routes = []*RouteRule{{Path: "/ws", Endpoint: "ws://" + strings.TrimPrefix(backend.URL, "http://")}}
+	config.ForwardedHeaders = ForwardedConfiguration{XForwarded: true}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	defer h.Close()
+	proxy := httptest.NewServer(h)
+	defer proxy.Close()
+
+	header := http.Header{}
+	header.Set("X-Forwarded-For", "203.0.113.9")
+	connection, response, err := websocket.DefaultDialer.Dial("ws://"+strings.TrimPrefix(proxy.URL, "http://")+"/ws", header)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	connection.Close()
+	if forwardedFor.Load() != "127.0.0.1" {
+		t.Errorf("expected untrusted X-Forwarded-For to be replaced\nexpected: %v\nreceived: %v", "127.0.0.1", forwardedFor.Load())
+	}
+	if cookies := response.Header.Values("Set-Cookie"); strings.Join(cookies, " ") != "first=1 second=2" {
+		t.Errorf("unexpected cookies\nexpected: %v\nreceived: %v", "first=1 second=2", cookies)
+	}
+}